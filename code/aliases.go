@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Valid aliases: lower-case ASCII letters, digits, ".", "_" and "-", from 3 to 32 characters
+var aliasPattern = regexp.MustCompile("^[a-z0-9][a-z0-9._-]{2,31}$")
+
+// Node names (16 base32 characters), which aliases must not imitate
+var nodeNamePattern = regexp.MustCompile("^[a-z2-7]{16}$")
+
+// aliasClaim is a registration of an alias by a node.
+type aliasClaim struct {
+	Origin string
+	ID     uint32
+	Hash   []byte
+	Seen   string
+}
+
+// AliasRegistry keeps track of the aliases registered on the network.
+//
+// Any node can register an alias by publishing a KIND_ALIAS message, which requires extra proof-of-work (see
+// PowPolicy.AliasExtra). If several nodes register the same alias, the registration with the lowest hash wins,
+// exactly as for conflicting messages: all the nodes agree on the owner of an alias without any coordination,
+// but a later registration with a lower hash can take an alias over. Unlike node names, aliases are therefore not
+// self-authenticating: they are a convenience to find a node, and must not be trusted without checking its safety
+// number. Registrations are never pruned. The registry must only be used from the main thread.
+type AliasRegistry struct {
+	claims  map[string][]aliasClaim // Alias -> registrations
+	winners map[string]aliasClaim   // Alias -> winning registration (computed lazily, nil if outdated)
+}
+
+// AliasInfo describes the current owner of an alias (for the client).
+type AliasInfo struct {
+	Alias              string
+	Owner              string // Node that has registered the alias
+	Identity           string // Identity of the owner
+	Hash               string // Hash of the winning registration
+	Registered         string // Date on which the winning registration was first seen by this node
+	Claims             int    // Number of nodes that have registered the alias
+	SelfAuthenticating bool   // Always false: the alias does not prove anything about the key of its owner
+}
+
+func NewAliasRegistry() *AliasRegistry {
+	return &AliasRegistry{
+		claims: make(map[string][]aliasClaim),
+	}
+}
+
+// NormalizeAlias converts an alias to lower case, and checks that it is valid.
+func NormalizeAlias(alias string) (string, error) {
+	alias = strings.ToLower(strings.TrimSpace(alias))
+	if !aliasPattern.MatchString(alias) {
+		return "", errors.New("an alias must contain 3 to 32 letters, digits, \".\", \"_\" or \"-\"")
+	} else if nodeNamePattern.MatchString(alias) {
+		return "", errors.New("an alias cannot look like a node name")
+	}
+	return alias, nil
+}
+
+// Rebuild loads the alias registrations from the message store.
+func (r *AliasRegistry) Rebuild() error {
+	r.claims = make(map[string][]aliasClaim)
+	r.winners = nil
+	messages, err := Context.Database.GetAllMessagesOfKind(KIND_ALIAS)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		r.Add(m)
+	}
+	return nil
+}
+
+// Add records an alias registration (other messages, and registrations of invalid aliases, are ignored).
+// A registration replaces the previous version of the message with the same (origin, ID) pair.
+func (r *AliasRegistry) Add(m *MessageRecord) {
+	if m.Data.Kind != KIND_ALIAS || m.Pruned || m.Data.ID == 0 || m.Data.Destination != "" {
+		return
+	}
+	alias, err := NormalizeAlias(string(m.Data.Content))
+	if err != nil || alias != string(m.Data.Content) {
+		return
+	}
+	for other, claims := range r.claims {
+		for i, claim := range claims {
+			if claim.Origin == m.Data.Origin && claim.ID == m.Data.ID {
+				r.claims[other] = append(claims[:i], claims[i+1:]...)
+				break
+			}
+		}
+	}
+	claim := aliasClaim{m.Data.Origin, m.Data.ID, m.Data.ComputeHash(), m.DateSeen}
+	r.claims[alias] = append(r.claims[alias], claim)
+	r.winners = nil
+}
+
+// winner returns the registration of an alias with the lowest hash.
+func (r *AliasRegistry) winner(alias string) (aliasClaim, bool) {
+	if r.winners == nil {
+		r.winners = make(map[string]aliasClaim)
+		for other, claims := range r.claims {
+			for _, claim := range claims {
+				if best, found := r.winners[other]; !found || bytes.Compare(claim.Hash, best.Hash) < 0 {
+					r.winners[other] = claim
+				}
+			}
+		}
+	}
+	claim, found := r.winners[alias]
+	return claim, found
+}
+
+// Lookup returns the current owner of an alias.
+func (r *AliasRegistry) Lookup(alias string) (AliasInfo, bool) {
+	alias, err := NormalizeAlias(alias)
+	if err != nil {
+		return AliasInfo{}, false
+	}
+	claim, found := r.winner(alias)
+	if !found {
+		return AliasInfo{}, false
+	}
+	origins := make(map[string]bool)
+	for _, other := range r.claims[alias] {
+		origins[other.Origin] = true
+	}
+	return AliasInfo{
+		Alias:      alias,
+		Owner:      claim.Origin,
+		Identity:   Context.Devices.IdentityOf(claim.Origin),
+		Hash:       hex.EncodeToString(claim.Hash),
+		Registered: claim.Seen,
+		Claims:     len(origins),
+	}, true
+}
+
+// All returns the owners of all the registered aliases, sorted by alias.
+func (r *AliasRegistry) All() []AliasInfo {
+	output := make([]AliasInfo, 0, len(r.claims))
+	for alias := range r.claims {
+		if info, found := r.Lookup(alias); found {
+			output = append(output, info)
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Alias < output[j].Alias
+	})
+	return output
+}
+
+// AliasesOf returns the aliases owned by the identity of a node (by any of its devices), sorted by alias.
+func (r *AliasRegistry) AliasesOf(name string) []string {
+	identity := Context.Devices.IdentityOf(name)
+	output := make([]string, 0)
+	for alias := range r.claims {
+		if claim, found := r.winner(alias); found && Context.Devices.IdentityOf(claim.Origin) == identity {
+			output = append(output, alias)
+		}
+	}
+	sort.Strings(output)
+	return output
+}
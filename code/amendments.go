@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// MessageRef references a message, by (origin, ID) pair or by hash. If both are given, the message with the
+// (origin, ID) pair must have the hash, which pins the version of the message in case of conflicting messages.
+type MessageRef struct {
+	Origin string // Can be omitted if it is implied (e.g. the origin of an edit)
+	ID     uint32
+	Hash   []byte
+}
+
+// errUnresolvedRef is returned when a reference does not match any stored message.
+var errUnresolvedRef = errors.New("the referenced message is unknown")
+
+// ErrLegacyFormat is returned when deleting a message in the legacy format, whose tombstone could not be forwarded
+// (see Tombstone).
+var ErrLegacyFormat = errors.New("messages in the legacy format cannot be deleted")
+
+// Resolve returns the referenced message (possibly a tombstone), using the given origin if the reference does not
+// have one. Returns errUnresolvedRef if the message is unknown, or if it does not have the expected hash.
+func (r MessageRef) Resolve(origin string) (*MessageRecord, error) {
+	if r.Origin != "" {
+		origin = r.Origin
+	}
+	var m *MessageRecord
+	var err error
+	if r.ID > 0 {
+		m, err = Context.Database.GetMessage(origin, r.ID)
+	} else if len(r.Hash) > 0 {
+		m, err = Context.Database.GetMessageByHash(r.Hash)
+	}
+	if err != nil {
+		return nil, err
+	} else if m == nil || (len(r.Hash) > 0 && !bytes.Equal(m.MessageHash(), r.Hash)) {
+		return nil, errUnresolvedRef
+	}
+	return m, nil
+}
+
+// Amendment is the content of the KIND_EDIT messages: the new content of a text message (or reply). Edits are signed by the
+// origin of the edited message, and they are sent to the conversation of the edited message (encrypted like it).
+type Amendment struct {
+	Target  MessageRef // Edited message (the origin is the origin of the edit)
+	Content string     // New content
+}
+
+// Deletion is the content of the KIND_DELETE messages, which list the messages purged by their origin (a message
+// and its edits). Deletions are always public, so that every node can purge the content of the private messages,
+// even though it cannot read them.
+type Deletion struct {
+	Targets []MessageRef // Purged messages (the origin is the origin of the deletion)
+}
+
+// editEntry is the latest edit of a message.
+type editEntry struct {
+	Edit    uint32 // ID of the edit message
+	Content string
+	Date    string // Date on which the edit was first seen by this node
+}
+
+// EditIndex keeps track of the latest edit of the messages readable by a local identity. Like the SearchIndex,
+// it is rebuilt from the message store when the node starts. It must only be used from the main thread.
+type EditIndex struct {
+	owner *LocalIdentity
+	edits map[messageKey]editEntry // Edited message -> latest edit
+}
+
+func NewEditIndex(owner *LocalIdentity) *EditIndex {
+	return &EditIndex{
+		owner: owner,
+		edits: make(map[messageKey]editEntry),
+	}
+}
+
+// Rebuild loads the edits readable by the owner from the message store.
+func (e *EditIndex) Rebuild() error {
+	e.edits = make(map[messageKey]editEntry)
+	messages, err := Context.Database.GetAllMessagesOfKind(KIND_EDIT)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if _, err := e.Add(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAmendment returns the amendment carried by an edit message, if the owner can read it.
+func (e *EditIndex) readAmendment(m *MessageRecord) (*Amendment, bool) {
+	content, _, err := e.owner.readContent(m)
+	if err != nil {
+		return nil, false
+	}
+	var amendment Amendment
+	if err := json.Unmarshal(content, &amendment); err != nil {
+		return nil, false
+	}
+	return &amendment, true
+}
+
+// Add records an edit (other messages, unreadable edits, and edits that do not apply to a text message of the same
+// origin, destination and channel are ignored). Returns the edited message if the edit is its latest one.
+func (e *EditIndex) Add(m *MessageRecord) (*MessageRecord, error) {
+	if m.Data.Kind != KIND_EDIT || m.Pruned || m.Data.ID == 0 {
+		return nil, nil
+	}
+	amendment, ok := e.readAmendment(m)
+	if !ok || (amendment.Target.Origin != "" && amendment.Target.Origin != m.Data.Origin) {
+		return nil, nil
+	}
+	target, err := amendment.Target.Resolve(m.Data.Origin)
+	if err == errUnresolvedRef {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if target.Pruned || !isTextKind(target.Data.Kind) || target.Data.Origin != m.Data.Origin ||
+		target.Data.ID == 0 || target.Data.Destination != m.Data.Destination ||
+		!bytes.Equal(target.Data.Channel, m.Data.Channel) {
+		return nil, nil
+	}
+	key := messageKey{target.Data.Origin, target.Data.ID}
+	if current, found := e.edits[key]; found && current.Edit > m.Data.ID {
+		return nil, nil
+	}
+	e.edits[key] = editEntry{m.Data.ID, amendment.Content, m.DateSeen}
+	return target, nil
+}
+
+// Get returns the latest edit of a message.
+func (e *EditIndex) Get(key messageKey) (editEntry, bool) {
+	entry, found := e.edits[key]
+	return entry, found
+}
+
+// Remove forgets the edits of a message (if it has been pruned), or the edit itself (if the edit has been pruned).
+func (e *EditIndex) Remove(key messageKey) {
+	delete(e.edits, key)
+	for target, entry := range e.edits {
+		if target.Origin == key.Origin && entry.Edit == key.ID {
+			delete(e.edits, target)
+		}
+	}
+}
+
+// applyDeletion purges the messages listed by a deletion, which must have the same origin as the deletion.
+// The messages are replaced with tombstones, so that the IDs of the origin remain contiguous. Messages in the legacy
+// format are ignored: their tombstones could not be forwarded to the nodes that have not received them yet.
+func (c *contextType) applyDeletion(m *MessageRecord) error {
+	if m.Data.Kind != KIND_DELETE || m.Pruned || m.Data.ID == 0 || m.Data.Destination != "" {
+		return nil
+	}
+	var deletion Deletion
+	if err := json.Unmarshal(m.Data.Content, &deletion); err != nil {
+		return nil
+	}
+	purged := make([]*MessageRecord, 0, len(deletion.Targets))
+	for _, ref := range deletion.Targets {
+		if ref.Origin != "" && ref.Origin != m.Data.Origin {
+			continue
+		}
+		target, err := ref.Resolve(m.Data.Origin)
+		if err == errUnresolvedRef {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !target.Pruned && target.Data.Origin == m.Data.Origin && target.Data.ID > 0 &&
+			target.Data.Format == FORMAT_DIGEST && (isTextKind(target.Data.Kind) || target.Data.Kind == KIND_EDIT) {
+			purged = append(purged, target)
+		}
+	}
+	_, err := c.pruneMessages(purged)
+	return err
+}
+
+// forgetMessage removes a message that has been pruned from the in-memory indexes of the local identities.
+func (c *contextType) forgetMessage(key messageKey) {
+	for _, id := range c.Identities {
+		id.Search.Remove(key)
+		id.Edits.Remove(key)
+		id.Threads.Remove(key)
+	}
+}
+
+// EditMessage submits an edit of a text message sent by this local identity (from this device).
+func (id *LocalIdentity) EditMessage(target *MessageRecord, content string) (Job, error) {
+	data, _ := json.Marshal(Amendment{Target: MessageRef{ID: target.Data.ID, Hash: target.MessageHash()},
+		Content: content})
+	return id.Jobs.Submit(&OutgoingMessage{Kind: KIND_EDIT, Destination: target.Data.Destination,
+		Channel: hex.EncodeToString(target.Data.Channel), Content: string(data), TTL: target.Data.TTL})
+}
+
+// DeleteMessage submits the deletion of a text message sent by this local identity (from this device), along with
+// all its edits. Returns ErrLegacyFormat if the message is in the legacy format (its edits in the legacy format are
+// kept as well).
+func (id *LocalIdentity) DeleteMessage(target *MessageRecord) (Job, error) {
+	if target.Data.Format != FORMAT_DIGEST {
+		return Job{}, ErrLegacyFormat
+	}
+	targets := []MessageRef{{ID: target.Data.ID, Hash: target.MessageHash()}}
+	edits, err := Context.Database.GetAllMessagesOfKind(KIND_EDIT)
+	if err != nil {
+		return Job{}, err
+	}
+	for _, m := range edits {
+		if m.Data.Origin != id.DisplayName || m.Data.Format != FORMAT_DIGEST {
+			continue
+		}
+		amendment, ok := id.Edits.readAmendment(m)
+		if !ok {
+			continue
+		}
+		if edited, err := amendment.Target.Resolve(m.Data.Origin); err == nil && edited.Data.ID == target.Data.ID &&
+			edited.Data.Origin == target.Data.Origin {
+			targets = append(targets, MessageRef{ID: m.Data.ID, Hash: m.MessageHash()})
+		}
+	}
+	data, _ := json.Marshal(Deletion{Targets: targets})
+	return id.Jobs.Submit(&OutgoingMessage{Kind: KIND_DELETE, Content: string(data)})
+}
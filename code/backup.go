@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Magic bytes at the beginning of a backup archive
+const BACKUP_MAGIC = "APBACKUP"
+
+// Version of the backup format. Archives with a higher version are rejected (version 2 added the additional
+// identities, which older versions would silently drop).
+const BACKUP_FORMAT_VERSION = 2
+
+// Environment variable from which the passphrase of a backup is read (otherwise, it is read from the standard input)
+const BACKUP_PASSPHRASE_ENV = "GOSSIPER_PASSPHRASE"
+
+// Parameters of the Argon2id key derivation for the encryption key of new backups
+const (
+	BACKUP_KDF_TIME    = 3
+	BACKUP_KDF_MEMORY  = 64 * 1024 // KiB
+	BACKUP_KDF_THREADS = 4
+	BACKUP_SALT_LENGTH = 16
+)
+
+// Maximum ratio between the Argon2id parameters of an archive and the parameters of new backups
+const BACKUP_KDF_LIMIT = 4
+
+// BackupArchive is the content of a backup archive, which is stored as compressed JSON and encrypted
+// with a key derived from a passphrase.
+//
+// The archive starts with a header: BACKUP_MAGIC, the format version (uint16), the Argon2id parameters
+// (time and memory as uint32, threads as uint8), the salt, and the AES-GCM nonce. All integers are little-endian.
+// The header is authenticated along with the encrypted content.
+type BackupArchive struct {
+	Version       int    // BACKUP_FORMAT_VERSION
+	SchemaVersion int    // Schema version of the database from which the messages have been exported
+	Created       string // RFC 3339 date
+	Name          string // Display name of the identity
+	Key           []byte // Keypair, in the format of key.bin
+	Messages      []*MessageRecord
+	Outbox        []*OutgoingMessage
+	ReadMarks     []PeerStatus
+	Contacts      []*Contact
+	Channels      []*Channel         // Subscriptions, with the keys of the encrypted channels
+	Identities    []*IdentityArchive // Additional identities of the data directory (see LoadIdentity)
+	Peers         []string           // Peers from the config file
+	Config        []byte             // Config file of the data directory (empty if there is none)
+}
+
+// IdentityArchive contains the keypair and the state of a local identity. The default identity is stored in the
+// fields of the BackupArchive itself (as in the first version of the format), and the additional identities in
+// BackupArchive.Identities.
+type IdentityArchive struct {
+	Label     string // Label of the identity (see LoadIdentity), empty for the default identity
+	Name      string
+	Key       []byte // Keypair, in the format of key.bin
+	Outbox    []*OutgoingMessage
+	ReadMarks []PeerStatus
+	Contacts  []*Contact
+	Channels  []*Channel
+}
+
+// subcommands are the alternative entry points of the gossiper (e.g. "gossiper backup ...").
+// They receive the remaining arguments and return the exit code.
+var subcommands = map[string]func(args []string) int{
+	"backup":  runBackup,
+	"restore": runRestore,
+}
+
+// runBackup exports the identities, messages, outboxes, read marks and peers of a data directory to an encrypted
+// archive.
+func runBackup(args []string) int {
+	flags := flag.NewFlagSet("gossiper backup", flag.ContinueOnError)
+	dataDir := flags.String("dataDir", "", "the directory containing the DB and keys")
+	configPath := flags.String("config", "", "path of the config file (default: dataDir/"+CONFIG_FILE_NAME+")")
+	out := flags.String("out", "", "path of the archive to create")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return EXIT_OK
+	} else if err != nil {
+		return EXIT_CONFIG_ERROR
+	}
+	if *dataDir == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "you must specify the data directory (dataDir) and the archive path (out)")
+		return EXIT_CONFIG_ERROR
+	}
+	if *configPath == "" {
+		*configPath = filepath.Join(*dataDir, CONFIG_FILE_NAME)
+	}
+
+	passphrase, err := readPassphrase()
+	if err == nil {
+		err = createBackup(*dataDir, *configPath, *out, passphrase)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "backup failed: "+err.Error())
+		return EXIT_STARTUP_FAILURE
+	}
+	return EXIT_OK
+}
+
+// runRestore imports an archive created by runBackup into a data directory.
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("gossiper restore", flag.ContinueOnError)
+	dataDir := flags.String("dataDir", "", "the directory for storing the DB and keys")
+	in := flags.String("in", "", "path of the archive to restore")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return EXIT_OK
+	} else if err != nil {
+		return EXIT_CONFIG_ERROR
+	}
+	if *dataDir == "" || *in == "" {
+		fmt.Fprintln(os.Stderr, "you must specify the data directory (dataDir) and the archive path (in)")
+		return EXIT_CONFIG_ERROR
+	}
+
+	passphrase, err := readPassphrase()
+	if err == nil {
+		err = restoreBackup(*dataDir, *in, passphrase)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "restore failed: "+err.Error())
+		return EXIT_STARTUP_FAILURE
+	}
+	return EXIT_OK
+}
+
+// readPassphrase reads the passphrase of an archive from the environment, or else from the standard input.
+func readPassphrase() ([]byte, error) {
+	passphrase := os.Getenv(BACKUP_PASSPHRASE_ENV)
+	if passphrase == "" {
+		fmt.Fprint(os.Stderr, "Passphrase: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		passphrase = strings.TrimRight(line, "\r\n")
+	}
+	if passphrase == "" {
+		return nil, errors.New("the passphrase cannot be empty")
+	}
+	return []byte(passphrase), nil
+}
+
+// createBackup writes the archive of a data directory, with all its identities (the default one, and the ones stored
+// in dataDir/identities, whether or not they are listed in the config file).
+func createBackup(dataDir string, configPath string, out string, passphrase []byte) error {
+	keyBin, err := ioutil.ReadFile(filepath.Join(dataDir, "key.bin"))
+	if err != nil {
+		return err
+	}
+	_, pk, err := DecodeKeyPair(keyBin)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, DATABASE_FILE_NAME)); err != nil {
+		return err
+	}
+
+	archive := &BackupArchive{
+		Version:       BACKUP_FORMAT_VERSION,
+		SchemaVersion: SCHEMA_VERSION,
+		Created:       time.Now().Format(time.RFC3339),
+		Name:          pk.DeriveName(),
+		Key:           keyBin,
+		Identities:    make([]*IdentityArchive, 0),
+		Peers:         make([]string, 0),
+	}
+
+	db, err := OpenReadOnlyConnection(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if archive.Messages, err = db.GetAllMessages(); err != nil {
+		return err
+	}
+	if findAnnouncement(archive.Messages, archive.Name) == nil {
+		return errors.New("the database does not contain the key announcement of " + archive.Name)
+	}
+	defaultID, err := archiveIdentity(db, "", keyBin)
+	if err != nil {
+		return err
+	}
+	archive.Outbox, archive.ReadMarks, archive.Contacts, archive.Channels = defaultID.Outbox, defaultID.ReadMarks,
+		defaultID.Contacts, defaultID.Channels
+
+	labels, err := ioutil.ReadDir(filepath.Join(dataDir, IDENTITIES_DIR))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range labels {
+		if !entry.IsDir() {
+			continue
+		}
+		key, err := ioutil.ReadFile(filepath.Join(dataDir, IDENTITIES_DIR, entry.Name(), "key.bin"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		id, err := archiveIdentity(db, entry.Name(), key)
+		if err != nil {
+			return fmt.Errorf("unable to back up the identity %s: %s", entry.Name(), err.Error())
+		}
+		archive.Identities = append(archive.Identities, id)
+	}
+
+	if archive.Config, err = ioutil.ReadFile(configPath); err == nil {
+		config := DefaultConfig()
+		if err := config.readFile(configPath); err != nil {
+			return fmt.Errorf("unable to load %s: %s", configPath, err.Error())
+		}
+		archive.Peers = config.Peers
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := encryptBackup(archive, passphrase)
+	if err != nil {
+		return err
+	}
+	// Write the archive atomically, so that an existing archive is never left half-written
+	tmp := out + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	LogMain.Infof("backed up %s and %d other identities (%d messages, %d in the outbox) to %s", Name(archive.Name),
+		len(archive.Identities), len(archive.Messages), len(archive.Outbox), out)
+	return nil
+}
+
+// archiveIdentity exports the keypair and the state (outbox, read marks, address book and subscriptions) of an
+// identity of the data directory.
+func archiveIdentity(db MessageStore, label string, key []byte) (*IdentityArchive, error) {
+	_, pk, err := DecodeKeyPair(key)
+	if err != nil {
+		return nil, err
+	}
+	id := &IdentityArchive{Label: label, Name: pk.DeriveName(), Key: key}
+	outbox, err := db.GetOutgoingMessages()
+	if err != nil {
+		return nil, err
+	}
+	id.Outbox = make([]*OutgoingMessage, 0)
+	for _, m := range outbox {
+		// The entries queued before the support of multiple identities belong to the default identity
+		// (see AssignDefaultIdentity)
+		if m.Identity == id.Name || (label == "" && m.Identity == "") {
+			id.Outbox = append(id.Outbox, m)
+		}
+	}
+	if id.ReadMarks, err = db.GetReadMarks(id.Name); err != nil {
+		return nil, err
+	}
+	if id.Contacts, err = db.GetContacts(id.Name); err != nil {
+		return nil, err
+	}
+	if id.Channels, err = db.GetChannels(id.Name); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// restoreBackup verifies an archive and merges it into a data directory.
+// The data directory can be empty, or contain the same identity (e.g. a node that has been reinstalled).
+func restoreBackup(dataDir string, in string, passphrase []byte) error {
+	data, err := ioutil.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	archive, err := decryptBackup(data, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// The keypairs must match the names (and the key announcements) of the archive, and the identities of the data
+	// directory (if any)
+	defaultID := &IdentityArchive{Name: archive.Name, Key: archive.Key, Outbox: archive.Outbox,
+		ReadMarks: archive.ReadMarks, Contacts: archive.Contacts, Channels: archive.Channels}
+	identities := append([]*IdentityArchive{defaultID}, archive.Identities...)
+	for _, id := range identities {
+		if err := checkArchivedIdentity(dataDir, id, archive.Messages); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		return err
+	}
+	db, err := NewConnection(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	inserted, replaced, skipped, err := mergeMessages(db, archive.Messages)
+	if err != nil {
+		return err
+	}
+	restoredOutbox := 0
+	for _, id := range identities {
+		restored, err := restoreIdentity(db, dataDir, id)
+		if err != nil {
+			return err
+		}
+		restoredOutbox += restored
+	}
+
+	// The config file is only restored if there is none, since it may have been adapted to the new machine
+	configPath := filepath.Join(dataDir, CONFIG_FILE_NAME)
+	if _, err := os.Stat(configPath); os.IsNotExist(err) && len(archive.Config) > 0 {
+		if err := ioutil.WriteFile(configPath, archive.Config, 0644); err != nil {
+			return err
+		}
+	} else if len(archive.Peers) > 0 {
+		LogMain.Infof("the config file has not been replaced; the peers of the archive were: %s",
+			strings.Join(archive.Peers, ","))
+	}
+
+	for _, id := range archive.Identities {
+		LogMain.Infof("restored the identity %s (%s), which is hosted if its label is listed in the identities",
+			id.Label, Name(id.Name))
+	}
+	LogMain.Infof("restored %s from %s: %d messages inserted, %d replaced, %d skipped, %d restored in the outbox",
+		Name(archive.Name), archive.Created, inserted, replaced, skipped, restoredOutbox)
+	return nil
+}
+
+// identityKeyPath returns the path of the keypair of an identity in a data directory (see LoadIdentity).
+func identityKeyPath(dataDir string, label string) string {
+	if label == "" {
+		return filepath.Join(dataDir, "key.bin")
+	}
+	return filepath.Join(dataDir, IDENTITIES_DIR, label, "key.bin")
+}
+
+// checkArchivedIdentity verifies that the keypair of an archived identity matches its name and its key announcement
+// (which is required for the default identity), and that the data directory does not contain another identity with
+// the same label.
+func checkArchivedIdentity(dataDir string, id *IdentityArchive, messages []*MessageRecord) error {
+	if id.Label != "" && !identityLabelPattern.MatchString(id.Label) {
+		return fmt.Errorf("invalid identity label \"%s\" in the archive", id.Label)
+	}
+	_, pk, err := DecodeKeyPair(id.Key)
+	if err != nil {
+		return err
+	}
+	if pk.DeriveName() != id.Name {
+		return errors.New("the keypair of " + id.Name + " does not match its name")
+	}
+	announcement := findAnnouncement(messages, id.Name)
+	if (announcement == nil && id.Label == "") ||
+		(announcement != nil && !bytes.Equal(announcement.Data.Content, pk.Serialize())) {
+		return errors.New("the keypair of " + id.Name + " does not match its key announcement")
+	}
+
+	if existing, err := ioutil.ReadFile(identityKeyPath(dataDir, id.Label)); err == nil {
+		_, existingPk, err := DecodeKeyPair(existing)
+		if err != nil {
+			return err
+		}
+		if existingPk.DeriveName() != id.Name {
+			return fmt.Errorf("the data directory contains another identity (%s)", existingPk.DeriveName())
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// restoreIdentity merges the state of an archived identity into a data directory, and writes its keypair if it is
+// missing. Returns the number of messages restored in the outbox.
+func restoreIdentity(db MessageStore, dataDir string, id *IdentityArchive) (int, error) {
+	for _, m := range id.Outbox {
+		// Archives created before the support of multiple identities do not record the identity of the outbox
+		m.Identity = id.Name
+	}
+	restored, err := mergeOutbox(db, id.Outbox)
+	if err != nil {
+		return restored, err
+	}
+	for _, mark := range id.ReadMarks {
+		if _, err := db.RaiseReadMark(id.Name, mark.Identifier, mark.NextID); err != nil {
+			return restored, err
+		}
+	}
+	if err := mergeContacts(db, id.Name, id.Contacts); err != nil {
+		return restored, err
+	}
+	if err := mergeChannels(db, id.Name, id.Channels); err != nil {
+		return restored, err
+	}
+
+	keyPath := identityKeyPath(dataDir, id.Label)
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(keyPath), os.ModePerm); err != nil {
+			return restored, err
+		}
+		if err := ioutil.WriteFile(keyPath, id.Key, 0600); err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+// findAnnouncement returns the key announcement (ID 0) of the given node, or nil if it is missing or pruned.
+func findAnnouncement(messages []*MessageRecord, name string) *MessageRecord {
+	for _, m := range messages {
+		if m.Data.Origin == name && m.Data.ID == 0 && !m.Pruned {
+			return m
+		}
+	}
+	return nil
+}
+
+// mergeMessages inserts the messages of an archive into a store, keeping the IDs of every origin contiguous.
+// Messages that follow a gap (i.e. whose predecessor is neither stored nor in the archive) are skipped.
+// Conflicting messages with the same (origin, ID) pair are resolved as in TryInsertMessage (the lowest hash wins),
+// and tombstones get their content back if the archive contains the original message (placeholders are replaced by
+// the original message whatever its hash).
+func mergeMessages(db MessageStore, messages []*MessageRecord) (inserted int, replaced int, skipped int, err error) {
+	sorted := append([]*MessageRecord(nil), messages...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Data.Origin == sorted[j].Data.Origin {
+			return sorted[i].Data.ID < sorted[j].Data.ID
+		}
+		return sorted[i].Data.Origin < sorted[j].Data.Origin
+	})
+
+	nextIDs := make(map[string]uint32)
+	for _, m := range sorted {
+		next, found := nextIDs[m.Data.Origin]
+		if !found {
+			if next, err = db.NextID(m.Data.Origin); err != nil {
+				return
+			}
+		}
+
+		if m.Data.ID == next {
+			if err = db.InsertOrUpdateMessage(m); err != nil {
+				return
+			}
+			inserted++
+			next++
+		} else if m.Data.ID < next {
+			var stored *MessageRecord
+			if stored, err = db.GetMessage(m.Data.Origin, m.Data.ID); err != nil {
+				return
+			}
+			comparison := 1
+			if stored != nil && !m.Pruned {
+				comparison = CompareHashes(m.MessageHash(), stored.MessageHash())
+			}
+			if stored == nil || comparison == -1 || (comparison == 0 && stored.Pruned) ||
+				(stored.Placeholder && !m.Pruned) {
+				if err = db.InsertOrUpdateMessage(m); err != nil {
+					return
+				}
+				replaced++
+			}
+		} else {
+			skipped++
+		}
+		nextIDs[m.Data.Origin] = next
+	}
+	return
+}
+
+// mergeOutbox adds the messages of an archived outbox that are not in the store yet, and returns their number.
+func mergeOutbox(db MessageStore, outbox []*OutgoingMessage) (int, error) {
+	existing, err := db.GetOutgoingMessages()
+	if err != nil {
+		return 0, err
+	}
+	restored := 0
+	for _, m := range outbox {
+		duplicate := false
+		for _, e := range existing {
+			if e.Identity == m.Identity && e.DateCreated == m.DateCreated && e.Destination == m.Destination &&
+				e.Content == m.Content {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			if err := db.InsertOutgoingMessage(m); err != nil {
+				return restored, err
+			}
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// mergeContacts adds the archived contacts that are not in the address book yet (the existing contacts, which may
+// have been edited since the backup, are kept).
+func mergeContacts(db MessageStore, identity string, contacts []*Contact) error {
+	existing, err := db.GetContacts(identity)
+	if err != nil {
+		return err
+	}
+	for _, c := range contacts {
+		duplicate := false
+		for _, e := range existing {
+			if e.Name == c.Name || (c.Petname != "" && strings.EqualFold(e.Petname, c.Petname)) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			if err := db.PutContact(identity, c); err != nil {
+				return err
+			}
+			existing = append(existing, c)
+		}
+	}
+	return nil
+}
+
+// mergeChannels adds the archived subscriptions to the channels to which the identity is not subscribed yet (the
+// existing subscriptions, whose password may have changed since the backup, are kept).
+func mergeChannels(db MessageStore, identity string, channels []*Channel) error {
+	existing, err := db.GetChannels(identity)
+	if err != nil {
+		return err
+	}
+	for _, c := range channels {
+		duplicate := false
+		for _, e := range existing {
+			if bytes.Equal(e.ID, c.ID) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			if err := db.PutChannel(identity, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backupHeader returns the header of an archive with the given key derivation parameters.
+func backupHeader(version uint16, kdfTime uint32, kdfMemory uint32, kdfThreads uint8, salt []byte,
+	nonce []byte) []byte {
+
+	var b bytes.Buffer
+	b.WriteString(BACKUP_MAGIC)
+	binary.Write(&b, binary.LittleEndian, version)
+	binary.Write(&b, binary.LittleEndian, kdfTime)
+	binary.Write(&b, binary.LittleEndian, kdfMemory)
+	b.WriteByte(kdfThreads)
+	b.Write(salt)
+	b.Write(nonce)
+	return b.Bytes()
+}
+
+// newBackupCipher derives the encryption key of an archive from the passphrase.
+func newBackupCipher(passphrase []byte, salt []byte, kdfTime uint32, kdfMemory uint32,
+	kdfThreads uint8) (cipher.AEAD, error) {
+
+	key := argon2.IDKey(passphrase, salt, kdfTime, kdfMemory, kdfThreads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptBackup serializes, compresses and encrypts an archive.
+func encryptBackup(archive *BackupArchive, passphrase []byte) ([]byte, error) {
+	var plaintext bytes.Buffer
+	compressor := gzip.NewWriter(&plaintext)
+	if err := json.NewEncoder(compressor).Encode(archive); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, BACKUP_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newBackupCipher(passphrase, salt, BACKUP_KDF_TIME, BACKUP_KDF_MEMORY, BACKUP_KDF_THREADS)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := backupHeader(BACKUP_FORMAT_VERSION, BACKUP_KDF_TIME, BACKUP_KDF_MEMORY, BACKUP_KDF_THREADS, salt, nonce)
+	return aead.Seal(header, nonce, plaintext.Bytes(), header), nil
+}
+
+// decryptBackup decrypts and decodes an archive. A wrong passphrase and a corrupted archive cannot be told apart.
+func decryptBackup(data []byte, passphrase []byte) (*BackupArchive, error) {
+	if !bytes.HasPrefix(data, []byte(BACKUP_MAGIC)) || len(data) < len(BACKUP_MAGIC)+11 {
+		return nil, errors.New("not a backup archive")
+	}
+	r := bytes.NewReader(data[len(BACKUP_MAGIC):])
+	var version uint16
+	var kdfTime, kdfMemory uint32
+	var kdfThreads uint8
+	binary.Read(r, binary.LittleEndian, &version)
+	binary.Read(r, binary.LittleEndian, &kdfTime)
+	binary.Read(r, binary.LittleEndian, &kdfMemory)
+	binary.Read(r, binary.LittleEndian, &kdfThreads)
+	if version > BACKUP_FORMAT_VERSION {
+		return nil, fmt.Errorf("the archive has format version %d, but this gossiper only supports up to version %d",
+			version, BACKUP_FORMAT_VERSION)
+	}
+	// The parameters are only authenticated once the key has been derived: they are bounded, so that a forged
+	// header cannot make the derivation fail or exhaust the memory
+	if kdfTime == 0 || kdfTime > BACKUP_KDF_LIMIT*BACKUP_KDF_TIME || kdfMemory > BACKUP_KDF_LIMIT*BACKUP_KDF_MEMORY ||
+		kdfThreads == 0 {
+		return nil, errors.New("invalid key derivation parameters")
+	}
+
+	salt := make([]byte, BACKUP_SALT_LENGTH)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, errors.New("truncated archive")
+	}
+	aead, err := newBackupCipher(passphrase, salt, kdfTime, kdfMemory, kdfThreads)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, errors.New("truncated archive")
+	}
+	headerLength := len(data) - r.Len()
+	plaintext, err := aead.Open(nil, nonce, data[headerLength:], data[:headerLength])
+	if err != nil {
+		return nil, errors.New("wrong passphrase, or corrupted archive")
+	}
+
+	decompressor, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	archive := &BackupArchive{}
+	if err := json.NewDecoder(decompressor).Decode(archive); err != nil {
+		return nil, errors.New("unable to decode the archive (" + err.Error() + ")")
+	}
+	if archive.Version > BACKUP_FORMAT_VERSION {
+		return nil, fmt.Errorf("the archive has format version %d, but this gossiper only supports up to version %d",
+			archive.Version, BACKUP_FORMAT_VERSION)
+	}
+	return archive, nil
+}
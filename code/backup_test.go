@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestBackupEncryptionRoundTrip(t *testing.T) {
+	archive := &BackupArchive{
+		Version:    BACKUP_FORMAT_VERSION,
+		Name:       "node",
+		Key:        []byte("key"),
+		Messages:   []*MessageRecord{{Data: RumorMessage{Origin: "node", Content: []byte("content")}}},
+		Identities: []*IdentityArchive{{Label: "work", Name: "work-node", Key: []byte("work key")}},
+		Peers:      []string{"127.0.0.1:5000"},
+	}
+	data, err := encryptBackup(archive, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(BACKUP_MAGIC)) {
+		t.Fatal("the archive does not start with the magic bytes")
+	}
+
+	decrypted, err := decryptBackup(data, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.Name != "node" || string(decrypted.Key) != "key" || len(decrypted.Messages) != 1 ||
+		string(decrypted.Messages[0].Data.Content) != "content" || len(decrypted.Identities) != 1 ||
+		decrypted.Identities[0].Label != "work" || len(decrypted.Peers) != 1 {
+		t.Errorf("unexpected archive: %+v", decrypted)
+	}
+
+	if _, err := decryptBackup(data, []byte("wrong passphrase")); err == nil {
+		t.Error("the archive has been decrypted with a wrong passphrase")
+	}
+}
+
+func TestBackupTampering(t *testing.T) {
+	data, err := encryptBackup(&BackupArchive{Version: BACKUP_FORMAT_VERSION}, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The header is authenticated along with the content
+	for _, offset := range []int{len(BACKUP_MAGIC) + 11, len(data) - 1} {
+		tampered := append([]byte(nil), data...)
+		tampered[offset] ^= 1
+		if _, err := decryptBackup(tampered, []byte("passphrase")); err == nil {
+			t.Errorf("an archive modified at offset %d has been decrypted", offset)
+		}
+	}
+	if _, err := decryptBackup(data[:len(BACKUP_MAGIC)+20], []byte("passphrase")); err == nil {
+		t.Error("a truncated archive has been decrypted")
+	}
+	if _, err := decryptBackup([]byte("not an archive at all"), []byte("passphrase")); err == nil {
+		t.Error("a file without the magic bytes has been decrypted")
+	}
+
+	// Archives with a newer format version are rejected
+	newer := append([]byte(nil), data...)
+	copy(newer[len(BACKUP_MAGIC):], []byte{BACKUP_FORMAT_VERSION + 1, 0})
+	if _, err := decryptBackup(newer, []byte("passphrase")); err == nil ||
+		!strings.Contains(err.Error(), "format version") {
+		t.Errorf("an archive with a newer format version has been accepted (%v)", err)
+	}
+}
+
+func TestBackupKdfParameters(t *testing.T) {
+	data, err := encryptBackup(&BackupArchive{Version: BACKUP_FORMAT_VERSION}, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The parameters of the header are checked before the key derivation (a zero time would make it panic)
+	for _, params := range [][3]uint32{
+		{0, BACKUP_KDF_MEMORY, BACKUP_KDF_THREADS},
+		{BACKUP_KDF_LIMIT*BACKUP_KDF_TIME + 1, BACKUP_KDF_MEMORY, BACKUP_KDF_THREADS},
+		{BACKUP_KDF_TIME, BACKUP_KDF_LIMIT*BACKUP_KDF_MEMORY + 1, BACKUP_KDF_THREADS},
+		{BACKUP_KDF_TIME, BACKUP_KDF_MEMORY, 0},
+	} {
+		forged := append([]byte(nil), data...)
+		header := forged[len(BACKUP_MAGIC)+2:]
+		binary.LittleEndian.PutUint32(header, params[0])
+		binary.LittleEndian.PutUint32(header[4:], params[1])
+		header[8] = uint8(params[2])
+		if _, err := decryptBackup(forged, []byte("passphrase")); err == nil ||
+			!strings.Contains(err.Error(), "key derivation parameters") {
+			t.Errorf("an archive with the parameters %v has been accepted (%v)", params, err)
+		}
+	}
+}
+
+// testRecord returns a record of the given origin and ID.
+func testRecord(origin string, id uint32, content string) *MessageRecord {
+	return &MessageRecord{Data: RumorMessage{Origin: origin, ID: id, Content: []byte(content),
+		Signature: []byte{}, Nonce: []byte{}}}
+}
+
+func TestMergeMessagesKeepsIDsContiguous(t *testing.T) {
+	store := NewMemoryStore()
+	store.InsertOrUpdateMessage(testRecord("a", 0, "key"))
+
+	archived := []*MessageRecord{testRecord("a", 2, "second"), testRecord("a", 1, "first"),
+		testRecord("a", 4, "after a gap"), testRecord("b", 0, "key"), testRecord("c", 1, "no announcement")}
+	inserted, replaced, skipped, err := mergeMessages(store, archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted != 3 || replaced != 0 || skipped != 2 {
+		t.Errorf("unexpected counts: %d inserted, %d replaced, %d skipped", inserted, replaced, skipped)
+	}
+	if next, _ := store.NextID("a"); next != 3 {
+		t.Errorf("unexpected next ID of a: %d", next)
+	}
+	if next, _ := store.NextID("c"); next != 0 {
+		t.Errorf("a message following a gap has been inserted")
+	}
+}
+
+func TestMergeMessagesConflicts(t *testing.T) {
+	// Two conflicting versions of the message a:1
+	low, high := testRecord("a", 1, "version 1"), testRecord("a", 1, "version 2")
+	if CompareHashes(low.MessageHash(), high.MessageHash()) > 0 {
+		low, high = high, low
+	}
+
+	store := NewMemoryStore()
+	store.InsertOrUpdateMessage(testRecord("a", 0, "key"))
+	store.InsertOrUpdateMessage(high)
+	if _, replaced, _, _ := mergeMessages(store, []*MessageRecord{low}); replaced != 1 {
+		t.Error("the version with the lowest hash has not replaced the stored version")
+	}
+	if _, replaced, _, _ := mergeMessages(store, []*MessageRecord{high}); replaced != 0 {
+		t.Error("the version with the highest hash has replaced the stored version")
+	}
+	stored, _ := store.GetMessage("a", 1)
+	if !bytes.Equal(stored.Data.Content, low.Data.Content) {
+		t.Error("the stored version is not the version with the lowest hash")
+	}
+
+	// A tombstone gets its content back
+	store.PruneMessages([]*MessageRecord{stored})
+	if _, replaced, _, _ := mergeMessages(store, []*MessageRecord{low}); replaced != 1 {
+		t.Error("the tombstone has not been replaced with the original message")
+	}
+	if stored, _ := store.GetMessage("a", 1); stored.Pruned || !bytes.Equal(stored.Data.Content, low.Data.Content) {
+		t.Error("the content of the tombstone has not been restored")
+	}
+
+	// A placeholder is replaced whatever the hash of the message
+	placeholder := testRecord("a", 2, "")
+	placeholder.Pruned, placeholder.Placeholder, placeholder.Hash = true, true, make([]byte, 32)
+	store.InsertOrUpdateMessage(placeholder)
+	if _, replaced, _, _ := mergeMessages(store, []*MessageRecord{testRecord("a", 2, "skipped")}); replaced != 1 {
+		t.Error("the placeholder has not been replaced with the message")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Size (in bits) and number of hash functions of the interest filters of light nodes. With 4 hash functions and
+// 1024 bits, about 1% of the other names match a filter of 100 names.
+const (
+	BLOOM_FILTER_BITS   = 1024
+	BLOOM_FILTER_HASHES = 4
+)
+
+// Bounds of the filters accepted from other nodes
+const (
+	BLOOM_FILTER_MAX_BYTES  = 4096
+	BLOOM_FILTER_MAX_HASHES = 16
+)
+
+// BloomFilter is a probabilistic set of names: Contains never returns false for a name that has been added, but may
+// return true for other names. Light nodes send such a filter of their names to their peers (see Replication), so
+// that the peers can tell which private messages they want, without learning the exact list of names.
+type BloomFilter struct {
+	Bits   []byte
+	Hashes uint32
+}
+
+// NewBloomFilter returns an empty filter of the given size (in bits, rounded up to a multiple of 8).
+func NewBloomFilter(bits int, hashes uint32) *BloomFilter {
+	return &BloomFilter{Bits: make([]byte, (bits+7)/8), Hashes: hashes}
+}
+
+// positions returns the bits of the filter selected by a name, using double hashing on its SHA-256 hash.
+func (f *BloomFilter) positions(name string) []uint64 {
+	hash := sha256.Sum256([]byte(name))
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16])
+	size := uint64(len(f.Bits)) * 8
+	output := make([]uint64, 0, f.Hashes)
+	for i := uint64(0); i < uint64(f.Hashes); i++ {
+		output = append(output, (h1+i*h2)%size)
+	}
+	return output
+}
+
+// Add adds a name to the filter.
+func (f *BloomFilter) Add(name string) {
+	for _, bit := range f.positions(name) {
+		f.Bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Contains tells whether a name may have been added to the filter.
+func (f *BloomFilter) Contains(name string) bool {
+	for _, bit := range f.positions(name) {
+		if f.Bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check verifies that a filter received from another node is usable.
+func (f *BloomFilter) Check() error {
+	if len(f.Bits) == 0 || len(f.Bits) > BLOOM_FILTER_MAX_BYTES {
+		return errors.New("invalid interest filter size")
+	}
+	if f.Hashes == 0 || f.Hashes > BLOOM_FILTER_MAX_HASHES {
+		return errors.New("invalid number of hash functions in the interest filter")
+	}
+	return nil
+}
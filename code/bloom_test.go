@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilterContainsAddedNames(t *testing.T) {
+	filter := NewBloomFilter(BLOOM_FILTER_BITS, BLOOM_FILTER_HASHES)
+	for i := 0; i < 100; i++ {
+		filter.Add(fmt.Sprintf("node%d", i))
+	}
+	for i := 0; i < 100; i++ {
+		if !filter.Contains(fmt.Sprintf("node%d", i)) {
+			t.Fatalf("node%d was added but is not contained in the filter", i)
+		}
+	}
+
+	// About 1% of the other names match a filter of 100 names (see BLOOM_FILTER_BITS)
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.Contains(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 500 {
+		t.Errorf("too many false positives: %d out of 10000", falsePositives)
+	}
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	filter := NewBloomFilter(BLOOM_FILTER_BITS, BLOOM_FILTER_HASHES)
+	if filter.Contains("node") {
+		t.Error("an empty filter contains a name")
+	}
+	if len(filter.Bits) != BLOOM_FILTER_BITS/8 {
+		t.Errorf("unexpected filter size: %d bytes", len(filter.Bits))
+	}
+	if len(NewBloomFilter(9, 1).Bits) != 2 {
+		t.Error("the size of a filter is not rounded up to a multiple of 8 bits")
+	}
+}
+
+func TestBloomFilterCheck(t *testing.T) {
+	cases := []struct {
+		filter *BloomFilter
+		valid  bool
+	}{
+		{NewBloomFilter(BLOOM_FILTER_BITS, BLOOM_FILTER_HASHES), true},
+		{NewBloomFilter(BLOOM_FILTER_MAX_BYTES*8, BLOOM_FILTER_MAX_HASHES), true},
+		{&BloomFilter{Bits: []byte{}, Hashes: 4}, false},
+		{NewBloomFilter(BLOOM_FILTER_MAX_BYTES*8+8, 4), false},
+		{NewBloomFilter(BLOOM_FILTER_BITS, 0), false},
+		{NewBloomFilter(BLOOM_FILTER_BITS, BLOOM_FILTER_MAX_HASHES+1), false},
+	}
+	for i, c := range cases {
+		if err := c.filter.Check(); (err == nil) != c.valid {
+			t.Errorf("case %d: expected valid=%v, got %v", i, c.valid, err)
+		}
+	}
+}
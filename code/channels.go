@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/argon2"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Length of the channel IDs (SHA-256 of the normalized name)
+const CHANNEL_ID_LENGTH = sha256.Size
+
+// Valid channel names (without the leading "#"): lower-case ASCII letters, digits, ".", "_" and "-", up to 64
+// characters
+var channelNamePattern = regexp.MustCompile("^[a-z0-9][a-z0-9._-]{0,63}$")
+
+// Parameters of the derivation of the keys of the encrypted channels (Argon2id, see ChannelKey)
+const (
+	CHANNEL_KDF_TIME    = 3
+	CHANNEL_KDF_MEMORY  = 64 * 1024 // KiB
+	CHANNEL_KDF_THREADS = 4
+)
+
+// Prefix of the conversations of the channels (see LocalIdentity.conversationOf), followed by the channel ID
+const CHANNEL_CONVERSATION_PREFIX = "#"
+
+// Channel is a channel to which a local identity is subscribed.
+//
+// Channels are named public rooms. The messages of a channel are public messages (without destination) whose
+// Channel field contains the channel ID, which is the SHA-256 hash of the name of the channel: every node stores and
+// forwards them, but only the subscribers of a channel display them. A channel can be protected by a password, in
+// which case the content of its messages is encrypted with a key derived from the password (see ChannelKey): the
+// messages of such a channel can only be read by the subscribers that know the password, and the messages that are
+// not encrypted with the key are ignored. Since the channel ID only depends on the name, any node can tell which
+// messages belong to the same channel, and check a guess of its name.
+type Channel struct {
+	ID         []byte
+	Name       string
+	Key        []byte // AES-256 key of an encrypted channel (nil if the channel is not encrypted)
+	Subscribed string // RFC3339
+}
+
+// ChannelActivity summarizes the messages of a channel stored by this node.
+type ChannelActivity struct {
+	ID       []byte
+	Messages int    // Number of messages (except tombstones)
+	LastSeen string // Date on which the latest message was first seen
+}
+
+// ChannelInfo describes a channel (for the client).
+type ChannelInfo struct {
+	ID         string // Channel ID (hexadecimal)
+	Name       string // Empty if the selected identity is not subscribed to the channel
+	Encrypted  bool
+	Subscribed string // Date of the subscription (empty if the selected identity is not subscribed to the channel)
+	Messages   int    // Number of messages of the channel stored by this node
+	LastSeen   string
+}
+
+// errNotSubscribed is returned when a local identity uses a channel to which it is not subscribed.
+var errNotSubscribed = errors.New("not subscribed to the channel")
+
+// NormalizeChannelName converts the name of a channel to lower case (without the leading "#"), and checks that it
+// is valid.
+func NormalizeChannelName(name string) (string, error) {
+	name = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), "#")
+	if !channelNamePattern.MatchString(name) {
+		return "", errors.New("a channel name must contain 1 to 64 letters, digits, \".\", \"_\" or \"-\"")
+	}
+	return name, nil
+}
+
+// ChannelID returns the ID of the channel with the given (normalized) name.
+func ChannelID(name string) []byte {
+	id := sha256.Sum256([]byte(name))
+	return id[:]
+}
+
+// ParseChannelRef returns the ID of a channel given by its ID (in hexadecimal) or by its name.
+func ParseChannelRef(ref string) ([]byte, error) {
+	if id, err := hex.DecodeString(ref); err == nil && len(id) == CHANNEL_ID_LENGTH {
+		return id, nil
+	}
+	name, err := NormalizeChannelName(ref)
+	if err != nil {
+		return nil, err
+	}
+	return ChannelID(name), nil
+}
+
+// ChannelKey derives the key of an encrypted channel from its password. The channel ID is used as the salt, so that
+// all the subscribers that know the password derive the same key.
+func ChannelKey(channelID []byte, password string) []byte {
+	return argon2.IDKey([]byte(password), channelID, CHANNEL_KDF_TIME, CHANNEL_KDF_MEMORY, CHANNEL_KDF_THREADS, 32)
+}
+
+// newChannelCipher returns the AES-256-GCM cipher of an encrypted channel.
+func newChannelCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealChannelContent encrypts the content of a message of an encrypted channel (ENCODING_CHANNEL): the GCM nonce,
+// followed by the ciphertext. The channel ID is authenticated, so that a message cannot be replayed in another channel
+// with the same password.
+func SealChannelContent(content []byte, channelID []byte, key []byte) ([]byte, error) {
+	aead, err := newChannelCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, content, channelID), nil
+}
+
+// OpenChannelContent decrypts the content of a message encrypted by SealChannelContent.
+func OpenChannelContent(content []byte, channelID []byte, key []byte) ([]byte, error) {
+	aead, err := newChannelCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) < aead.NonceSize() {
+		return nil, errMalformedContent
+	}
+	return aead.Open(nil, content[:aead.NonceSize()], content[aead.NonceSize():], channelID)
+}
+
+// channelConversation returns the conversation of the messages of a channel (see LocalIdentity.conversationOf).
+func channelConversation(channelID []byte) string {
+	return CHANNEL_CONVERSATION_PREFIX + hex.EncodeToString(channelID)
+}
+
+// ChannelList keeps track of the channels to which a local identity is subscribed. It is loaded from the message
+// store when the node starts (before the indexes of the identity, which only contain the messages of the channels
+// to which it is subscribed). It must only be used from the main thread.
+type ChannelList struct {
+	owner    *LocalIdentity
+	channels map[string]Channel // Channel ID (hexadecimal) -> subscription
+}
+
+func NewChannelList(owner *LocalIdentity) *ChannelList {
+	return &ChannelList{
+		owner:    owner,
+		channels: make(map[string]Channel),
+	}
+}
+
+// Load reads the subscriptions of the owner from the message store, replacing the current subscriptions.
+func (l *ChannelList) Load() error {
+	channels, err := Context.Database.GetChannels(l.owner.DisplayName)
+	if err != nil {
+		return err
+	}
+	l.channels = make(map[string]Channel)
+	for _, c := range channels {
+		l.channels[hex.EncodeToString(c.ID)] = *c
+	}
+	return nil
+}
+
+// Get returns the subscription to a channel.
+func (l *ChannelList) Get(channelID []byte) (Channel, bool) {
+	c, found := l.channels[hex.EncodeToString(channelID)]
+	return c, found
+}
+
+// Subscribe subscribes the owner to a channel, given by its (normalized) name. The channel is encrypted if a key
+// is given (see ChannelKey). An existing subscription to the same channel is replaced (e.g. to change the password).
+func (l *ChannelList) Subscribe(name string, key []byte) (Channel, error) {
+	c := Channel{ID: ChannelID(name), Name: name, Key: key, Subscribed: time.Now().Format(time.RFC3339)}
+	if err := Context.Database.PutChannel(l.owner.DisplayName, &c); err != nil {
+		return Channel{}, err
+	}
+	l.channels[hex.EncodeToString(c.ID)] = c
+	return c, l.owner.rebuildIndexes()
+}
+
+// Unsubscribe unsubscribes the owner from a channel. Returns errNotSubscribed if it is not subscribed to it.
+func (l *ChannelList) Unsubscribe(channelID []byte) error {
+	if _, found := l.Get(channelID); !found {
+		return errNotSubscribed
+	}
+	if err := Context.Database.DeleteChannel(l.owner.DisplayName, channelID); err != nil {
+		return err
+	}
+	delete(l.channels, hex.EncodeToString(channelID))
+	return l.owner.rebuildIndexes()
+}
+
+// Info describes a channel, as seen by the owner.
+func (l *ChannelList) Info(channelID []byte, activity ChannelActivity) ChannelInfo {
+	info := ChannelInfo{ID: hex.EncodeToString(channelID), Messages: activity.Messages, LastSeen: activity.LastSeen}
+	if c, found := l.Get(channelID); found {
+		info.Name = c.Name
+		info.Encrypted = c.Key != nil
+		info.Subscribed = c.Subscribed
+	}
+	return info
+}
+
+// All describes the channels to which the owner is subscribed, followed by the other channels that have messages in
+// the message store if all is true. The channels are sorted by name, then by date of the latest message.
+func (l *ChannelList) All(all bool) ([]ChannelInfo, error) {
+	activities, err := Context.Database.ChannelList()
+	if err != nil {
+		return nil, err
+	}
+	output := make([]ChannelInfo, 0, len(l.channels))
+	seen := make(map[string]bool)
+	for _, activity := range activities {
+		info := l.Info(activity.ID, activity)
+		if info.Subscribed != "" || all {
+			output = append(output, info)
+		}
+		seen[info.ID] = true
+	}
+	for channelID, c := range l.channels {
+		if !seen[channelID] {
+			output = append(output, l.Info(c.ID, ChannelActivity{}))
+		}
+	}
+	sort.SliceStable(output, func(i, j int) bool {
+		if (output[i].Name == "") != (output[j].Name == "") {
+			return output[i].Name != ""
+		} else if output[i].Name != output[j].Name {
+			return output[i].Name < output[j].Name
+		}
+		return output[i].LastSeen > output[j].LastSeen
+	})
+	return output, nil
+}
+
+// readChannelContent returns the content of a message of a channel to which this local identity is subscribed.
+// The messages of an encrypted channel must be encrypted with its key, and the other ones must not be encrypted.
+func (id *LocalIdentity) readChannelContent(m *MessageRecord) ([]byte, error) {
+	c, found := id.Channels.Get(m.Data.Channel)
+	if !found {
+		return nil, errNotSubscribed
+	} else if c.Key == nil && m.Data.Encoding == ENCODING_LEGACY {
+		return m.Data.Content, nil
+	} else if c.Key != nil && m.Data.Encoding == ENCODING_CHANNEL {
+		return OpenChannelContent(m.Data.Content, c.ID, c.Key)
+	}
+	return nil, errMalformedContent
+}
+
+// encryptChannelContent returns the content of a new message of a channel (encrypted if the channel is), and its
+// encoding.
+func (id *LocalIdentity) encryptChannelContent(content []byte, channelID []byte) ([]byte, uint32, error) {
+	c, found := id.Channels.Get(channelID)
+	if !found {
+		return nil, 0, errNotSubscribed
+	} else if c.Key == nil {
+		return content, ENCODING_LEGACY, nil
+	}
+	encrypted, err := SealChannelContent(content, c.ID, c.Key)
+	return encrypted, ENCODING_CHANNEL, err
+}
+
+// rebuildIndexes rebuilds the in-memory indexes of this local identity (after a change of its subscriptions).
+func (id *LocalIdentity) rebuildIndexes() error {
+	if err := id.Edits.Rebuild(); err != nil {
+		return err
+	}
+	if err := id.Threads.Rebuild(); err != nil {
+		return err
+	}
+	return id.Search.Rebuild()
+}
+
+// ChannelMessages returns the text messages of a channel to which this local identity is subscribed.
+func (id *LocalIdentity) ChannelMessages(channelID []byte) ([]*MessageRecord, error) {
+	if _, found := id.Channels.Get(channelID); !found {
+		return nil, errNotSubscribed
+	}
+	messages, err := Context.Database.GetChannelMessages(channelID)
+	if err != nil {
+		return nil, err
+	}
+	output := make([]*MessageRecord, 0, len(messages))
+	for _, m := range messages {
+		if isTextKind(m.Data.Kind) && bytes.Equal(m.Data.Channel, channelID) {
+			output = append(output, m)
+		}
+	}
+	return output, nil
+}
@@ -4,12 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 )
 
 // FailOnError prints the error and terminates the program, if a non-nil error is given.
+// It must be used only for failures during the startup phase: errors that occur while the node
+// is running are propagated to the caller and reported with ReportError.
 func FailOnError(e error) {
 	if e != nil {
-		panic(e.Error())
+		LogMain.Errorf("%s", e.Error())
+		os.Exit(EXIT_STARTUP_FAILURE)
 	}
 }
 
@@ -44,6 +48,7 @@ func IsInArray(elem string, arr []string) bool {
 	}
 	return false
 }
+
 // NumLeadingZeros returns the number of leading zero bits of a hash
 func NumLeadingZeros(hash []byte) int {
 	count := 0
@@ -74,4 +79,4 @@ func CompareHashes(hash1 []byte, hash2 []byte) int {
 		}
 	}
 	return 0
-}
\ No newline at end of file
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Name of the configuration file, which is looked up in the data directory unless specified otherwise
+const CONFIG_FILE_NAME = "config"
+
+// Duration is a time.Duration that is stored as a human-readable string (e.g. "1s", "500ms") in the config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("durations must be given as strings, e.g. \"1s\" or \"500ms\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+type TransportConfig struct {
+	Protocol   string // Only "udp" is currently supported
+	GossipAddr string // Address/port for the gossiper socket
+}
+
+type GossipConfig struct {
+	AntiEntropyInterval Duration // Interval between two anti-entropy status messages
+	RumorTimeout        Duration // Time to wait for a status acknowledgement when rumormongering
+	EventQueueSize      int      // Capacity of the main event queue
+}
+
+type PowConfig struct {
+	Difficulty          int      // Base proof-of-work difficulty (leading zeros) of new messages (SHA-256 scheme)
+	Argon2Difficulty    int      // Base proof-of-work difficulty of new messages (memory-hard Argon2id scheme)
+	MinDifficulty       int      // Minimum base difficulty accepted from other nodes (SHA-256 scheme)
+	MinArgon2Difficulty int      // Minimum base difficulty accepted from other nodes (Argon2id scheme)
+	SizeUnit            int      // Content size (bytes) covered by the base difficulty, +1 leading zero per doubling
+	AnnouncementExtra   int      // Additional leading zeros required for key announcements
+	AliasExtra          int      // Additional leading zeros required for alias registrations
+	Scheme              string   // Scheme used for the messages of this node ("sha256" or "argon2id")
+	AcceptedSchemes     []string // Schemes accepted from other nodes
+}
+
+// Policy returns the proof-of-work policy described by this configuration.
+// Unknown schemes are ignored (they are reported by Validate).
+func (c *PowConfig) Policy() *PowPolicy {
+	policy := &PowPolicy{
+		Difficulty:        map[uint32]int{POW_SHA256: c.Difficulty, POW_ARGON2ID: c.Argon2Difficulty},
+		Minimum:           make(map[uint32]int),
+		SizeUnit:          c.SizeUnit,
+		AnnouncementExtra: c.AnnouncementExtra,
+		AliasExtra:        c.AliasExtra,
+	}
+	policy.Scheme, _ = ParsePowScheme(c.Scheme)
+	for _, name := range c.AcceptedSchemes {
+		scheme, err := ParsePowScheme(name)
+		if err != nil {
+			continue
+		} else if scheme == POW_ARGON2ID {
+			policy.Minimum[scheme] = c.MinArgon2Difficulty
+		} else {
+			policy.Minimum[scheme] = c.MinDifficulty
+		}
+	}
+	return policy
+}
+
+type StorageConfig struct {
+	Backend string // "sqlite" (stored in the data directory) or "memory" (lost when the node stops)
+}
+
+type WebConfig struct {
+	Port          int    // Port for the HTTP client (0 disables the web server)
+	ListenAddress string // Interface on which the HTTP client listens
+	StaticDir     string // Directory containing the web client
+}
+
+type LogConfig struct {
+	Level string // One of "debug", "info", "warn", "error"
+	File  string // If not empty, the log is written to this file instead of the standard output
+	JSON  bool   // Write one JSON object per line instead of plain text
+}
+
+type RetentionConfig struct {
+	MaxAge        Duration            // Messages older than this are pruned (0 = keep forever)
+	OriginMaxAge  map[string]Duration // Overrides MaxAge for the messages of some origins (0 = keep forever)
+	MaxSize       int64               // Maximum total size of the stored content, in bytes (0 = unlimited)
+	KeepOwn       bool                // Never prune the messages sent or received by local identities (unless they expire)
+	PruneInterval Duration            // Interval between two pruning passes
+}
+
+type ReplicationConfig struct {
+	Mode             string   // "full" (every message is stored) or "light" (see Context.Keeps)
+	InterestLifetime Duration // Time after which the interest filter of a light peer is forgotten
+}
+
+type PrivacyConfig struct {
+	RedactLogs bool // Hide peer addresses and node names in the log
+}
+
+// Config contains all the tunable parameters of the gossiper.
+type Config struct {
+	DataDir     string
+	Identities  []string // Labels of the additional identities hosted by this gossiper (see LoadIdentity)
+	Peers       []string
+	Transport   TransportConfig
+	Gossip      GossipConfig
+	Pow         PowConfig
+	Storage     StorageConfig
+	Web         WebConfig
+	Log         LogConfig
+	Retention   RetentionConfig
+	Replication ReplicationConfig
+	Privacy     PrivacyConfig
+}
+
+// DefaultConfig returns the configuration used when neither the config file nor the flags specify a value.
+func DefaultConfig() *Config {
+	return &Config{
+		Identities: make([]string, 0),
+		Peers:      make([]string, 0),
+		Transport: TransportConfig{
+			Protocol: "udp",
+		},
+		Gossip: GossipConfig{
+			AntiEntropyInterval: Duration{1 * time.Second},
+			RumorTimeout:        Duration{1 * time.Second},
+			EventQueueSize:      10,
+		},
+		Pow: PowConfig{
+			Difficulty:          18,
+			Argon2Difficulty:    8,
+			MinDifficulty:       18,
+			MinArgon2Difficulty: 8,
+			SizeUnit:            1024,
+			AnnouncementExtra:   2,
+			AliasExtra:          6,
+			Scheme:              "sha256",
+			AcceptedSchemes:     []string{"sha256", "argon2id"},
+		},
+		Storage: StorageConfig{
+			Backend: STORAGE_SQLITE,
+		},
+		Web: WebConfig{
+			ListenAddress: "localhost",
+			StaticDir:     "webclient",
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+		Retention: RetentionConfig{
+			OriginMaxAge:  make(map[string]Duration),
+			KeepOwn:       true,
+			PruneInterval: Duration{10 * time.Minute},
+		},
+		Replication: ReplicationConfig{
+			Mode:             REPLICATION_FULL,
+			InterestLifetime: Duration{10 * time.Minute},
+		},
+	}
+}
+
+// LoadConfiguration builds the configuration from the command-line arguments and the config file.
+// Values are taken from the defaults first, then from the config file (if any), and finally from the flags.
+func LoadConfiguration(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("gossiper", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of the config file (default: dataDir/"+CONFIG_FILE_NAME+")")
+	uiPort := flags.Int("UIPort", 0, "port for the HTTP client")
+	gossipIpPort := flags.String("gossipAddr", "", "address/port for the gossiper")
+	dataDir := flags.String("dataDir", "", "the directory for storing the DB and keys")
+	peersParams := flags.String("peers", "", "peers separated by commas")
+	identities := flags.String("identities", "", "labels of the additional identities separated by commas")
+	powDifficulty := flags.Int("powDifficulty", 18, "proof-of-work difficulty (leading zeros), for sending and accepting messages")
+	storage := flags.String("storage", STORAGE_SQLITE, "storage backend for the messages (sqlite or memory)")
+	powScheme := flags.String("powScheme", "sha256", "proof-of-work scheme for new messages (sha256 or argon2id)")
+	replication := flags.String("replication", REPLICATION_FULL, "replication mode (full, or light to only store "+
+		"the public messages and the messages of the local identities)")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Collect the flags that have been explicitly set, as they take precedence over the file
+	setFlags := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	config := DefaultConfig()
+
+	path := *configPath
+	if path == "" && *dataDir != "" {
+		path = filepath.Join(*dataDir, CONFIG_FILE_NAME)
+	}
+	if path != "" {
+		err := config.readFile(path)
+		if os.IsNotExist(err) && !setFlags["config"] {
+			// The default config file is optional
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to load %s: %s", path, err.Error())
+		}
+	}
+
+	if setFlags["UIPort"] {
+		config.Web.Port = *uiPort
+	}
+	if setFlags["gossipAddr"] {
+		config.Transport.GossipAddr = *gossipIpPort
+	}
+	if setFlags["dataDir"] {
+		config.DataDir = *dataDir
+	}
+	if setFlags["peers"] {
+		config.Peers = make([]string, 0)
+		for _, peerAddress := range strings.Split(*peersParams, ",") {
+			if peerAddress != "" {
+				config.Peers = append(config.Peers, peerAddress)
+			}
+		}
+	}
+	if setFlags["identities"] {
+		config.Identities = make([]string, 0)
+		for _, label := range strings.Split(*identities, ",") {
+			if label != "" {
+				config.Identities = append(config.Identities, label)
+			}
+		}
+	}
+	if setFlags["powDifficulty"] {
+		config.Pow.Difficulty = *powDifficulty
+		config.Pow.MinDifficulty = *powDifficulty
+	}
+	if setFlags["storage"] {
+		config.Storage.Backend = *storage
+	}
+	if setFlags["powScheme"] {
+		config.Pow.Scheme = *powScheme
+	}
+	if setFlags["replication"] {
+		config.Replication.Mode = *replication
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile overrides the current configuration with the values specified in a JSON file.
+// Unknown keys are reported as errors, so that typos do not go unnoticed.
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(c)
+}
+
+// Validate checks the configuration for consistency, and returns an error describing all the problems found.
+// Peer addresses are also resolved in place.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+
+	if c.DataDir == "" {
+		problems = append(problems, "you must specify a database directory (dataDir)")
+	}
+	if c.Transport.Protocol != "udp" {
+		problems = append(problems, "unsupported transport protocol \""+c.Transport.Protocol+"\" (only \"udp\" is available)")
+	}
+	if c.Transport.GossipAddr == "" {
+		problems = append(problems, "you must supply a gossip address/port (gossipAddr). Use \":PORT\" to listen to all interfaces")
+	}
+
+	for i, label := range c.Identities {
+		if !identityLabelPattern.MatchString(label) {
+			problems = append(problems, fmt.Sprintf("invalid identity label \"%s\" (only letters, digits, "+
+				"\"-\" and \"_\" are allowed)", label))
+		} else if IsInArray(label, c.Identities[:i]) {
+			problems = append(problems, fmt.Sprintf("duplicate identity label \"%s\"", label))
+		}
+	}
+
+	// Check if all peer addresses are valid, and resolve them if they contain domain names
+	for i, peerAddress := range c.Peers {
+		addr, err := CheckAndResolveAddress(peerAddress)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("invalid peer address \"%s\": %s", peerAddress, err.Error()))
+		} else {
+			c.Peers[i] = addr
+		}
+	}
+
+	if c.Gossip.AntiEntropyInterval.Duration <= 0 {
+		problems = append(problems, "the anti-entropy interval must be positive")
+	}
+	if c.Gossip.RumorTimeout.Duration <= 0 {
+		problems = append(problems, "the rumor timeout must be positive")
+	}
+	if c.Gossip.EventQueueSize < 0 {
+		problems = append(problems, "the event queue size cannot be negative")
+	}
+	for _, difficulty := range []int{c.Pow.Difficulty, c.Pow.Argon2Difficulty, c.Pow.MinDifficulty,
+		c.Pow.MinArgon2Difficulty} {
+		if difficulty < 0 || difficulty > 256 {
+			problems = append(problems, "the proof-of-work difficulties must be between 0 and 256")
+			break
+		}
+	}
+	if c.Pow.Difficulty < c.Pow.MinDifficulty || c.Pow.Argon2Difficulty < c.Pow.MinArgon2Difficulty {
+		problems = append(problems, "the proof-of-work difficulty of this node cannot be lower than the minimum accepted")
+	}
+	if c.Pow.SizeUnit < 0 || c.Pow.AnnouncementExtra < 0 || c.Pow.AliasExtra < 0 {
+		problems = append(problems, "the proof-of-work size unit and surcharges cannot be negative")
+	}
+	if scheme, err := ParsePowScheme(c.Pow.Scheme); err != nil {
+		problems = append(problems, err.Error()+" (expected sha256 or argon2id)")
+	} else if _, accepted := c.Pow.Policy().Minimum[scheme]; !accepted {
+		problems = append(problems, "the proof-of-work scheme of this node must be one of the accepted schemes")
+	}
+	for _, name := range c.Pow.AcceptedSchemes {
+		if _, err := ParsePowScheme(name); err != nil {
+			problems = append(problems, err.Error()+" in the accepted schemes")
+		}
+	}
+	if c.Storage.Backend != STORAGE_SQLITE && c.Storage.Backend != STORAGE_MEMORY {
+		problems = append(problems, "unknown storage backend \""+c.Storage.Backend+"\" (expected sqlite or memory)")
+	}
+	if c.Web.Port < 0 || c.Web.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("invalid UI port %d", c.Web.Port))
+	}
+	if _, err := ParseLogLevel(c.Log.Level); err != nil {
+		problems = append(problems, err.Error()+" (expected debug, info, warn or error)")
+	}
+	if c.Retention.MaxAge.Duration < 0 {
+		problems = append(problems, "the maximum message age cannot be negative")
+	}
+	for origin, maxAge := range c.Retention.OriginMaxAge {
+		if maxAge.Duration < 0 {
+			problems = append(problems, "the maximum message age of "+origin+" cannot be negative")
+		}
+	}
+	if c.Retention.MaxSize < 0 {
+		problems = append(problems, "the maximum storage size cannot be negative")
+	}
+	if c.Retention.PruneInterval.Duration <= 0 {
+		problems = append(problems, "the pruning interval must be positive")
+	}
+
+	if c.Replication.Mode != REPLICATION_FULL && c.Replication.Mode != REPLICATION_LIGHT {
+		problems = append(problems, "unknown replication mode \""+c.Replication.Mode+"\" (expected full or light)")
+	}
+	if c.Replication.InterestLifetime.Duration <= 0 {
+		problems = append(problems, "the lifetime of the interest filters must be positive")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  - " + strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
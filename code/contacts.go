@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Maximum length of a petname, in characters
+const MAX_PETNAME_LENGTH = 64
+
+// Maximum length of the notes of a contact, in characters
+const MAX_CONTACT_NOTES_LENGTH = 4096
+
+// Contact is an entry of the address book of a local identity. Contacts are never published: petnames are
+// only meaningful to the identity that chose them, which makes them impossible to spoof.
+type Contact struct {
+	Name     string // Name of the node (usually an identity, i.e. the name of its primary device)
+	Petname  string // Name chosen by the user (can be empty), unique within the address book
+	Notes    string
+	Verified bool   // The user has checked the key of the node out-of-band
+	Updated  string // RFC3339
+	// RFC3339 date of the last safety-number check (see VerifyContact), empty if never checked
+	LastVerified string
+}
+
+// ErrPetnameTaken is returned when a petname is already used by another contact.
+var ErrPetnameTaken = errors.New("the petname is already used by another contact")
+
+// ContactBook is the address book of a local identity. It is loaded from the message store when the node starts,
+// and kept in memory so that the petnames can be looked up for every message sent to the client.
+// It must only be used from the main thread.
+type ContactBook struct {
+	owner    *LocalIdentity
+	contacts map[string]Contact // Name -> contact
+}
+
+func NewContactBook(owner *LocalIdentity) *ContactBook {
+	return &ContactBook{
+		owner:    owner,
+		contacts: make(map[string]Contact),
+	}
+}
+
+// ValidateContact normalizes the petname of a contact, and checks the lengths of its fields.
+func ValidateContact(c *Contact) error {
+	c.Petname = strings.TrimSpace(c.Petname)
+	if len(c.Name) != DISPLAY_NAME_BITS/5 {
+		return fmt.Errorf("invalid node name \"%s\"", c.Name)
+	}
+	if utf8.RuneCountInString(c.Petname) > MAX_PETNAME_LENGTH {
+		return fmt.Errorf("the petname cannot be longer than %d characters", MAX_PETNAME_LENGTH)
+	}
+	if utf8.RuneCountInString(c.Notes) > MAX_CONTACT_NOTES_LENGTH {
+		return fmt.Errorf("the notes cannot be longer than %d characters", MAX_CONTACT_NOTES_LENGTH)
+	}
+	return nil
+}
+
+// Load reads the contacts of the owner from the message store, replacing the current contents of the book.
+func (b *ContactBook) Load() error {
+	contacts, err := Context.Database.GetContacts(b.owner.DisplayName)
+	if err != nil {
+		return err
+	}
+	b.contacts = make(map[string]Contact)
+	for _, c := range contacts {
+		b.contacts[c.Name] = *c
+	}
+	return nil
+}
+
+// List returns the contacts, sorted by name.
+func (b *ContactBook) List() []Contact {
+	output := make([]Contact, 0, len(b.contacts))
+	for _, c := range b.contacts {
+		output = append(output, c)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Name < output[j].Name
+	})
+	return output
+}
+
+// Get returns the contact with the given name.
+func (b *ContactBook) Get(name string) (Contact, bool) {
+	c, found := b.contacts[name]
+	return c, found
+}
+
+// Petname returns the petname of a node: the petname of its own contact if any, or else the petname of the identity
+// to which it belongs. It is empty if the node is not in the address book.
+func (b *ContactBook) Petname(name string) string {
+	if c, found := b.contacts[name]; found && c.Petname != "" {
+		return c.Petname
+	}
+	if identity := Context.Devices.IdentityOf(name); identity != name {
+		return b.contacts[identity].Petname
+	}
+	return ""
+}
+
+// Put creates or replaces a contact (which must have been validated). Petnames are compared case-insensitively.
+func (b *ContactBook) Put(c Contact) error {
+	if c.Petname != "" {
+		for _, other := range b.contacts {
+			if other.Name != c.Name && strings.EqualFold(other.Petname, c.Petname) {
+				return ErrPetnameTaken
+			}
+		}
+	}
+	c.Updated = time.Now().Format(time.RFC3339)
+	if err := Context.Database.PutContact(b.owner.DisplayName, &c); err != nil {
+		return err
+	}
+	b.contacts[c.Name] = c
+	return nil
+}
+
+// Delete removes a contact, and tells whether it existed.
+func (b *ContactBook) Delete(name string) (bool, error) {
+	if _, found := b.contacts[name]; !found {
+		return false, nil
+	}
+	if err := Context.Database.DeleteContact(b.owner.DisplayName, name); err != nil {
+		return false, err
+	}
+	delete(b.contacts, name)
+	return true, nil
+}
+
+// Import adds the given contacts to the book, replacing the existing contacts with the same name. Invalid contacts,
+// and contacts whose petname is used by another contact, are skipped. If replace is false, the existing contacts
+// are kept instead. As with PUT /contacts/{name}, the date of the last safety-number check is never imported: the
+// one of the existing contact is kept. Returns the number of imported and skipped contacts.
+func (b *ContactBook) Import(contacts []Contact, replace bool) (int, int, error) {
+	imported, skipped := 0, 0
+	for _, c := range contacts {
+		existing, found := b.contacts[c.Name]
+		if found && !replace {
+			skipped++
+			continue
+		}
+		// Only VerifyContact records safety-number checks
+		c.LastVerified = existing.LastVerified
+		if err := ValidateContact(&c); err != nil {
+			skipped++
+			continue
+		}
+		if err := b.Put(c); err == ErrPetnameTaken {
+			skipped++
+		} else if err != nil {
+			return imported, skipped, err
+		} else {
+			imported++
+		}
+	}
+	return imported, skipped, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestContactImportKeepsVerificationDates(t *testing.T) {
+	database := Context.Database
+	Context.Database = NewMemoryStore()
+	defer func() { Context.Database = database }()
+
+	book := NewContactBook(&LocalIdentity{DisplayName: "aaaaaaaaaaaaaaaa"})
+	if err := book.Put(Contact{Name: "bbbbbbbbbbbbbbbb", LastVerified: "2020-01-01T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+	imported, skipped, err := book.Import([]Contact{
+		{Name: "bbbbbbbbbbbbbbbb", Petname: "bob", LastVerified: "2030-01-01T00:00:00Z"},
+		{Name: "cccccccccccccccc", Petname: "carol", Verified: true, LastVerified: "2030-01-01T00:00:00Z"},
+	}, true)
+	if err != nil || imported != 2 || skipped != 0 {
+		t.Fatalf("unexpected import: %d imported, %d skipped (%v)", imported, skipped, err)
+	}
+	if c, _ := book.Get("bbbbbbbbbbbbbbbb"); c.Petname != "bob" || c.LastVerified != "2020-01-01T00:00:00Z" {
+		t.Errorf("the date of the last check of an existing contact has been replaced: %+v", c)
+	}
+	if c, _ := book.Get("cccccccccccccccc"); c.LastVerified != "" {
+		t.Errorf("the date of the last check of a new contact has been imported: %+v", c)
+	}
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"math/rand"
-	"time"
-	"strings"
-	"encoding/binary"
 )
 
 // Classes for peers
@@ -21,104 +19,31 @@ type contextType struct {
 	PeerSet         map[string]int // The integer value represents the class
 
 	StatusSubscriptions map[string]func(statusMessage *StatusPacket)
+	Interests           map[string]peerInterest      // Interest filters of the light peers (see Replication)
+	PeerClocks          map[string]map[string]uint32 // Latest vector clock advertised by each peer (see seenByPeers)
 
-	PrivateKey  PrivateKey
-	PublicKey   PublicKey
-	DisplayName string // Self-signing name of this node, derived from the public key
+	Identities []*LocalIdentity // Identities hosted by this gossiper (the default identity first)
 
-	Database *DbConnection
+	Database MessageStore
 
-	PowTarget int // Number of leading zeros for proof-of-work
-}
-
-var Context contextType
-
-// GetMyNextID returns the next ID of this node.
-func (c *contextType) GetMyNextID() uint32 {
-	return c.Database.NextID(c.DisplayName)
-}
-
-// AddNewMessage adds a new message to this gossiper (when received from a client) and returns its ID.
-// The destination can be left empty (in this case, it is treated as a public message).
-func (c *contextType) AddNewMessage(message string, destination string) (uint32, error) {
-
-	var m *MessageRecord
-	var nextID uint32
-	var errPk error
-	// Run on main thread
-	c.RunSync(func() {
-		nextID = c.GetMyNextID()
-
-		m = &MessageRecord{}
-		m.Data.ID = nextID
-		m.Data.Origin = c.DisplayName
-		m.Data.Destination = destination
-
-		if destination == "" {
-			// Public message
-			m.Data.Content = []byte(message) // Unencrypted content (since it is public)
-		} else {
-			// Private message
-			pk, err := c.GetPublicKeyOf(destination)
-			if err != nil {
-				// Public key not found (unknown node)
-				errPk = err
-				return
-			}
+	Pow *PowPolicy // Proof-of-work declared in the messages of this node, and required from other nodes
 
-			// The content is stored and encrypted twice, first with the public key of the sender (who should be able to
-			// see their own message), then with the public key of the recipient
-
-			encryptedMine, err := c.PublicKey.Encrypt([]byte(message))
-			if err != nil {
-				// Encryption error (message too long?)
-				errPk = err
-				return
-			}
-
-			encryptedTheirs, err := pk.Encrypt([]byte(message))
-			if err != nil {
-				// Encryption error (message too long?)
-				errPk = err
-				return
-			}
-
-			// Store the length of the first chunk (so as to identify the split point)
-			lenBin := make([]byte, 2)
-			binary.LittleEndian.PutUint16(lenBin, uint16(len(encryptedMine)))
-			m.Data.Content = append(lenBin, encryptedMine...)
-			m.Data.Content = append(m.Data.Content, encryptedTheirs...)
-		}
-
-		m.Data.Signature = c.PrivateKey.Sign(m.Data.Payload())
-		m.FromAddress = "localhost:" + strings.Split(c.ThisNodeAddress, ":")[1]
-		m.DateSeen = time.Now().Format(time.RFC3339)
-		errPk = nil
-	})
-	if errPk != nil {
-		return 0, errPk
-	}
+	Running context.Context // Cancelled when the node starts shutting down
 
-	// Compute proof-of-work nonce on the caller thread
-	m.Data.ComputeNonce(c.PowTarget)
+	Devices  *DeviceRegistry  // Devices linked to the identities of the network
+	Aliases  *AliasRegistry   // Aliases registered on the network
+	Profiles *ProfileRegistry // Latest profiles of the nodes of the network
 
-	c.RunSync(func() {
-		err := c.VerifyMessage(&m.Data)
-		if err != nil {
-			// Something wrong has happened
-			panic(err)
-		}
-
-		c.Database.InsertOrUpdateMessage(m)
-	})
-	return nextID, nil
+	Config *Config
 }
 
+var Context contextType
+
 // VerifyMessage verifies the content of a message prior to accepting it, in terms of its structure,
 // proof-of-work nonce, and digital signature.
 func (c *contextType) VerifyMessage(message *RumorMessage) error {
 	// Verify the structure of the message (as well as the proof-of-work nonce)
-	err := message.SanityCheck(c.PowTarget)
+	err := message.SanityCheck(c.Pow)
 	if err != nil {
 		return err
 	}
@@ -150,19 +75,45 @@ func (c *contextType) VerifyMessage(message *RumorMessage) error {
 	return nil
 }
 
+// IsRedundant tells whether a rumor would be discarded by TryInsertMessage anyway, because it is out of order,
+// or because the stored message with the same ID has a lower (or the same) hash and is not a placeholder. Such rumors
+// do not need to be verified, which bounds the time spent checking memory-hard proofs-of-work of duplicate rumors.
+func (c *contextType) IsRedundant(m *RumorMessage) (bool, error) {
+	expectedNextID, err := c.Database.NextID(m.Origin)
+	if err != nil {
+		return false, err
+	}
+	if m.ID > expectedNextID {
+		return true, nil
+	} else if m.ID == expectedNextID {
+		return false, nil
+	}
+	dbMsg, err := c.Database.GetMessage(m.Origin, m.ID)
+	if err != nil || dbMsg == nil || dbMsg.Placeholder {
+		return false, err
+	}
+	return CompareHashes(m.ComputeHash(), dbMsg.MessageHash()) != -1, nil
+}
+
 // TryInsertMessage inserts a new message in order.
 // Returns true if the message is inserted, and false if it was already seen.
 // An error is returned if the supplied ID is not the expected next ID (i.e. if the message is out of order)
 // Note that the message is assumed to have already been verified for correctness.
+// Light nodes store a tombstone instead of the messages they do not keep (see Keeps).
 func (c *contextType) TryInsertMessage(m *RumorMessage, originAddress string) (bool, error) {
-	expectedNextID := c.Database.NextID(m.Origin)
+	expectedNextID, err := c.Database.NextID(m.Origin)
+	if err != nil {
+		return false, err
+	}
 	if m.ID == expectedNextID {
 		// New message (in order)
-		mr := &MessageRecord{}
-		mr.Data = *m
-		mr.FromAddress = originAddress
-		mr.DateSeen = time.Now().Format(time.RFC3339)
-		c.Database.InsertOrUpdateMessage(mr)
+		mr := c.newRecord(m, originAddress)
+		if err := c.Database.InsertOrUpdateMessage(mr); err != nil {
+			return false, err
+		}
+		if !mr.Pruned {
+			c.messageStored(mr)
+		}
 		return true, nil
 
 	} else if m.ID < expectedNextID {
@@ -170,15 +121,25 @@ func (c *contextType) TryInsertMessage(m *RumorMessage, originAddress string) (b
 		// In this case, conflicts are resolved by adopting the message with the lowest hash.
 		// Note that messages are already verified at this point, so this case can happen only if the sender
 		// tries to send different messages having the same ID (with possibly malicious intent).
+		// Placeholders are always replaced, since their hash has not been verified.
 
-		dbMsg := c.Database.GetMessage(m.Origin, m.ID).Data
-		if CompareHashes(m.ComputeHash(), dbMsg.ComputeHash()) == -1 {
+		dbMsg, err := c.Database.GetMessage(m.Origin, m.ID)
+		if err != nil {
+			return false, err
+		} else if dbMsg == nil {
+			return false, errMessageNotFound
+		}
+		if dbMsg.Placeholder || CompareHashes(m.ComputeHash(), dbMsg.MessageHash()) == -1 {
 			// Replace the old message with the new one
-			mr := &MessageRecord{}
-			mr.Data = *m
-			mr.FromAddress = originAddress
-			mr.DateSeen = time.Now().Format(time.RFC3339)
-			c.Database.InsertOrUpdateMessage(mr)
+			mr := c.newRecord(m, originAddress)
+			if err := c.Database.InsertOrUpdateMessage(mr); err != nil {
+				return false, err
+			}
+			if mr.Pruned {
+				c.forgetMessage(messageKey{m.Origin, m.ID})
+			} else {
+				c.messageStored(mr)
+			}
 			return true, nil // We return true to redistribute the message
 		}
 
@@ -190,15 +151,36 @@ func (c *contextType) TryInsertMessage(m *RumorMessage, originAddress string) (b
 }
 
 // BuildStatusMessage returns a status packet with the vector clock of all the messages seen so far by this node
-func (c *contextType) BuildStatusMessage() *StatusPacket {
+// (and its interest filter if it is a light node)
+func (c *contextType) BuildStatusMessage() (*StatusPacket, error) {
+	vectorClock, err := c.VectorClock()
+	if err != nil {
+		return nil, err
+	}
 	status := &StatusPacket{}
-	status.Want = c.Database.VectorClock()
-	return status
+	status.Want = vectorClock
+	status.Interest = c.InterestFilter()
+	return status, nil
 }
 
-// BuildRumorMessage returns a rumor message with the given (origin, ID) pair.
-func (c *contextType) BuildRumorMessage(origin string, id uint32) *RumorMessage {
-	return &c.Database.GetMessage(origin, id).Data
+// errMessageNotFound is returned when a message that is expected to be in the database is missing.
+var errMessageNotFound = errors.New("message not found in database")
+
+// errMessagePruned is returned when a message has been replaced with a tombstone that cannot be forwarded.
+var errMessagePruned = errors.New("message pruned from the database")
+
+// BuildRumorMessage returns a rumor message with the given (origin, ID) pair (possibly a tombstone, see
+// MessageRecord.Forwardable).
+func (c *contextType) BuildRumorMessage(origin string, id uint32) (*RumorMessage, error) {
+	m, err := c.Database.GetMessage(origin, id)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return nil, errMessageNotFound
+	} else if !m.Forwardable() {
+		return nil, errMessagePruned
+	}
+	return &m.Data, nil
 }
 
 // RandomPeer selects a random peer from the current set of peers.
@@ -220,12 +202,15 @@ func (c *contextType) RandomPeer(exclusionList []string) string {
 }
 
 // VectorClockEquals tells whether the vector clock of this node equals the vector clock of the other node.
-func (c *contextType) VectorClockEquals(other []PeerStatus) bool {
-	this := c.Database.VectorClock()
+func (c *contextType) VectorClockEquals(other []PeerStatus) (bool, error) {
+	this, err := c.VectorClock()
+	if err != nil {
+		return false, err
+	}
 
 	// Compare lengths first
 	if len(this) != len(other) {
-		return false
+		return false, nil
 	}
 
 	vcMap := make(map[string]uint32)
@@ -237,21 +222,24 @@ func (c *contextType) VectorClockEquals(other []PeerStatus) bool {
 		match, found := vcMap[otherStatus.Identifier]
 		if found {
 			if match != otherStatus.NextID {
-				return false
+				return false, nil
 			}
 		} else {
-			return false
+			return false, nil
 		}
 	}
 
-	return true
+	return true, nil
 }
 
 // VectorClockDifference returns the difference between two vector clocks.
 // The first return value represents the messages seen by this node (but not by the other node),
 // whereas the second return value represents the messages seen by the other  node, but not by this node.
-func (c *contextType) VectorClockDifference(other []PeerStatus) ([]PeerStatus, []PeerStatus) {
-	this := c.Database.VectorClock()
+func (c *contextType) VectorClockDifference(other []PeerStatus) ([]PeerStatus, []PeerStatus, error) {
+	this, err := c.VectorClock()
+	if err != nil {
+		return nil, nil, err
+	}
 	vcMap := make(map[string]uint32)
 	for _, record := range this {
 		vcMap[record.Identifier] = record.NextID
@@ -284,14 +272,26 @@ func (c *contextType) VectorClockDifference(other []PeerStatus) ([]PeerStatus, [
 		}
 	}
 
-	return otherDiff, thisDiff
+	return otherDiff, thisDiff, nil
 }
 
 // SendStatusMessage sends a status message to the given peer.
-func (c *contextType) SendStatusMessage(peerAddress string) {
-	statusMsg := c.BuildStatusMessage()
-	gossipMsg := GossipPacket{Status: statusMsg}
-	Context.GossipSocket.Send(Encode(&gossipMsg), peerAddress)
+func (c *contextType) SendStatusMessage(peerAddress string) error {
+	statusMsg, err := c.BuildStatusMessage()
+	if err != nil {
+		return err
+	}
+	return c.SendPacket(&GossipPacket{Status: statusMsg}, peerAddress)
+}
+
+// SendPacket encodes a gossip packet and sends it to the given peer.
+func (c *contextType) SendPacket(packet *GossipPacket, peerAddress string) error {
+	data, err := Encode(packet)
+	if err != nil {
+		return err
+	}
+	c.GossipSocket.Send(data, peerAddress)
+	return nil
 }
 
 // RunSync runs a synchronous task on the main event loop, and waits until the task has finished
@@ -306,8 +306,10 @@ func (c *contextType) RunSync(event func()) {
 
 func (c *contextType) GetPublicKeyOf(node string) (PublicKey, error) {
 	// Get special message with ID = 0 (public key announcement)
-	msg := c.Database.GetMessage(node, 0)
-	if msg == nil {
+	msg, err := c.Database.GetMessage(node, 0)
+	if err != nil {
+		return nil, err
+	} else if msg == nil {
 		// Unknown node
 		return nil, errors.New("public key of node not found in database (unknown node)")
 	}
@@ -318,21 +320,3 @@ func (c *contextType) GetPublicKeyOf(node string) (PublicKey, error) {
 	}
 	return pk, nil
 }
-
-// InsertKeyAnnouncementMessage adds a new message with the public key announcement of THIS node
-func (c *contextType) InsertKeyAnnouncementMessage() {
-	nextID := c.GetMyNextID()
-	if nextID == 0 {
-		m := &MessageRecord{}
-		m.Data.ID = nextID
-		m.Data.Origin = c.DisplayName
-		m.Data.Destination = ""                  // Public message
-		m.Data.Content = c.PublicKey.Serialize() // The content is our public key (serialized to bytes)
-		m.Data.Signature = make([]byte, 0)       // Not needed, since the name is self-signing
-		m.Data.ComputeNonce(c.PowTarget)
-		m.FromAddress = "localhost:" + strings.Split(c.ThisNodeAddress, ":")[1]
-		m.DateSeen = time.Now().Format(time.RFC3339)
-
-		c.Database.InsertOrUpdateMessage(m)
-	}
-}
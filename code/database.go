@@ -3,9 +3,14 @@ package main
 import (
 	"database/sql"
 	"encoding/hex"
-	_ "github.com/mattn/go-sqlite3"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// DbConnection is the SQLite implementation of MessageStore.
 type DbConnection struct {
 	Connection *sql.DB
 }
@@ -15,6 +20,39 @@ type MessageRecord struct {
 	DateSeen        string
 	FromAddress     string
 	ComputedHashStr string // This field is used just for the GUI
+	Pruned          bool   // True for tombstones: the message has been pruned, and only its ID and hash are kept
+	Hash            []byte // Hash of the pruned message (only set for tombstones)
+	Placeholder     bool   // True for the tombstones of the messages skipped by a light node (see SkipNotice)
+}
+
+// OutgoingMessage is a message composed by the client that has not been inserted yet.
+// It is stored in the outbox before its proof-of-work is computed, so that it survives restarts.
+type OutgoingMessage struct {
+	LocalID     int64
+	Identity    string // Name of the local identity sending the message
+	Destination string
+	Content     string
+	DateCreated string
+	State       string // See JobState (only "queued", "retrying" and "failed" are stored)
+	Attempts    int    // Number of failed attempts
+	LastError   string
+	TTL         uint32 // Lifetime of the message in seconds (0 = no expiry)
+	Kind        uint32 // Kind of the message (see KIND_TEXT)
+	Channel     string // ID of the channel of a public message (hexadecimal), empty for the main public room
+}
+
+// MessageHash returns the hash of the message, which is stored separately for tombstones.
+func (m *MessageRecord) MessageHash() []byte {
+	if m.Pruned {
+		return m.Hash
+	}
+	return m.Data.ComputeHash()
+}
+
+// Forwardable tells whether the message can be sent to other nodes: tombstones can only be forwarded if they
+// can be verified without the content (see RumorMessage.Tombstone).
+func (m *MessageRecord) Forwardable() bool {
+	return !m.Pruned || (m.Data.IsTombstone() && !m.Placeholder)
 }
 
 func (m *MessageRecord) ComputeHashStr() string {
@@ -23,174 +61,986 @@ func (m *MessageRecord) ComputeHashStr() string {
 	return m.ComputedHashStr
 }
 
-func NewConnection(dbPath string) *DbConnection {
-	db, err := sql.Open("sqlite3", dbPath+"/messages.db")
-	FailOnError(err)
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS messages (" +
-		"ID INTEGER NOT NULL," +
-		"Origin TEXT NOT NULL," +
-		"Destination TEXT NOT NULL," +
-		"Content BLOB NOT NULL," +
-		"Signature BLOB NOT NULL," +
-		"Nonce BLOB NOT NULL," +
-		"DateSeen TEXT NOT NULL," +
-		"FromAddress TEXT NOT NULL," +
-		"PRIMARY KEY (ID, Origin)" +
-		")")
-	FailOnError(err)
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_origin ON messages(Origin)")
-	FailOnError(err)
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_dest ON messages(Destination)")
-	FailOnError(err)
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS idx_origin_dest ON messages(Origin, Destination)")
-	FailOnError(err)
-	return &DbConnection{db}
-}
-
-func (db *DbConnection) NextID(nodeName string) uint32 {
-	stmt, err := db.Connection.Prepare("SELECT MAX(ID) FROM messages WHERE Origin = ?")
-	FailOnError(err)
-	defer stmt.Close()
-	result, err := stmt.Query(nodeName)
-	FailOnError(err)
-	defer result.Close()
-
-	var id uint32
-	if result.Next() {
-		var id_ sql.NullInt64
-		result.Scan(&id_)
-		if id_.Valid {
-			id = uint32(id_.Int64) + 1
-		} else {
-			id = 0
-		}
-	} else {
-		id = 0
-	}
-	return id
-}
-
-func (db *DbConnection) VectorClock() []PeerStatus {
-	result, err := db.Connection.Query("SELECT Origin, MAX(ID) FROM messages GROUP BY Origin")
-	FailOnError(err)
-	defer result.Close()
-
-	status := make([]PeerStatus, 0)
-	for result.Next() {
-		var origin string
-		var id uint32
-		result.Scan(&origin, &id)
-		status = append(status, PeerStatus{origin, id + 1})
+// isTransientDbError tells whether a database error is temporary (e.g. the database is locked by another
+// connection), in which case the operation can be retried.
+func isTransientDbError(err error) bool {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
 	}
-	return status
+	return false
 }
 
-func (db *DbConnection) NodeList() []string {
-	result, err := db.Connection.Query("SELECT DISTINCT Origin FROM messages ORDER BY Origin ASC")
-	FailOnError(err)
-	defer result.Close()
+// retry runs a database operation, retrying it if it fails with a transient error.
+func (db *DbConnection) retry(operation func() error) error {
+	return Retry(isTransientDbError, operation)
+}
 
-	nodes := make([]string, 0)
-	for result.Next() {
-		var origin string
-		result.Scan(&origin)
-		nodes = append(nodes, origin)
-	}
-	return nodes
-}
-
-func (db *DbConnection) InsertOrUpdateMessage(m *MessageRecord) {
-	// Start a new transaction
-	tx, err := db.Connection.Begin()
-	FailOnError(err)
-
-	// Delete the message if it already exists
-	stmt, err := tx.Prepare("DELETE FROM messages WHERE Origin = ? AND ID = ?")
-	FailOnError(err)
-	_, err = stmt.Exec(m.Data.Origin, m.Data.ID)
-	FailOnError(err)
-	stmt.Close()
-
-	// Insert the new message
-	stmt, err = tx.Prepare("INSERT INTO messages(ID, Origin, Destination, Content, Signature, Nonce, " +
-		"DateSeen, FromAddress) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
-	_, err = stmt.Exec(m.Data.ID, m.Data.Origin, m.Data.Destination, m.Data.Content,
-		m.Data.Signature, m.Data.Nonce, m.DateSeen, m.FromAddress)
-	FailOnError(err)
-	stmt.Close()
-
-	// Commit transaction
-	FailOnError(tx.Commit())
-}
-
-func (db *DbConnection) GetMessage(origin string, id uint32) *MessageRecord {
-	stmt, err := db.Connection.Prepare("SELECT Destination, Content, Signature, Nonce," +
-		"DateSeen, FromAddress FROM messages WHERE Origin = ? AND ID = ?")
-	FailOnError(err)
-	defer stmt.Close()
-
-	result, err := stmt.Query(origin, id)
-	FailOnError(err)
-	defer result.Close()
-
-	if result.Next() {
-		m := &MessageRecord{}
-		m.Data.Origin = origin
-		m.Data.ID = id
-		result.Scan(&m.Data.Destination, &m.Data.Content, &m.Data.Signature,
-			&m.Data.Nonce, &m.DateSeen, &m.FromAddress)
-		if len(m.Data.Content) == 0 {
-			m.Data.Content = make([]byte, 0) // Fix for serialization
-		}
-		if len(m.Data.Signature) == 0 {
-			m.Data.Signature = make([]byte, 0) // Fix for serialization
-		}
-		return m
-	} else {
+// Name of the SQLite database file in the data directory
+const DATABASE_FILE_NAME = "messages.db"
+
+// Time (in milliseconds) during which SQLite waits for a lock to be released before reporting that the database is
+// busy. It is kept short, since the database is mostly used from the main thread.
+const SQLITE_BUSY_TIMEOUT = 1000
+
+// migration upgrades the database schema from Version-1 to Version.
+type migration struct {
+	Version     int
+	Description string
+	Destructive bool // If true, a backup of the database is made before running the migration
+	Apply       func(tx *sql.Tx) error
+}
+
+// execAll returns a migration step that runs the given statements.
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumns returns a migration step that adds columns to a table ({table, column, definition} triples).
+// Columns that already exist are skipped, since they may have been created by development builds
+// that predate schema versioning.
+func addColumns(columns ...[3]string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, column := range columns {
+			if err := addColumnIfMissing(tx, column[0], column[1], column[2]); err != nil {
+				return err
+			}
+		}
 		return nil
 	}
 }
 
-func (db *DbConnection) GetAllMessagesTo(destination string) []*MessageRecord {
-	stmt, err := db.Connection.Prepare("SELECT ID, Origin, Content, Signature, Nonce," +
-		"DateSeen, FromAddress FROM messages WHERE Destination = ?")
-	FailOnError(err)
-	defer stmt.Close()
+// Ordered list of the schema migrations. The schema version of a database is the version of the last migration
+// applied to it. New migrations must be appended at the end, and existing ones must never be modified.
+var migrations = []migration{
+	{1, "create the messages table", false, execAll(
+		"CREATE TABLE IF NOT EXISTS messages ("+
+			"ID INTEGER NOT NULL,"+
+			"Origin TEXT NOT NULL,"+
+			"Destination TEXT NOT NULL,"+
+			"Content BLOB NOT NULL,"+
+			"Signature BLOB NOT NULL,"+
+			"Nonce BLOB NOT NULL,"+
+			"DateSeen TEXT NOT NULL,"+
+			"FromAddress TEXT NOT NULL,"+
+			"PRIMARY KEY (ID, Origin)"+
+			")",
+		"CREATE INDEX IF NOT EXISTS idx_origin ON messages(Origin)",
+		"CREATE INDEX IF NOT EXISTS idx_dest ON messages(Destination)",
+		"CREATE INDEX IF NOT EXISTS idx_origin_dest ON messages(Origin, Destination)",
+	)},
+	{2, "create the outbox table", false, execAll(
+		"CREATE TABLE IF NOT EXISTS outbox (" +
+			"LocalID INTEGER PRIMARY KEY AUTOINCREMENT," +
+			"Destination TEXT NOT NULL," +
+			"Content TEXT NOT NULL," +
+			"DateCreated TEXT NOT NULL" +
+			")",
+	)},
+	{3, "add the retry state of the outbox", false, addColumns(
+		[3]string{"outbox", "State", "TEXT NOT NULL DEFAULT 'queued'"},
+		[3]string{"outbox", "Attempts", "INTEGER NOT NULL DEFAULT 0"},
+		[3]string{"outbox", "LastError", "TEXT NOT NULL DEFAULT ''"},
+	)},
+	{4, "add the proof-of-work scheme", false, addColumns(
+		[3]string{"messages", "PowScheme", "INTEGER NOT NULL DEFAULT 0"},
+	)},
+	{5, "add the declared difficulty", false, addColumns(
+		[3]string{"messages", "Difficulty", "INTEGER NOT NULL DEFAULT 0"},
+	)},
+	{6, "add TTLs and tombstones", false, addColumns(
+		[3]string{"messages", "TTL", "INTEGER NOT NULL DEFAULT 0"},
+		[3]string{"messages", "Pruned", "INTEGER NOT NULL DEFAULT 0"},
+		[3]string{"messages", "Hash", "BLOB"},
+		[3]string{"outbox", "TTL", "INTEGER NOT NULL DEFAULT 0"},
+	)},
+	{7, "add message kinds and read marks (multi-device support)", false, func(tx *sql.Tx) error {
+		err := addColumns(
+			[3]string{"messages", "Kind", "INTEGER NOT NULL DEFAULT 0"},
+			[3]string{"messages", "Encoding", "INTEGER NOT NULL DEFAULT 0"},
+			[3]string{"outbox", "Kind", "INTEGER NOT NULL DEFAULT 0"},
+		)(tx)
+		if err != nil {
+			return err
+		}
+		return execAll(
+			"CREATE INDEX IF NOT EXISTS idx_kind ON messages(Kind)",
+			"CREATE TABLE IF NOT EXISTS read_marks ("+
+				"Origin TEXT NOT NULL PRIMARY KEY,"+
+				"NextID INTEGER NOT NULL"+
+				")",
+		)(tx)
+	}},
+	{8, "assign the outbox and the read marks to local identities", true, func(tx *sql.Tx) error {
+		// The existing rows belong to the default identity, whose name is not known yet (see AssignDefaultIdentity)
+		err := addColumns([3]string{"outbox", "Identity", "TEXT NOT NULL DEFAULT ''"})(tx)
+		if err != nil {
+			return err
+		}
+		return execAll(
+			"CREATE TABLE read_marks_v8 ("+
+				"Identity TEXT NOT NULL,"+
+				"Origin TEXT NOT NULL,"+
+				"NextID INTEGER NOT NULL,"+
+				"PRIMARY KEY (Identity, Origin)"+
+				")",
+			"INSERT INTO read_marks_v8(Identity, Origin, NextID) SELECT '', Origin, NextID FROM read_marks",
+			"DROP TABLE read_marks",
+			"ALTER TABLE read_marks_v8 RENAME TO read_marks",
+		)(tx)
+	}},
+	{9, "create the address books", false, execAll(
+		"CREATE TABLE IF NOT EXISTS contacts (" +
+			"Identity TEXT NOT NULL," +
+			"Name TEXT NOT NULL," +
+			"Petname TEXT NOT NULL," +
+			"Notes TEXT NOT NULL," +
+			"Verified INTEGER NOT NULL," +
+			"Updated TEXT NOT NULL," +
+			"PRIMARY KEY (Identity, Name)" +
+			")",
+	)},
+	{10, "record the safety-number checks", false, addColumns(
+		[3]string{"contacts", "LastVerified", "TEXT NOT NULL DEFAULT ''"},
+	)},
+	{11, "record the receipts of private messages, and the preferences of the identities", false, execAll(
+		"CREATE TABLE IF NOT EXISTS receipts ("+
+			"Origin TEXT NOT NULL,"+
+			"ID INTEGER NOT NULL,"+
+			"Delivered TEXT NOT NULL DEFAULT '',"+
+			"Read TEXT NOT NULL DEFAULT '',"+
+			"PRIMARY KEY (Origin, ID)"+
+			")",
+		"CREATE TABLE IF NOT EXISTS preferences ("+
+			"Identity TEXT NOT NULL PRIMARY KEY,"+
+			"ReadReceipts INTEGER NOT NULL DEFAULT 1"+
+			")",
+	)},
+	{12, "store the hash of every message (references by hash)", false, func(tx *sql.Tx) error {
+		// The columns are listed explicitly: the columns added by later migrations do not exist yet
+		rows, err := tx.Query("SELECT ID, Origin, Destination, Content, Signature, Nonce, PowScheme, Difficulty, " +
+			"TTL, Kind, Encoding FROM messages WHERE Pruned = 0")
+		if err != nil {
+			return err
+		}
+		messages := make([]*MessageRecord, 0)
+		for rows.Next() {
+			m := &MessageRecord{}
+			if err := rows.Scan(&m.Data.ID, &m.Data.Origin, &m.Data.Destination, &m.Data.Content, &m.Data.Signature,
+				&m.Data.Nonce, &m.Data.PowScheme, &m.Data.Difficulty, &m.Data.TTL, &m.Data.Kind,
+				&m.Data.Encoding); err != nil {
+				rows.Close()
+				return err
+			}
+			messages = append(messages, m)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, m := range messages {
+			_, err := tx.Exec("UPDATE messages SET Hash = ? WHERE Origin = ? AND ID = ?", m.Data.ComputeHash(),
+				m.Data.Origin, m.Data.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return execAll("CREATE INDEX IF NOT EXISTS idx_hash ON messages(Hash)")(tx)
+	}},
+	{13, "add topic channels", false, func(tx *sql.Tx) error {
+		err := addColumns(
+			[3]string{"messages", "Channel", "BLOB"},
+			[3]string{"outbox", "Channel", "TEXT NOT NULL DEFAULT ''"},
+		)(tx)
+		if err != nil {
+			return err
+		}
+		return execAll(
+			"CREATE INDEX IF NOT EXISTS idx_channel ON messages(Channel)",
+			"CREATE TABLE IF NOT EXISTS channels ("+
+				"Identity TEXT NOT NULL,"+
+				"ID BLOB NOT NULL,"+
+				"Name TEXT NOT NULL,"+
+				"Key BLOB,"+
+				"Subscribed TEXT NOT NULL,"+
+				"PRIMARY KEY (Identity, ID)"+
+				")",
+		)(tx)
+	}},
+	{14, "add placeholders of skipped messages", false, func(tx *sql.Tx) error {
+		if err := addColumns([3]string{"messages", "Placeholder", "INTEGER NOT NULL DEFAULT 0"})(tx); err != nil {
+			return err
+		}
+		return execAll("CREATE INDEX IF NOT EXISTS idx_placeholder ON messages(Placeholder) WHERE Placeholder = 1")(tx)
+	}},
+	{15, "add forwardable tombstones", false, addColumns(
+		[3]string{"messages", "Format", "INTEGER NOT NULL DEFAULT 0"},
+		[3]string{"messages", "Digest", "BLOB"},
+	)},
+}
+
+// SCHEMA_VERSION is the schema version expected by this binary.
+var SCHEMA_VERSION = migrations[len(migrations)-1].Version
 
-	result, err := stmt.Query(destination)
-	FailOnError(err)
-	defer result.Close()
+func NewConnection(dbPath string) (*DbConnection, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(dbPath, DATABASE_FILE_NAME)+fmt.Sprintf("?_busy_timeout=%d", SQLITE_BUSY_TIMEOUT))
+	if err != nil {
+		return nil, err
+	}
+	connection := &DbConnection{db}
+	if err := connection.migrate(dbPath); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return connection, nil
+}
 
-	output := make([]*MessageRecord, 0)
-	for result.Next() {
-		m := &MessageRecord{}
-		m.Data.Destination = destination
-		result.Scan(&m.Data.ID, &m.Data.Origin, &m.Data.Content, &m.Data.Signature,
-			&m.Data.Nonce, &m.DateSeen, &m.FromAddress)
-		output = append(output, m)
+// OpenReadOnlyConnection opens the database of a data directory without modifying it, e.g. to back up the data
+// directory of a running node. The schema is not migrated: the database must have the schema version of this binary.
+func OpenReadOnlyConnection(dbPath string) (*DbConnection, error) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dbPath, DATABASE_FILE_NAME)+
+		fmt.Sprintf("?mode=ro&_busy_timeout=%d", SQLITE_BUSY_TIMEOUT))
+	if err != nil {
+		return nil, err
+	}
+	connection := &DbConnection{db}
+	version, err := connection.schemaVersion()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if version != SCHEMA_VERSION {
+		db.Close()
+		return nil, fmt.Errorf("the database has schema version %d, but this gossiper expects version %d "+
+			"(start the matching version of the gossiper once to migrate it)", version, SCHEMA_VERSION)
+	}
+	return connection, nil
+}
+
+// schemaVersion returns the schema version of the database. Databases created before schema versioning
+// have no schema_version table: they are assumed to have version 1 (or 0 if they are empty).
+func (db *DbConnection) schemaVersion() (int, error) {
+	var tables, versioned int
+	err := db.Connection.QueryRow("SELECT COUNT(*), COALESCE(SUM(name = 'schema_version'), 0) FROM sqlite_master "+
+		"WHERE type = 'table' AND name IN ('schema_version', 'messages')").Scan(&tables, &versioned)
+	if err != nil {
+		return 0, err
 	}
 
-	return output
+	var version sql.NullInt64
+	if versioned > 0 {
+		if err := db.Connection.QueryRow("SELECT MAX(Version) FROM schema_version").Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	if version.Valid {
+		return int(version.Int64), nil
+	} else if tables > 0 {
+		// Only the messages table exists (unversioned database)
+		return 1, nil
+	}
+	return 0, nil
 }
 
-func (db *DbConnection) GetAllMessagesBetween(origin string, destination string) []*MessageRecord {
-	stmt, err := db.Connection.Prepare("SELECT ID, Origin, Destination, Content, Signature, Nonce," +
-		"DateSeen, FromAddress FROM messages WHERE (Origin = ? AND Destination = ?)" +
-		"OR (Origin = ? AND Destination = ?) ORDER BY DateSeen ASC")
-	FailOnError(err)
-	defer stmt.Close()
+// migrate upgrades the schema of the database to SCHEMA_VERSION. Each migration runs in its own transaction,
+// along with the update of the schema version, so that a failed migration leaves the database unchanged.
+// Databases created by a newer version of the gossiper are rejected.
+func (db *DbConnection) migrate(dbPath string) error {
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SCHEMA_VERSION {
+		return fmt.Errorf("the database has schema version %d, but this gossiper only supports up to version %d "+
+			"(it has been opened by a newer version)", version, SCHEMA_VERSION)
+	}
+	_, err = db.Connection.Exec("CREATE TABLE IF NOT EXISTS schema_version (Version INTEGER NOT NULL)")
+	if err != nil {
+		return err
+	}
 
-	result, err := stmt.Query(origin, destination, destination, origin)
-	FailOnError(err)
-	defer result.Close()
+	fresh := version == 0
+	if fresh {
+		LogDb.Infof("creating a new database (schema version %d)", SCHEMA_VERSION)
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		if m.Destructive && !fresh {
+			// A new database has nothing to lose
+			backup, err := db.backup(dbPath, version)
+			if err != nil {
+				return fmt.Errorf("unable to back up the database before migration %d: %s", m.Version, err.Error())
+			}
+			LogDb.Infof("database backed up to %s", backup)
+		}
 
-	output := make([]*MessageRecord, 0)
+		if !fresh {
+			LogDb.Infof("migrating the database to schema version %d (%s)", m.Version, m.Description)
+		}
+		tx, err := db.Connection.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.Apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %s", m.Version, err.Error())
+		}
+		if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO schema_version(Version) VALUES (?)", m.Version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		version = m.Version
+	}
+	return nil
+}
+
+// backup copies the database to a new file in the data directory, and returns its path.
+func (db *DbConnection) backup(dbPath string, version int) (string, error) {
+	path := filepath.Join(dbPath, fmt.Sprintf("%s.v%d.%s.bak", DATABASE_FILE_NAME, version,
+		time.Now().Format("20060102-150405")))
+	_, err := db.Connection.Exec("VACUUM INTO ?", path)
+	return path, err
+}
+
+// addColumnIfMissing adds a column to an existing table, unless the column already exists.
+func addColumnIfMissing(tx *sql.Tx, table string, column string, definition string) error {
+	result, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	found := false
 	for result.Next() {
-		m := &MessageRecord{}
-		result.Scan(&m.Data.ID, &m.Data.Origin, &m.Data.Destination, &m.Data.Content, &m.Data.Signature,
-			&m.Data.Nonce, &m.DateSeen, &m.FromAddress)
-		output = append(output, m)
+		var cid int
+		var name, columnType string
+		var notNull, primaryKey int
+		var defaultValue sql.NullString
+		if err := result.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			result.Close()
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	result.Close()
+	if err := result.Err(); err != nil || found {
+		return err
+	}
+
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func (db *DbConnection) Close() error {
+	return db.Connection.Close()
+}
+
+func (db *DbConnection) NextID(nodeName string) (uint32, error) {
+	var id sql.NullInt64
+	err := db.retry(func() error {
+		return db.Connection.QueryRow("SELECT MAX(ID) FROM messages WHERE Origin = ?", nodeName).Scan(&id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if id.Valid {
+		return uint32(id.Int64) + 1, nil
+	}
+	return 0, nil
+}
+
+func (db *DbConnection) VectorClock() ([]PeerStatus, error) {
+	var status []PeerStatus
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT Origin, MAX(ID) FROM messages GROUP BY Origin")
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		status = make([]PeerStatus, 0)
+		for result.Next() {
+			var origin string
+			var id uint32
+			if err := result.Scan(&origin, &id); err != nil {
+				return err
+			}
+			status = append(status, PeerStatus{origin, id + 1})
+		}
+		return result.Err()
+	})
+	return status, err
+}
+
+func (db *DbConnection) FirstPlaceholders() ([]PeerStatus, error) {
+	var status []PeerStatus
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT Origin, MIN(ID) FROM messages WHERE Placeholder = 1 GROUP BY Origin")
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		status = make([]PeerStatus, 0)
+		for result.Next() {
+			var origin string
+			var id uint32
+			if err := result.Scan(&origin, &id); err != nil {
+				return err
+			}
+			status = append(status, PeerStatus{origin, id})
+		}
+		return result.Err()
+	})
+	return status, err
+}
+
+func (db *DbConnection) NodeList() ([]string, error) {
+	var nodes []string
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT DISTINCT Origin FROM messages ORDER BY Origin ASC")
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		nodes = make([]string, 0)
+		for result.Next() {
+			var origin string
+			if err := result.Scan(&origin); err != nil {
+				return err
+			}
+			nodes = append(nodes, origin)
+		}
+		return result.Err()
+	})
+	return nodes, err
+}
+
+func (db *DbConnection) InsertOrUpdateMessage(m *MessageRecord) error {
+	return db.insertMessage(m, nil)
+}
+
+// InsertSentMessage stores a new message of a local identity and removes its draft from the outbox, in the same
+// transaction, so that a message is never sent twice if the node stops in between.
+func (db *DbConnection) InsertSentMessage(m *MessageRecord, localID int64) error {
+	return db.insertMessage(m, &localID)
+}
+
+// insertMessage stores a message (replacing the message with the same (origin, ID) pair if any), and removes the
+// outbox entry with the given LocalID (if not nil) in the same transaction.
+func (db *DbConnection) insertMessage(m *MessageRecord, localID *int64) error {
+	err := db.retry(func() error {
+		// Start a new transaction
+		tx, err := db.Connection.Begin()
+		if err != nil {
+			return err
+		}
+
+		// Delete the message if it already exists
+		_, err = tx.Exec("DELETE FROM messages WHERE Origin = ? AND ID = ?", m.Data.Origin, m.Data.ID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// Remove the draft of the message from the outbox
+		if localID != nil {
+			if _, err = tx.Exec("DELETE FROM outbox WHERE LocalID = ?", *localID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		// Insert the new message
+		_, err = tx.Exec("INSERT INTO messages("+MESSAGE_COLUMNS+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, "+
+			"?, ?, ?, ?)", m.Data.ID, m.Data.Origin, m.Data.Destination, m.Data.Content, m.Data.Signature, m.Data.Nonce,
+			m.Data.PowScheme, m.Data.Difficulty, m.Data.TTL, m.Data.Kind, m.Data.Encoding, m.DateSeen, m.FromAddress,
+			m.Pruned, m.MessageHash(), nullableBlob(m.Data.Channel), m.Placeholder,
+			m.Data.Format, nullableBlob(m.Data.Digest))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		// Commit transaction
+		return tx.Commit()
+	})
+	if err != nil && !isTransientDbError(err) {
+		// The message could not be stored, even though it has been accepted
+		return Fatal(err)
+	}
+	return err
+}
+
+// MESSAGE_COLUMNS lists the columns of the messages table, in the order expected by scanMessage
+const MESSAGE_COLUMNS = "ID, Origin, Destination, Content, Signature, Nonce, PowScheme, Difficulty, TTL, Kind, " +
+	"Encoding, DateSeen, FromAddress, Pruned, Hash, Channel, Placeholder, Format, Digest"
+
+// nullableBlob returns nil for empty values (stored as NULL), so that "IS NULL" selects all of them.
+func nullableBlob(value []byte) interface{} {
+	if len(value) == 0 {
+		return nil
+	}
+	return value
+}
+
+// scanMessage reads a row selected with MESSAGE_COLUMNS into a record.
+func scanMessage(row interface{ Scan(...interface{}) error }, m *MessageRecord) error {
+	err := row.Scan(&m.Data.ID, &m.Data.Origin, &m.Data.Destination, &m.Data.Content, &m.Data.Signature,
+		&m.Data.Nonce, &m.Data.PowScheme, &m.Data.Difficulty, &m.Data.TTL, &m.Data.Kind, &m.Data.Encoding,
+		&m.DateSeen, &m.FromAddress, &m.Pruned, &m.Hash, &m.Data.Channel, &m.Placeholder, &m.Data.Format,
+		&m.Data.Digest)
+	if err != nil {
+		return err
+	}
+	if len(m.Data.Content) == 0 {
+		m.Data.Content = make([]byte, 0) // Fix for serialization
+	}
+	if len(m.Data.Signature) == 0 {
+		m.Data.Signature = make([]byte, 0) // Fix for serialization
+	}
+	if len(m.Data.Nonce) == 0 {
+		m.Data.Nonce = make([]byte, 0) // Fix for serialization (tombstones)
+	}
+	return nil
+}
+
+// GetMessage returns the message with the given (origin, ID) pair, or nil if it does not exist.
+func (db *DbConnection) GetMessage(origin string, id uint32) (*MessageRecord, error) {
+	m := &MessageRecord{}
+	err := db.retry(func() error {
+		return scanMessage(db.Connection.QueryRow("SELECT "+MESSAGE_COLUMNS+
+			" FROM messages WHERE Origin = ? AND ID = ?", origin, id), m)
+	})
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// queryMessages runs a query that returns a list of messages (selected with MESSAGE_COLUMNS).
+func (db *DbConnection) queryMessages(query string, args ...interface{}) ([]*MessageRecord, error) {
+	var output []*MessageRecord
+	err := db.retry(func() error {
+		result, err := db.Connection.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		output = make([]*MessageRecord, 0)
+		for result.Next() {
+			m := &MessageRecord{}
+			if err := scanMessage(result, m); err != nil {
+				return err
+			}
+			output = append(output, m)
+		}
+		return result.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// GetMessageByHash returns the message with the given hash (including tombstones), or nil if it does not exist.
+func (db *DbConnection) GetMessageByHash(hash []byte) (*MessageRecord, error) {
+	messages, err := db.queryMessages("SELECT "+MESSAGE_COLUMNS+" FROM messages WHERE Hash = ? LIMIT 1", hash)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return messages[0], nil
+}
+
+func (db *DbConnection) GetAllMessagesTo(destination string) ([]*MessageRecord, error) {
+	return db.queryMessages("SELECT "+MESSAGE_COLUMNS+" FROM messages WHERE Destination = ? AND Channel IS NULL "+
+		"AND Pruned = 0", destination)
+}
+
+func (db *DbConnection) GetChannelMessages(channel []byte) ([]*MessageRecord, error) {
+	return db.queryMessages("SELECT "+MESSAGE_COLUMNS+" FROM messages WHERE Channel = ? AND Pruned = 0", channel)
+}
+
+// ChannelList returns the channels that have messages (except tombstones), with their number of messages.
+func (db *DbConnection) ChannelList() ([]ChannelActivity, error) {
+	var channels []ChannelActivity
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT Channel, COUNT(*), MAX(DateSeen) FROM messages " +
+			"WHERE Channel IS NOT NULL AND Pruned = 0 GROUP BY Channel")
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		channels = make([]ChannelActivity, 0)
+		for result.Next() {
+			var c ChannelActivity
+			if err := result.Scan(&c.ID, &c.Messages, &c.LastSeen); err != nil {
+				return err
+			}
+			channels = append(channels, c)
+		}
+		return result.Err()
+	})
+	return channels, err
+}
+
+func (db *DbConnection) GetAllMessagesBetween(origin string, destination string) ([]*MessageRecord, error) {
+	return db.queryMessages("SELECT "+MESSAGE_COLUMNS+" FROM messages WHERE ((Origin = ? AND Destination = ?)"+
+		"OR (Origin = ? AND Destination = ?)) AND Pruned = 0 ORDER BY DateSeen ASC",
+		origin, destination, destination, origin)
+}
+
+func (db *DbConnection) GetAllMessages() ([]*MessageRecord, error) {
+	return db.queryMessages("SELECT " + MESSAGE_COLUMNS + " FROM messages ORDER BY Origin ASC, ID ASC")
+}
+
+func (db *DbConnection) GetAllMessagesOfKind(kind uint32) ([]*MessageRecord, error) {
+	return db.queryMessages("SELECT "+MESSAGE_COLUMNS+" FROM messages WHERE Kind = ? AND Pruned = 0 "+
+		"ORDER BY Origin ASC, ID ASC", kind)
+}
+
+func (db *DbConnection) GetPrunableMessages(filter PruneFilter) ([]*MessageRecord, error) {
+	conditions := []string{"Pruned = 0", "ID > 0"}
+	for _, kind := range PERMANENT_KINDS {
+		conditions = append(conditions, fmt.Sprintf("Kind != %d", kind))
+	}
+	args := make([]interface{}, 0)
+	if !filter.ExpiredAt.IsZero() {
+		conditions = append(conditions, "TTL > 0 AND julianday(DateSeen) + TTL / 86400.0 < julianday(?)")
+		args = append(args, filter.ExpiredAt.Format(time.RFC3339))
 	}
+	if !filter.SeenBefore.IsZero() {
+		conditions = append(conditions, "julianday(DateSeen) < julianday(?)")
+		args = append(args, filter.SeenBefore.Format(time.RFC3339))
+	}
+	if filter.Origin != "" {
+		conditions = append(conditions, "Origin = ?")
+		args = append(args, filter.Origin)
+	}
+	for _, origin := range filter.ExcludeOrigins {
+		conditions = append(conditions, "Origin != ?")
+		args = append(args, origin)
+	}
+	if filter.PrivateOnly {
+		conditions = append(conditions, "Destination != ''")
+	}
+	for _, node := range filter.ExcludeNodes {
+		conditions = append(conditions, "Origin != ? AND Destination != ?")
+		args = append(args, node, node)
+	}
+	return db.queryMessages("SELECT "+MESSAGE_COLUMNS+" FROM messages WHERE "+strings.Join(conditions, " AND ")+
+		" ORDER BY julianday(DateSeen) ASC, ID ASC", args...)
+}
+
+// PruneMessages replaces the given messages with tombstones (see RumorMessage.Tombstone): their content is deleted,
+// but the rows are kept with the hash of the message, so that the IDs of each origin remain contiguous.
+func (db *DbConnection) PruneMessages(messages []*MessageRecord) error {
+	return db.retry(func() error {
+		tx, err := db.Connection.Begin()
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			t := m.Data.Tombstone()
+			_, err = tx.Exec("UPDATE messages SET Content = ?, Signature = ?, Nonce = ?, Digest = ?, Pruned = 1, "+
+				"Hash = ? WHERE Origin = ? AND ID = ? AND Pruned = 0", t.Content, t.Signature, t.Nonce,
+				nullableBlob(t.Digest), m.MessageHash(), m.Data.Origin, m.Data.ID)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// StoredContentSize returns the total size of the content of the messages that have not been pruned.
+func (db *DbConnection) StoredContentSize() (int64, error) {
+	var size sql.NullInt64
+	err := db.retry(func() error {
+		return db.Connection.QueryRow("SELECT SUM(length(Content)) FROM messages WHERE Pruned = 0").Scan(&size)
+	})
+	return size.Int64, err
+}
+
+// InsertOutgoingMessage stores a new message in the outbox, and sets its LocalID.
+func (db *DbConnection) InsertOutgoingMessage(m *OutgoingMessage) error {
+	return db.retry(func() error {
+		result, err := db.Connection.Exec("INSERT INTO outbox(Identity, Destination, Content, DateCreated, State, "+
+			"Attempts, LastError, TTL, Kind, Channel) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", m.Identity, m.Destination,
+			m.Content, m.DateCreated, m.State, m.Attempts, m.LastError, m.TTL, m.Kind, m.Channel)
+		if err != nil {
+			return err
+		}
+		m.LocalID, err = result.LastInsertId()
+		return err
+	})
+}
+
+// UpdateOutgoingMessage overwrites a message in the outbox (identified by its LocalID).
+func (db *DbConnection) UpdateOutgoingMessage(m *OutgoingMessage) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("UPDATE outbox SET Destination = ?, Content = ?, State = ?, Attempts = ?, "+
+			"LastError = ?, TTL = ?, Kind = ?, Channel = ? WHERE LocalID = ?", m.Destination, m.Content, m.State,
+			m.Attempts, m.LastError, m.TTL, m.Kind, m.Channel, m.LocalID)
+		return err
+	})
+}
+
+// GetOutgoingMessages returns the messages in the outbox, in the order in which they were composed.
+func (db *DbConnection) GetOutgoingMessages() ([]*OutgoingMessage, error) {
+	var output []*OutgoingMessage
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT LocalID, Identity, Destination, Content, DateCreated, State, " +
+			"Attempts, LastError, TTL, Kind, Channel FROM outbox ORDER BY LocalID ASC")
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		output = make([]*OutgoingMessage, 0)
+		for result.Next() {
+			m := &OutgoingMessage{}
+			if err := result.Scan(&m.LocalID, &m.Identity, &m.Destination, &m.Content, &m.DateCreated, &m.State,
+				&m.Attempts, &m.LastError, &m.TTL, &m.Kind, &m.Channel); err != nil {
+				return err
+			}
+			output = append(output, m)
+		}
+		return result.Err()
+	})
+	return output, err
+}
+
+func (db *DbConnection) DeleteOutgoingMessage(localID int64) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("DELETE FROM outbox WHERE LocalID = ?", localID)
+		return err
+	})
+}
+
+// GetReadMarks returns the read marks of a local identity: for each origin, the messages with a lower ID have been read.
+func (db *DbConnection) GetReadMarks(identity string) ([]PeerStatus, error) {
+	var marks []PeerStatus
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT Origin, NextID FROM read_marks WHERE Identity = ? "+
+			"ORDER BY Origin ASC", identity)
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		marks = make([]PeerStatus, 0)
+		for result.Next() {
+			var mark PeerStatus
+			if err := result.Scan(&mark.Identifier, &mark.NextID); err != nil {
+				return err
+			}
+			marks = append(marks, mark)
+		}
+		return result.Err()
+	})
+	return marks, err
+}
+
+// RaiseReadMark marks the messages of an origin with an ID lower than nextID as read by a local identity (read marks
+// never decrease). Returns true if the read mark has changed.
+func (db *DbConnection) RaiseReadMark(identity string, origin string, nextID uint32) (bool, error) {
+	var changed bool
+	err := db.retry(func() error {
+		result, err := db.Connection.Exec("INSERT INTO read_marks(Identity, Origin, NextID) VALUES (?, ?, ?) "+
+			"ON CONFLICT(Identity, Origin) DO UPDATE SET NextID = excluded.NextID WHERE excluded.NextID > NextID",
+			identity, origin, nextID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		changed = rows > 0
+		return err
+	})
+	return changed, err
+}
+
+// AssignDefaultIdentity assigns the outbox entries and the read marks stored before the support of multiple
+// identities to the default identity.
+func (db *DbConnection) AssignDefaultIdentity(identity string) error {
+	return db.retry(func() error {
+		tx, err := db.Connection.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range []string{
+			"UPDATE outbox SET Identity = ? WHERE Identity = ''",
+			"UPDATE OR IGNORE read_marks SET Identity = ? WHERE Identity = ''",
+		} {
+			if _, err := tx.Exec(statement, identity); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM read_marks WHERE Identity = ''"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// GetContacts returns the address book of a local identity, sorted by name.
+func (db *DbConnection) GetContacts(identity string) ([]*Contact, error) {
+	var contacts []*Contact
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT Name, Petname, Notes, Verified, Updated, LastVerified "+
+			"FROM contacts WHERE Identity = ? ORDER BY Name ASC", identity)
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		contacts = make([]*Contact, 0)
+		for result.Next() {
+			c := &Contact{}
+			if err := result.Scan(&c.Name, &c.Petname, &c.Notes, &c.Verified, &c.Updated,
+				&c.LastVerified); err != nil {
+				return err
+			}
+			contacts = append(contacts, c)
+		}
+		return result.Err()
+	})
+	return contacts, err
+}
+
+// PutContact creates or replaces a contact in the address book of a local identity.
+func (db *DbConnection) PutContact(identity string, c *Contact) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("INSERT OR REPLACE INTO contacts(Identity, Name, Petname, Notes, Verified, "+
+			"Updated, LastVerified) VALUES (?, ?, ?, ?, ?, ?, ?)", identity, c.Name, c.Petname, c.Notes, c.Verified,
+			c.Updated, c.LastVerified)
+		return err
+	})
+}
+
+// DeleteContact removes a contact from the address book of a local identity.
+func (db *DbConnection) DeleteContact(identity string, name string) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("DELETE FROM contacts WHERE Identity = ? AND Name = ?", identity, name)
+		return err
+	})
+}
+
+// GetReceipt returns the receipts received for a private message (empty dates if none).
+func (db *DbConnection) GetReceipt(origin string, id uint32) (Receipt, error) {
+	var receipt Receipt
+	err := db.retry(func() error {
+		receipt = Receipt{}
+		err := db.Connection.QueryRow("SELECT Delivered, Read FROM receipts WHERE Origin = ? AND ID = ?",
+			origin, id).Scan(&receipt.Delivered, &receipt.Read)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	return receipt, err
+}
+
+// RecordReceipt records the date on which a private message was delivered or read (the first date is kept).
+// A message that has been read has also been delivered.
+func (db *DbConnection) RecordReceipt(origin string, id uint32, status string, date string) error {
+	return db.retry(func() error {
+		read := ""
+		if status == RECEIPT_READ {
+			read = date
+		}
+		_, err := db.Connection.Exec("INSERT INTO receipts(Origin, ID, Delivered, Read) VALUES (?, ?, ?, ?) "+
+			"ON CONFLICT(Origin, ID) DO UPDATE SET "+
+			"Delivered = CASE WHEN Delivered = '' THEN excluded.Delivered ELSE Delivered END, "+
+			"Read = CASE WHEN Read = '' THEN excluded.Read ELSE Read END", origin, id, date, read)
+		return err
+	})
+}
+
+// GetPreferences returns the preferences of a local identity (the default preferences if none are stored).
+func (db *DbConnection) GetPreferences(identity string) (Preferences, error) {
+	var preferences Preferences
+	err := db.retry(func() error {
+		preferences = DefaultPreferences()
+		err := db.Connection.QueryRow("SELECT ReadReceipts FROM preferences WHERE Identity = ?",
+			identity).Scan(&preferences.ReadReceipts)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	return preferences, err
+}
+
+// PutPreferences stores the preferences of a local identity.
+func (db *DbConnection) PutPreferences(identity string, p *Preferences) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("INSERT OR REPLACE INTO preferences(Identity, ReadReceipts) VALUES (?, ?)",
+			identity, p.ReadReceipts)
+		return err
+	})
+}
+
+// GetChannels returns the channels to which a local identity is subscribed, sorted by name.
+func (db *DbConnection) GetChannels(identity string) ([]*Channel, error) {
+	var channels []*Channel
+	err := db.retry(func() error {
+		result, err := db.Connection.Query("SELECT ID, Name, Key, Subscribed FROM channels WHERE Identity = ? "+
+			"ORDER BY Name ASC", identity)
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+
+		channels = make([]*Channel, 0)
+		for result.Next() {
+			c := &Channel{}
+			if err := result.Scan(&c.ID, &c.Name, &c.Key, &c.Subscribed); err != nil {
+				return err
+			}
+			channels = append(channels, c)
+		}
+		return result.Err()
+	})
+	return channels, err
+}
+
+// PutChannel creates or replaces the subscription of a local identity to a channel.
+func (db *DbConnection) PutChannel(identity string, c *Channel) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("INSERT OR REPLACE INTO channels(Identity, ID, Name, Key, Subscribed) "+
+			"VALUES (?, ?, ?, ?, ?)", identity, c.ID, c.Name, nullableBlob(c.Key), c.Subscribed)
+		return err
+	})
+}
 
-	return output
+// DeleteChannel removes the subscription of a local identity to a channel.
+func (db *DbConnection) DeleteChannel(identity string, channelID []byte) error {
+	return db.retry(func() error {
+		_, err := db.Connection.Exec("DELETE FROM channels WHERE Identity = ? AND ID = ?", identity, channelID)
+		return err
+	})
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationsFromUnversionedDatabase(t *testing.T) {
+	dir := t.TempDir()
+
+	// Database created before schema versioning (only the messages table)
+	legacy, err := sql.Open("sqlite3", filepath.Join(dir, DATABASE_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := legacy.Begin()
+	if err := migrations[0].Apply(tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	_, err = legacy.Exec("INSERT INTO messages (ID, Origin, Destination, Content, Signature, Nonce, DateSeen, "+
+		"FromAddress) VALUES (1, 'a', '', ?, ?, ?, '2020-01-01T00:00:00Z', 'peer')", []byte("content"),
+		[]byte("signature"), []byte("nonce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Close()
+
+	db, err := NewConnection(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if version, err := db.schemaVersion(); err != nil || version != SCHEMA_VERSION {
+		t.Fatalf("unexpected schema version %d (%v)", version, err)
+	}
+	m, err := db.GetMessage("a", 1)
+	if err != nil || m == nil {
+		t.Fatalf("the message has not been migrated (%v)", err)
+	}
+	if string(m.Data.Content) != "content" || m.Data.Format != FORMAT_LEGACY || m.Data.Digest != nil || m.Pruned {
+		t.Errorf("unexpected migrated message: %+v", m)
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, DATABASE_FILE_NAME+".v*.bak"))
+	if len(backups) == 0 {
+		t.Errorf("the database has not been backed up before the destructive migrations (%v)", backups)
+	}
+}
+
+func TestDatabaseStoresForwardableTombstones(t *testing.T) {
+	db, err := NewConnection(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m := &MessageRecord{Data: RumorMessage{Origin: "a", ID: 1, Content: []byte("content"),
+		Signature: []byte("signature"), Nonce: []byte("nonce"), Format: FORMAT_DIGEST, Difficulty: 1},
+		DateSeen: "2020-01-01T00:00:00Z"}
+	hash := m.MessageHash()
+	if err := db.InsertOrUpdateMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PruneMessages([]*MessageRecord{m}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := db.GetMessage("a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Pruned || len(stored.Data.Content) != 0 || !stored.Forwardable() {
+		t.Fatal("the message has not been replaced with a forwardable tombstone")
+	}
+	if !bytes.Equal(stored.Data.ComputeHash(), hash) || string(stored.Data.Signature) != "signature" {
+		t.Error("the tombstone cannot be verified")
+	}
+}
+
+func TestReadOnlyConnection(t *testing.T) {
+	dir := t.TempDir()
+	legacy, err := sql.Open("sqlite3", filepath.Join(dir, DATABASE_FILE_NAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, _ := legacy.Begin()
+	if err := migrations[0].Apply(tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+	legacy.Close()
+
+	// A database with another schema version is not migrated
+	if db, err := OpenReadOnlyConnection(dir); err == nil {
+		db.Close()
+		t.Fatal("a database with an older schema version has been opened")
+	}
+	db, err := NewConnection(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if backups, _ := filepath.Glob(filepath.Join(dir, DATABASE_FILE_NAME+".v*.bak")); len(backups) != 1 {
+		t.Errorf("the database has been modified by the read-only connection (%v)", backups)
+	}
+
+	db, err = OpenReadOnlyConnection(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.InsertOrUpdateMessage(&MessageRecord{Data: RumorMessage{Origin: "a"}}); err == nil {
+		t.Error("a message has been written through the read-only connection")
+	}
+}
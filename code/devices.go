@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Lifetime of the synchronization messages between the devices of an identity (30 days)
+const DEVICE_SYNC_TTL = 30 * 24 * 3600
+
+// deviceLink is the latest link (or unlink) message published by a primary identity for a device.
+type deviceLink struct {
+	ID     uint32
+	Linked bool
+}
+
+// deviceClaim is the latest claim published by a device.
+type deviceClaim struct {
+	ID      uint32
+	Primary string
+}
+
+// DeviceRegistry keeps track of the devices linked to the identities of the network.
+//
+// Every device has its own keypair, and thus its own name and ID sequence. A device belongs to an identity (whose
+// name is the name of its primary device) if the primary has linked it (KIND_DEVICE_LINK, signed by the primary key)
+// and the device has claimed the identity (KIND_DEVICE_CLAIM, signed by the device key), so that neither can
+// take over the other. Only the latest link/unlink message of the primary and the latest claim of the device count.
+// A device cannot have devices of its own. The registry must only be used from the main thread.
+type DeviceRegistry struct {
+	links  map[string]map[string]deviceLink // Primary -> device -> latest link/unlink
+	claims map[string]deviceClaim           // Device -> latest claim
+}
+
+// DeviceInfo describes a device of an identity (for the client).
+type DeviceInfo struct {
+	Name    string
+	Linked  bool // The primary has linked the device
+	Claimed bool // The device has claimed the identity
+}
+
+// DeviceSync is the content of the KIND_DEVICE_SYNC messages, which the devices of an identity send to each other.
+type DeviceSync struct {
+	Read []PeerStatus // Read marks (see MessageStore.GetReadMarks)
+}
+
+func NewDeviceRegistry() *DeviceRegistry {
+	return &DeviceRegistry{
+		links:  make(map[string]map[string]deviceLink),
+		claims: make(map[string]deviceClaim),
+	}
+}
+
+// Rebuild loads the device links and claims from the message store.
+func (r *DeviceRegistry) Rebuild() error {
+	r.links = make(map[string]map[string]deviceLink)
+	r.claims = make(map[string]deviceClaim)
+	for _, kind := range []uint32{KIND_DEVICE_LINK, KIND_DEVICE_UNLINK, KIND_DEVICE_CLAIM} {
+		messages, err := Context.Database.GetAllMessagesOfKind(kind)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			r.Add(m)
+		}
+	}
+	return nil
+}
+
+// Add records a device link, unlink or claim (other messages are ignored).
+func (r *DeviceRegistry) Add(m *MessageRecord) {
+	name := string(m.Data.Content)
+	if m.Pruned || m.Data.Destination != "" || len(name) != DISPLAY_NAME_BITS/5 || name == m.Data.Origin {
+		return
+	}
+	switch m.Data.Kind {
+	case KIND_DEVICE_LINK, KIND_DEVICE_UNLINK:
+		devices, found := r.links[m.Data.Origin]
+		if !found {
+			devices = make(map[string]deviceLink)
+			r.links[m.Data.Origin] = devices
+		}
+		if current, found := devices[name]; !found || m.Data.ID > current.ID {
+			devices[name] = deviceLink{m.Data.ID, m.Data.Kind == KIND_DEVICE_LINK}
+		}
+	case KIND_DEVICE_CLAIM:
+		if current, found := r.claims[m.Data.Origin]; !found || m.Data.ID > current.ID {
+			r.claims[m.Data.Origin] = deviceClaim{m.Data.ID, name}
+		}
+	}
+}
+
+// isLinked tells whether a device has been linked by the given primary, and has claimed it.
+func (r *DeviceRegistry) isLinked(device string, primary string) bool {
+	claim, found := r.claims[device]
+	return found && claim.Primary == primary && r.links[primary][device].Linked
+}
+
+// IdentityOf returns the identity to which a node belongs (the node itself, unless it is a linked device).
+func (r *DeviceRegistry) IdentityOf(name string) string {
+	if claim, found := r.claims[name]; found && r.isLinked(name, claim.Primary) {
+		if primaryClaim, found := r.claims[claim.Primary]; !found || !r.isLinked(claim.Primary, primaryClaim.Primary) {
+			return claim.Primary
+		}
+	}
+	return name
+}
+
+// NamesOf returns the names of all the devices of an identity: the primary first, then the linked devices by name.
+func (r *DeviceRegistry) NamesOf(identity string) []string {
+	names := []string{identity}
+	if r.IdentityOf(identity) != identity {
+		return names
+	}
+	for device := range r.links[identity] {
+		if r.isLinked(device, identity) {
+			names = append(names, device)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// DevicesOf returns the devices that have been linked by an identity, or that have claimed it.
+func (r *DeviceRegistry) DevicesOf(identity string) []DeviceInfo {
+	devices := make(map[string]*DeviceInfo)
+	for device, link := range r.links[identity] {
+		devices[device] = &DeviceInfo{Name: device, Linked: link.Linked}
+	}
+	for device, claim := range r.claims {
+		if claim.Primary == identity {
+			if _, found := devices[device]; !found {
+				devices[device] = &DeviceInfo{Name: device}
+			}
+			devices[device].Claimed = true
+		}
+	}
+	output := make([]DeviceInfo, 0, len(devices))
+	for _, info := range devices {
+		output = append(output, *info)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Name < output[j].Name
+	})
+	return output
+}
+
+// Primary returns the name of the identity to which this local identity belongs (the name of its primary device).
+func (id *LocalIdentity) Primary() string {
+	return Context.Devices.IdentityOf(id.DisplayName)
+}
+
+// IsMine tells whether a node belongs to the same identity as this local identity.
+func (id *LocalIdentity) IsMine(name string) bool {
+	return Context.Devices.IdentityOf(name) == id.Primary()
+}
+
+// Conversation returns the private text messages exchanged by this local identity and another identity
+// (from any of their devices), sorted by date.
+func (id *LocalIdentity) Conversation(contact string) ([]*MessageRecord, error) {
+	output := make([]*MessageRecord, 0)
+	seen := make(map[messageKey]bool)
+	for _, mine := range Context.Devices.NamesOf(id.Primary()) {
+		for _, theirs := range Context.Devices.NamesOf(Context.Devices.IdentityOf(contact)) {
+			messages, err := Context.Database.GetAllMessagesBetween(mine, theirs)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range messages {
+				key := messageKey{m.Data.Origin, m.Data.ID}
+				if isTextKind(m.Data.Kind) && !seen[key] {
+					seen[key] = true
+					output = append(output, m)
+				}
+			}
+		}
+	}
+	sort.SliceStable(output, func(i, j int) bool {
+		return output[i].DateSeen < output[j].DateSeen
+	})
+	return output, nil
+}
+
+// MarkConversationRead marks all the messages received from another identity as read, and sends a read receipt
+// for the messages that were unread (see sendReadReceipts). If the read marks have changed and this identity has
+// other devices, they are sent to them. Must be called on the main thread.
+func (id *LocalIdentity) MarkConversationRead(contact string) error {
+	messages, err := id.Conversation(contact)
+	if err != nil {
+		return err
+	}
+	marks, err := id.ReadMarks()
+	if err != nil {
+		return err
+	}
+	nextIDs := make(map[string]uint32)
+	unread := make([]*MessageRecord, 0)
+	for _, m := range messages {
+		if id.IsMine(m.Data.Origin) {
+			continue
+		}
+		if m.Data.ID+1 > nextIDs[m.Data.Origin] {
+			nextIDs[m.Data.Origin] = m.Data.ID + 1
+		}
+		if m.Data.ID >= marks[m.Data.Origin] {
+			unread = append(unread, m)
+		}
+	}
+	if err := id.sendReadReceipts(unread); err != nil {
+		return err
+	}
+
+	changed := make([]PeerStatus, 0)
+	for origin, next := range nextIDs {
+		raised, err := Context.Database.RaiseReadMark(id.DisplayName, origin, next)
+		if err != nil {
+			return err
+		} else if raised {
+			changed = append(changed, PeerStatus{origin, next})
+		}
+	}
+	if len(changed) == 0 || len(Context.Devices.NamesOf(id.Primary())) < 2 {
+		return nil
+	}
+	content, _ := json.Marshal(DeviceSync{Read: changed})
+	_, err = id.Jobs.Submit(&OutgoingMessage{Kind: KIND_DEVICE_SYNC, Content: string(content),
+		Destination: id.Primary(), TTL: DEVICE_SYNC_TTL})
+	return err
+}
+
+// ReadMarks returns the read marks of this local identity, by origin.
+func (id *LocalIdentity) ReadMarks() (map[string]uint32, error) {
+	marks, err := Context.Database.GetReadMarks(id.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	output := make(map[string]uint32)
+	for _, mark := range marks {
+		output[mark.Identifier] = mark.NextID
+	}
+	return output, nil
+}
+
+// applyDeviceSync merges the state sent by another device of this identity.
+func (id *LocalIdentity) applyDeviceSync(m *MessageRecord) error {
+	if m.Data.Origin == id.DisplayName || !id.IsMine(m.Data.Origin) || m.Data.Destination != id.Primary() {
+		return nil
+	}
+	content, err := id.DecryptContent(&m.Data)
+	if err != nil {
+		return err
+	}
+	var sync DeviceSync
+	if err := json.Unmarshal(content, &sync); err != nil {
+		return err
+	}
+	for _, mark := range sync.Read {
+		if _, err := Context.Database.RaiseReadMark(id.DisplayName, mark.Identifier, mark.NextID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// messageStored updates the in-memory state of the node after a message has been stored. Must be called
+// on the main thread.
+func (c *contextType) messageStored(m *MessageRecord) {
+	c.Devices.Add(m)
+	c.Aliases.Add(m)
+	ReportError(LogDb, "unable to prune the previous profile", c.Profiles.Add(m))
+	ReportError(LogDb, "unable to apply a deletion", c.applyDeletion(m))
+	for _, id := range c.Identities {
+		if m.Data.Kind == KIND_DEVICE_LINK || m.Data.Kind == KIND_DEVICE_UNLINK || m.Data.Kind == KIND_DEVICE_CLAIM {
+			// The identities of the conversations may have changed
+			id.Search.Invalidate()
+		}
+		id.Search.Add(m)
+		if m.Data.Kind == KIND_DEVICE_SYNC {
+			ReportError(LogMain, "unable to apply the state of another device", id.applyDeviceSync(m))
+		} else if m.Data.Kind == KIND_RECEIPT {
+			ReportError(LogMain, "unable to apply a receipt", id.applyReceipt(m))
+		} else if m.Data.Kind == KIND_EDIT {
+			// The edited message is indexed again, with its new content
+			target, err := id.Edits.Add(m)
+			ReportError(LogMain, "unable to apply an edit", err)
+			if target != nil {
+				id.Search.Add(target)
+			}
+		}
+		id.Threads.Add(m)
+		id.queueDeliveryReceipt(m)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -10,10 +12,11 @@ import (
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -32,7 +35,7 @@ type PublicKey interface {
 }
 
 type PrivateKey interface {
-	Sign(message []byte) []byte
+	Sign(message []byte) ([]byte, error)
 	Decrypt(ciphertext []byte) ([]byte, error)
 }
 
@@ -45,41 +48,58 @@ type RsaPrivateKey struct {
 }
 
 // GenerateKeyPair generates a 2048-bit RSA public/private key pair
-func GenerateKeyPair(dataDirectory string) (PrivateKey, PublicKey) {
-	fmt.Println("INFO: generating a 2048-bit RSA keypair for the first time.")
+func GenerateKeyPair(dataDirectory string) (PrivateKey, PublicKey, error) {
+	LogCrypto.Infof("generating a %d-bit RSA keypair for the first time", RSA_KEY_SIZE_BITS)
 
 	key, err := rsa.GenerateKey(rand.Reader, RSA_KEY_SIZE_BITS)
-	FailOnError(err)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Save the key on file
-	os.MkdirAll(dataDirectory, os.ModePerm)
+	if err := os.MkdirAll(dataDirectory, os.ModePerm); err != nil {
+		return nil, nil, err
+	}
 
 	buf := bytes.Buffer{}
 	encoder := gob.NewEncoder(&buf)
-	err = encoder.Encode(key)
-	FailOnError(err)
+	if err := encoder.Encode(key); err != nil {
+		return nil, nil, err
+	}
 
-	err = ioutil.WriteFile(dataDirectory+"/key.bin", buf.Bytes(), 0644)
-	FailOnError(err)
-	return &RsaPrivateKey{key}, &RsaPublicKey{&key.PublicKey}
+	if err := ioutil.WriteFile(dataDirectory+"/key.bin", buf.Bytes(), 0644); err != nil {
+		return nil, nil, err
+	}
+	return &RsaPrivateKey{key}, &RsaPublicKey{&key.PublicKey}, nil
 }
 
-func LoadKeyPair(dataDirectory string) (PrivateKey, PublicKey) {
-	os.MkdirAll(dataDirectory, os.ModePerm)
+func LoadKeyPair(dataDirectory string) (PrivateKey, PublicKey, error) {
+	if err := os.MkdirAll(dataDirectory, os.ModePerm); err != nil {
+		return nil, nil, err
+	}
 
 	keyBin, err := ioutil.ReadFile(dataDirectory + "/key.bin")
-	var key *rsa.PrivateKey
 	if err == nil {
-		key = &rsa.PrivateKey{}
-		decoder := gob.NewDecoder(bytes.NewBuffer(keyBin))
-		err := decoder.Decode(key)
-		FailOnError(err)
-		FailOnError(key.Validate())
-		return &RsaPrivateKey{key}, &RsaPublicKey{&key.PublicKey}
-	} else {
+		return DecodeKeyPair(keyBin)
+	} else if os.IsNotExist(err) {
 		// Generate a new key
 		return GenerateKeyPair(dataDirectory)
+	} else {
+		return nil, nil, err
+	}
+}
+
+// DecodeKeyPair decodes and validates a keypair in the format of key.bin.
+func DecodeKeyPair(keyBin []byte) (PrivateKey, PublicKey, error) {
+	key := &rsa.PrivateKey{}
+	decoder := gob.NewDecoder(bytes.NewBuffer(keyBin))
+	if err := decoder.Decode(key); err != nil {
+		return nil, nil, errors.New("unable to decode key.bin (" + err.Error() + ")")
 	}
+	if err := key.Validate(); err != nil {
+		return nil, nil, errors.New("invalid key in key.bin (" + err.Error() + ")")
+	}
+	return &RsaPrivateKey{key}, &RsaPublicKey{&key.PublicKey}, nil
 }
 
 func (k *RsaPublicKey) Serialize() []byte {
@@ -126,13 +146,114 @@ func (k *RsaPublicKey) Encrypt(message []byte) ([]byte, error) {
 	return enc, err
 }
 
-func (k *RsaPrivateKey) Sign(message []byte) []byte {
+func (k *RsaPrivateKey) Sign(message []byte) ([]byte, error) {
 	digest := sha256.Sum256(message)
-	signature, err := rsa.SignPSS(rand.Reader, k.key, crypto.SHA256, digest[:], nil)
-	FailOnError(err)
-	return signature
+	return rsa.SignPSS(rand.Reader, k.key, crypto.SHA256, digest[:], nil)
 }
 
 func (k *RsaPrivateKey) Decrypt(ciphertext []byte) ([]byte, error) {
 	return rsa.DecryptOAEP(sha256.New(), rand.Reader, k.key, ciphertext, nil)
 }
+
+// SealEnvelope encrypts a message for several recipients (e.g. all the devices of two identities).
+// The message is encrypted with a random AES-256-GCM key, which is encrypted with the public key of every recipient.
+// The envelope contains the number of recipients (uint8), then for each recipient its name, the length of the
+// encrypted key (uint16, little-endian) and the encrypted key, and finally the GCM nonce and the ciphertext.
+func SealEnvelope(message []byte, recipients map[string]PublicKey) ([]byte, error) {
+	if len(recipients) == 0 || len(recipients) > 255 {
+		return nil, errors.New("invalid number of recipients")
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// Sort the recipients, so that the envelope does not depend on the iteration order of the map
+	names := make([]string, 0, len(recipients))
+	for name := range recipients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteByte(byte(len(names)))
+	for _, name := range names {
+		if len(name) != DISPLAY_NAME_BITS/5 {
+			return nil, errors.New("invalid recipient name")
+		}
+		encryptedKey, err := recipients[name].Encrypt(key)
+		if err != nil {
+			return nil, err
+		}
+		length := make([]byte, 2)
+		binary.LittleEndian.PutUint16(length, uint16(len(encryptedKey)))
+		b.WriteString(name)
+		b.Write(length)
+		b.Write(encryptedKey)
+	}
+	b.Write(nonce)
+	b.Write(aead.Seal(nil, nonce, message, nil))
+	return b.Bytes(), nil
+}
+
+// OpenEnvelope decrypts an envelope created by SealEnvelope, as the given recipient.
+func OpenEnvelope(envelope []byte, name string, key PrivateKey) ([]byte, error) {
+	r := bytes.NewReader(envelope)
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.New("malformed envelope")
+	}
+	var encryptedKey []byte
+	for i := 0; i < int(count); i++ {
+		recipient := make([]byte, DISPLAY_NAME_BITS/5)
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(r, recipient); err != nil {
+			return nil, errors.New("malformed envelope")
+		}
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, errors.New("malformed envelope")
+		}
+		chunk := make([]byte, binary.LittleEndian.Uint16(length))
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, errors.New("malformed envelope")
+		}
+		if string(recipient) == name {
+			encryptedKey = chunk
+		}
+	}
+	if encryptedKey == nil {
+		return nil, errors.New("the envelope is not addressed to " + name)
+	}
+
+	messageKey, err := key.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, errors.New("malformed envelope")
+	}
+	ciphertext := make([]byte, r.Len())
+	r.Read(ciphertext)
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
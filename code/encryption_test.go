@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testKeyPair generates a keypair in a temporary directory.
+func testKeyPair(t *testing.T) (PrivateKey, PublicKey) {
+	t.Helper()
+	sk, pk, err := GenerateKeyPair(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk, pk
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	sk1, pk1 := testKeyPair(t)
+	sk2, pk2 := testKeyPair(t)
+	_, pk3 := testKeyPair(t)
+	message := []byte("hello, devices")
+	envelope, err := SealEnvelope(message, map[string]PublicKey{pk1.DeriveName(): pk1, pk2.DeriveName(): pk2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recipient := range []struct {
+		sk PrivateKey
+		pk PublicKey
+	}{{sk1, pk1}, {sk2, pk2}} {
+		opened, err := OpenEnvelope(envelope, recipient.pk.DeriveName(), recipient.sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(opened, message) {
+			t.Errorf("unexpected content: %q", opened)
+		}
+	}
+
+	if _, err := OpenEnvelope(envelope, pk3.DeriveName(), sk1); err == nil {
+		t.Error("an envelope has been opened by a node that is not a recipient")
+	}
+	if _, err := OpenEnvelope(envelope, pk2.DeriveName(), sk1); err == nil {
+		t.Error("an envelope has been opened with the key of another recipient")
+	}
+}
+
+func TestEnvelopeTampering(t *testing.T) {
+	sk, pk := testKeyPair(t)
+	envelope, err := SealEnvelope([]byte("content"), map[string]PublicKey{pk.DeriveName(): pk})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), envelope...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := OpenEnvelope(tampered, pk.DeriveName(), sk); err == nil {
+		t.Error("a tampered envelope has been opened")
+	}
+	for _, length := range []int{0, 1, 20, len(envelope) - 20} {
+		if _, err := OpenEnvelope(envelope[:length], pk.DeriveName(), sk); err == nil {
+			t.Errorf("an envelope truncated to %d bytes has been opened", length)
+		}
+	}
+}
+
+func TestSealEnvelopeRecipients(t *testing.T) {
+	_, pk := testKeyPair(t)
+	if _, err := SealEnvelope([]byte("content"), map[string]PublicKey{}); err == nil {
+		t.Error("an envelope without recipients has been sealed")
+	}
+	if _, err := SealEnvelope([]byte("content"), map[string]PublicKey{"short": pk}); err == nil {
+		t.Error("an envelope has been sealed for an invalid name")
+	}
+}
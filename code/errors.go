@@ -0,0 +1,64 @@
+package main
+
+import "fmt"
+
+// Number of attempts for operations that fail with a transient error (e.g. a locked database). The attempts are
+// not spaced out: operations mostly run on the main thread, which must not sleep, and the database already waits for
+// locks to be released (see SQLITE_BUSY_TIMEOUT) before reporting a transient error.
+const MAX_RETRIES = 3
+
+// FatalError marks an error after which the state of the node may be inconsistent
+// (e.g. a failed commit in the database): the node shuts down once it is reported (see ReportError).
+// Other errors are considered recoverable: they affect only the current request or packet,
+// and the node can safely carry on.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return e.Err.Error()
+}
+
+// Fatal wraps an error as a FatalError. Nil errors are returned as they are.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*FatalError); ok {
+		return err
+	}
+	return &FatalError{err}
+}
+
+// IsFatal tells whether the given error has been classified as fatal.
+func IsFatal(err error) bool {
+	_, ok := err.(*FatalError)
+	return ok
+}
+
+// ReportError logs an error at a level that depends on its classification. Fatal errors also stop the node, which
+// then exits with EXIT_SHUTDOWN_FAILURE.
+func ReportError(logger *Logger, context string, err error) {
+	if err == nil {
+		return
+	}
+	if IsFatal(err) {
+		logger.Errorf("%s: %s", context, err.Error())
+		requestShutdown(fmt.Errorf("%s: %s", context, err.Error()))
+	} else {
+		logger.Warnf("%s: %s", context, err.Error())
+	}
+}
+
+// Retry runs an operation until it succeeds, fails with a non-transient error,
+// or the maximum number of attempts is reached. The attempts follow each other immediately.
+func Retry(isTransient func(error) bool, operation func() error) error {
+	var err error
+	for attempt := 0; attempt < MAX_RETRIES; attempt++ {
+		err = operation()
+		if err == nil || !isTransient(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -1,160 +1,264 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 )
 
 func main() {
-	uiPort := flag.Int("UIPort", 0, "port for the HTTP client")
-	gossipIpPort := flag.String("gossipAddr", "", "address/port for the gossiper")
-	dataDir := flag.String("dataDir", "", "the directory for storing the DB and keys")
-	peersParams := flag.String("peers", "", "peers separated by commas")
-	powDifficulty := flag.Int("powDifficulty", 18, "proof-of-work difficulty (leading zeros)")
-
-	flag.Parse()
-
-	if *gossipIpPort == "" {
-		FailOnError(errors.New("you must supply a gossip address/port (gossipAddr). Use \":PORT\" to listen to all interfaces"))
+	if len(os.Args) > 1 {
+		if subcommand, found := subcommands[os.Args[1]]; found {
+			os.Exit(subcommand(os.Args[2:]))
+		}
 	}
-	Context.ThisNodeAddress = *gossipIpPort
 
-	if *dataDir == "" {
-		FailOnError(errors.New("you must specify a database directory (dataDir)"))
+	config, err := LoadConfiguration(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(EXIT_CONFIG_ERROR)
+	}
+	Context.Config = config
+	if err := InitializeLogging(config.Log, config.Privacy); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to initialize logging: "+err.Error())
+		os.Exit(EXIT_CONFIG_ERROR)
 	}
+	Context.ThisNodeAddress = config.Transport.GossipAddr
+	running, cancel := context.WithCancel(context.Background())
+	Context.Running = running
 
 	rand.Seed(time.Now().UTC().UnixNano()) // Initialize random seed
 	Context.PeerSet = make(map[string]int)
 	Context.StatusSubscriptions = make(map[string]func(*StatusPacket))
-	Context.PrivateKey, Context.PublicKey = LoadKeyPair(*dataDir)
-	Context.DisplayName = Context.PublicKey.DeriveName()
-	fmt.Println("INFO: the display name of this node is: " + Context.DisplayName)
+	Context.Interests = make(map[string]peerInterest)
+	Context.PeerClocks = make(map[string]map[string]uint32)
+	// The default identity (key.bin) comes first, followed by the additional identities
+	for _, label := range append([]string{""}, config.Identities...) {
+		id, err := LoadIdentity(config.DataDir, label)
+		FailOnError(err)
+		if label == "" {
+			LogMain.Infof("the display name of this node is: %s", Name(id.DisplayName))
+		} else {
+			LogMain.Infof("the display name of identity %s is: %s", label, Name(id.DisplayName))
+		}
+		Context.Identities = append(Context.Identities, id)
+	}
 
-	Context.Database = NewConnection(*dataDir)
-	Context.PowTarget = *powDifficulty
-	Context.InsertKeyAnnouncementMessage()
+	Context.Database, err = OpenStore(config.Storage.Backend, config.DataDir)
+	FailOnError(err)
+	FailOnError(Context.Database.AssignDefaultIdentity(Context.DefaultIdentity().DisplayName))
+	Context.Pow = config.Pow.Policy()
+	for _, id := range Context.Identities {
+		FailOnError(id.InsertKeyAnnouncementMessage())
+	}
 
-	// Check if all peer addresses are valid, and resolve them if they contain domain names
-	for _, peerAddress := range strings.Split(*peersParams, ",") {
-		if peerAddress != "" {
-			// Check if the address is valid and resolve its name
-			addr, err := CheckAndResolveAddress(peerAddress)
-			FailOnError(err)
-			Context.PeerSet[addr] = Manual
-		}
+	Context.Devices = NewDeviceRegistry()
+	FailOnError(Context.Devices.Rebuild())
+	Context.Aliases = NewAliasRegistry()
+	FailOnError(Context.Aliases.Rebuild())
+	Context.Profiles = NewProfileRegistry()
+	FailOnError(Context.Profiles.Rebuild())
+
+	// The search indexes contain decrypted content: they are only kept in memory, and rebuilt at every start
+	for _, id := range Context.Identities {
+		FailOnError(id.Channels.Load())
+		FailOnError(id.Edits.Rebuild())
+		FailOnError(id.Threads.Rebuild())
+		FailOnError(id.Search.Rebuild())
+		FailOnError(id.Contacts.Load())
+	}
+
+	// Peer addresses have already been validated and resolved
+	for _, peerAddress := range config.Peers {
+		Context.PeerSet[peerAddress] = Manual
 	}
 
 	// Create the event queue as a buffered channel of type Event
-	Context.EventQueue = make(chan func(), 10)
+	Context.EventQueue = make(chan func(), config.Gossip.EventQueueSize)
 
 	// Define the handler for messages from other peerSet
-	Context.GossipSocket = MakeServerUdpSocket(Context.ThisNodeAddress)
+	socket, err := MakeServerUdpSocket(Context.ThisNodeAddress)
+	FailOnError(err)
+	Context.GossipSocket = socket
 	peerHandler := NewRequestListener(Context.GossipSocket)
-	peerHandler.Handler = func(data []byte, sender string) {
-		if sender == Context.ThisNodeAddress {
-			// This should not happen
-			return
-		}
+	peerHandler.Handler = handleGossipPacket
+	// Start listening for peer messages in another thread
+	peerHandler.Start()
 
-		msg := &GossipPacket{}
-		err := Decode(data, msg)
-		if err != nil {
-			// Malformed request -> discard it
-			return
+	// If a HTTP UI port is given, define the handler for client requests
+	var webServer *http.Server
+	if config.Web.Port != 0 {
+		webServer, err = InitializeWebServer(config.Web)
+		FailOnError(err)
+	}
+
+	// Start anti-entropy routine
+	antiEntropyTicker := time.NewTicker(config.Gossip.AntiEntropyInterval.Duration)
+	go func() {
+		for _ = range antiEntropyTicker.C {
+			Context.EventQueue <- func() {
+				// Executed on the main thread
+				ReportError(LogGossip, "anti-entropy failed", Context.SendStatusMessage(Context.RandomPeer([]string{})))
+			}
 		}
+	}()
 
-		// If the gossiper has not been seen yet: add it to the set
-		if _, found := Context.PeerSet[sender]; !found {
-			Context.PeerSet[sender] = Learned
+	// Apply the retention policy periodically
+	pruningTicker := startPruning(config.Retention.PruneInterval.Duration)
+
+	// Start the workers that compute the proof-of-work of the messages sent by the clients (one per identity)
+	jobs := make([]*JobQueue, 0, len(Context.Identities))
+	for _, id := range Context.Identities {
+		FailOnError(id.Jobs.ResumeOutbox())
+		go id.Jobs.Run()
+		jobs = append(jobs, id.Jobs)
+	}
+
+	stopped := waitForShutdown(&shutdownTasks{cancel, webServer, peerHandler, antiEntropyTicker, pruningTicker, jobs})
+
+	// Main event loop
+	for {
+		select {
+		case eventHandler := <-Context.EventQueue:
+			// All events are handled in the main thread
+			eventHandler()
+		case err := <-stopped:
+			finalizeShutdown(err)
 		}
+	}
+}
+
+// handleGossipPacket handles a packet received from another peer. It is executed on the main thread.
+// The returned error is only used for reporting: a bad packet is simply discarded.
+func handleGossipPacket(data []byte, sender string) error {
+	if sender == Context.ThisNodeAddress {
+		// This should not happen
+		return nil
+	}
 
-		if msg.Rumor != nil {
-			// Received a rumor message from a peer
-			m := msg.Rumor
+	msg := &GossipPacket{}
+	err := Decode(data, msg)
+	if err != nil {
+		// Malformed request -> discard it
+		return nil
+	}
+
+	// If the gossiper has not been seen yet: add it to the set
+	if _, found := Context.PeerSet[sender]; !found {
+		Context.PeerSet[sender] = Learned
+	}
 
-			if m.ID == 0 {
-				fmt.Printf("RUMOR (key announcement) origin %s:%d from %s\n", m.Origin, m.ID, sender)
-			} else if m.Destination == "" {
-				fmt.Printf("RUMOR (public msg) origin %s:%d from %s\n", m.Origin, m.ID, sender)
+	if msg.Rumor != nil {
+		// Received a rumor message from a peer
+		m := msg.Rumor
+
+		if m.IsTombstone() {
+			LogGossip.Infof("RUMOR (tombstone) origin %s:%d from %s", Name(m.Origin), m.ID, Addr(sender))
+		} else if m.ID == 0 {
+			LogGossip.Infof("RUMOR (key announcement) origin %s:%d from %s", Name(m.Origin), m.ID, Addr(sender))
+		} else if m.Destination == "" {
+			LogGossip.Infof("RUMOR (public msg) origin %s:%d from %s", Name(m.Origin), m.ID, Addr(sender))
+		} else {
+			LogGossip.Infof("RUMOR (private msg) origin %s:%d from %s", Name(m.Origin), m.ID, Addr(sender))
+		}
+
+		redundant, err := Context.IsRedundant(m)
+		if err != nil {
+			return err
+		}
+		if !redundant {
+			err = Context.VerifyMessage(m)
+		}
+		if err != nil {
+			// The message failed the verification step
+			LogGossip.Warnf("dropped rumor message due to failed verification (%s)", err.Error())
+		} else {
+			// Valid (or already known) message
+			inserted := false
+			if redundant {
+				LogGossip.Debugf("rumor %s:%d not inserted (already seen or out of order)", Name(m.Origin), m.ID)
 			} else {
-				fmt.Printf("RUMOR (private msg) origin %s:%d from %s\n", m.Origin, m.ID, sender)
+				inserted, err = Context.TryInsertMessage(m, sender)
+				if IsFatal(err) {
+					return err
+				} else if err != nil {
+					LogGossip.Debugf("rumor %s:%d not inserted (%s)", Name(m.Origin), m.ID, err.Error())
+				}
 			}
 
-			err := Context.VerifyMessage(m)
-			if err != nil {
-				// The message failed the verification step
-				fmt.Printf("Dropped rumor message due to failed verification (%s)\n", err.Error())
-			} else {
-				// Valid message
-				inserted, _ := Context.TryInsertMessage(m, sender)
-				Context.SendStatusMessage(sender) // Send status message in order to acknowledge
+			// Send status message in order to acknowledge
+			if err := Context.SendStatusMessage(sender); err != nil {
+				return err
+			}
 
-				if inserted {
-					// This message has not been seen before
-					randomPeer := Context.RandomPeer([]string{sender})
-					if randomPeer != "" {
-						fmt.Printf("MONGERING with %s\n", randomPeer)
-						startRumormongering(m, randomPeer)
+			if inserted {
+				// This message has not been seen before
+				randomPeer := Context.RandomPeer([]string{sender})
+				if randomPeer != "" {
+					LogGossip.Debugf("MONGERING with %s", Addr(randomPeer))
+					if err := startRumormongering(m, randomPeer); err != nil {
+						return err
 					}
 				}
 			}
 		}
-		if msg.Status != nil {
-			// Received a status message from a peer
-			m := msg.Status
-			fmt.Printf("STATUS from %s", sender)
-			for _, s := range m.Want {
-				fmt.Printf(" %s:%d", s.Identifier, s.NextID)
-			}
-			fmt.Printf("\n")
-			if handler, found := Context.StatusSubscriptions[sender]; found {
-				// Some task is expecting a status message -> forward it
-				handler(m)
-			} else {
-				// No task is expecting the message -> treat it as an anti-entropy status packet
-				synchronizeMessages(m.Want, sender)
-			}
-		}
 	}
-	// Start listening for peer messages in another thread
-	peerHandler.Start()
+	if msg.Skip != nil {
+		// Received the notice of a message that this (light) node does not want
+		n := msg.Skip
+		LogGossip.Debugf("SKIP origin %s:%d from %s", Name(n.Origin), n.ID, Addr(sender))
+		inserted, err := Context.TryInsertPlaceholder(n, sender)
+		if IsFatal(err) {
+			return err
+		} else if err != nil {
+			LogGossip.Warnf("dropped skip notice %s:%d (%s)", Name(n.Origin), n.ID, err.Error())
+		} else if !inserted {
+			LogGossip.Debugf("skip notice %s:%d not inserted (already seen or out of order)", Name(n.Origin), n.ID)
+		}
 
-	// If a HTTP UI port is given, define the handler for client requests
-	if *uiPort != 0 {
-		InitializeWebServer(*uiPort)
+		// Send status message in order to acknowledge
+		if err := Context.SendStatusMessage(sender); err != nil {
+			return err
+		}
 	}
-
-	// Start anti-entropy routine
-	go func() {
-		antiEntropyTicker := time.NewTicker(1 * time.Second)
-		for _ = range antiEntropyTicker.C {
-			Context.EventQueue <- func() {
-				// Executed on the main thread
-				Context.SendStatusMessage(Context.RandomPeer([]string{}))
-			}
+	if msg.Status != nil {
+		// Received a status message from a peer
+		m := msg.Status
+		status := make([]string, 0, len(m.Want))
+		for _, s := range m.Want {
+			status = append(status, fmt.Sprintf("%s:%d", Name(s.Identifier), s.NextID))
+		}
+		LogGossip.Debugf("STATUS from %s %s", Addr(sender), strings.Join(status, " "))
+		Context.RecordInterest(sender, m.Interest)
+		Context.RecordPeerClock(sender, m.Want)
+		if handler, found := Context.StatusSubscriptions[sender]; found {
+			// Some task is expecting a status message -> forward it
+			handler(m)
+		} else {
+			// No task is expecting the message -> treat it as an anti-entropy status packet
+			return synchronizeMessages(m.Want, sender)
 		}
-	}()
-
-	// Main event loop
-	for eventHandler := range Context.EventQueue {
-		// All events are handled in the main thread
-		eventHandler()
 	}
+	return nil
 }
 
 // startRumormongering forwards a rumor message to a peer, and the process is optionally repeated
 // with another peer according to the coin flip result.
-func startRumormongering(msg *RumorMessage, destinationPeerAddress string) {
+func startRumormongering(msg *RumorMessage, destinationPeerAddress string) error {
 	if destinationPeerAddress == "" {
-		return
+		return nil
 	}
 
-	// Forward the rumor message to that peer and wait for a response (or a timeout)
-	fwdMessage := GossipPacket{Rumor: msg}
+	// Forward the rumor message to that peer (or a skip notice if the peer does not want it), and wait for a
+	// response (or a timeout)
+	fwdMessage := Context.rumorPacket(msg, destinationPeerAddress)
 
 	statusChannel := make(chan *StatusPacket)
 	Context.StatusSubscriptions[destinationPeerAddress] = func(statusMessage *StatusPacket) {
@@ -169,11 +273,14 @@ func startRumormongering(msg *RumorMessage, destinationPeerAddress string) {
 			}
 		}
 	}
-	Context.GossipSocket.Send(Encode(&fwdMessage), destinationPeerAddress)
+	if err := Context.SendPacket(fwdMessage, destinationPeerAddress); err != nil {
+		delete(Context.StatusSubscriptions, destinationPeerAddress)
+		return err
+	}
 
 	// Run listener in another thread
 	go func() {
-		timeoutTimer := time.After(1 * time.Second)
+		timeoutTimer := time.After(Context.Config.Gossip.RumorTimeout.Duration)
 		var statusMsg *StatusPacket
 		select { // Whichever comes first (timeout or status message)...
 		case msg := <-statusChannel:
@@ -188,45 +295,79 @@ func startRumormongering(msg *RumorMessage, destinationPeerAddress string) {
 			// Unsubscribe from status messages
 			delete(Context.StatusSubscriptions, destinationPeerAddress)
 
+			inSync := false
+			if statusMsg != nil {
+				var err error
+				inSync, err = Context.VectorClockEquals(statusMsg.Want)
+				if err != nil {
+					ReportError(LogGossip, "rumormongering failed", err)
+					return
+				}
+			}
+
 			// If a timeout occurs, or the vector clocks match
-			if statusMsg == nil || Context.VectorClockEquals(statusMsg.Want) {
+			if statusMsg == nil || inSync {
 				if statusMsg != nil {
-					fmt.Printf("IN SYNC WITH %s\n", destinationPeerAddress)
+					LogGossip.Debugf("IN SYNC WITH %s", Addr(destinationPeerAddress))
 				}
 
 				// Flip a coin
 				if rand.Intn(2) == 1 {
 					randomPeer := Context.RandomPeer([]string{destinationPeerAddress}) // Avoid selecting this peer again
 					if randomPeer != "" {
-						fmt.Printf("FLIPPED COIN sending rumor to %s\n", randomPeer)
-						startRumormongering(msg, randomPeer)
+						LogGossip.Debugf("FLIPPED COIN sending rumor to %s", Addr(randomPeer))
+						ReportError(LogGossip, "rumormongering failed", startRumormongering(msg, randomPeer))
 					}
 				}
 			} else {
 				// The two peers do not agree on the set of messages
-				synchronizeMessages(statusMsg.Want, destinationPeerAddress)
+				ReportError(LogGossip, "synchronization failed", synchronizeMessages(statusMsg.Want, destinationPeerAddress))
 			}
 		}
 	}()
+	return nil
 }
 
 // synchronizeMessages compares the vector clocks of this node and the given peer,
 // and starts a synchronization job if they differ.
-func synchronizeMessages(otherStatus []PeerStatus, destinationPeerAddress string) {
+func synchronizeMessages(otherStatus []PeerStatus, destinationPeerAddress string) error {
 	// If two peers do not agree on the set of messages -> begin exchange
-	otherSet, _ := Context.VectorClockDifference(otherStatus)
+	otherSet, thisSet, err := Context.VectorClockDifference(otherStatus)
+	if err != nil {
+		return err
+	}
+	if len(thisSet) > 0 && Context.interestOf(destinationPeerAddress) != nil {
+		// A light peer only supplies the messages of its filter (its vector clock also counts the messages it has
+		// dropped) -> ask a full peer for the others
+		if fullPeer := Context.randomFullPeer([]string{destinationPeerAddress}); fullPeer != "" {
+			LogGossip.Debugf("FETCHING from %s (behind light peer %s)", Addr(fullPeer), Addr(destinationPeerAddress))
+			if err := Context.SendStatusMessage(fullPeer); err != nil {
+				return err
+			}
+		}
+	}
 	inSync := true
 	for _, mismatch := range otherSet {
 		// The peer has not seen some messages that this node has seen -> send them in order
 		id := mismatch.NextID
 		inSync = false
-		rumor := Context.BuildRumorMessage(mismatch.Identifier, id)
-		outMsg := GossipPacket{Rumor: rumor}
-		fmt.Printf("MONGERING with %s\n", destinationPeerAddress)
-		Context.GossipSocket.Send(Encode(&outMsg), destinationPeerAddress)
+		outMsg, err := Context.BuildPacket(mismatch.Identifier, id, destinationPeerAddress)
+		if err == errMessagePruned {
+			// The peer must obtain this message from another node
+			LogGossip.Debugf("unable to send %s:%d to %s (pruned)", Name(mismatch.Identifier), id,
+				Addr(destinationPeerAddress))
+			continue
+		} else if err != nil {
+			return err
+		}
+		LogGossip.Debugf("MONGERING with %s", Addr(destinationPeerAddress))
+		if err := Context.SendPacket(outMsg, destinationPeerAddress); err != nil {
+			return err
+		}
 	}
 
 	if inSync {
-		fmt.Printf("IN SYNC WITH %s\n", destinationPeerAddress)
+		LogGossip.Debugf("IN SYNC WITH %s", Addr(destinationPeerAddress))
 	}
+	return nil
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Directory (in the data directory) containing the keys of the additional identities
+const IDENTITIES_DIR = "identities"
+
+// Valid labels of additional identities (used as directory names)
+var identityLabelPattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// HTTP header and cookie used by the clients to select the identity they act as (see handleAs)
+const IDENTITY_HEADER = "X-Identity"
+const IDENTITY_COOKIE = "identity"
+
+// LocalIdentity is an identity hosted by this gossiper. Every identity has its own keypair (and thus its own name
+// and sequence of message IDs), outbox and search index, whereas the message store, the peers and the device
+// registry are shared by all the identities of the gossiper.
+type LocalIdentity struct {
+	Label       string // Empty for the default identity (key.bin), otherwise the label given in the configuration
+	PrivateKey  PrivateKey
+	PublicKey   PublicKey
+	DisplayName string // Self-signing name of this identity, derived from the public key
+
+	Jobs     *JobQueue    // Messages composed by the client, waiting for their proof-of-work
+	Search   *SearchIndex // Full-text index of the messages readable by this identity (kept in memory only)
+	Contacts *ContactBook // Address book of this identity
+	Edits    *EditIndex   // Latest edits of the messages readable by this identity (kept in memory only)
+	Threads  *ThreadIndex // Replies and reactions readable by this identity (kept in memory only)
+	Channels *ChannelList // Channels to which this identity is subscribed
+
+	pendingReceipts map[string][]ReceiptRef // Delivery receipts waiting to be sent, by sender (nil if none)
+}
+
+// LoadIdentity loads (or generates) the keypair of an identity. The default identity (empty label) is stored in
+// dataDir/key.bin, and the other ones in dataDir/identities/LABEL/key.bin.
+func LoadIdentity(dataDir string, label string) (*LocalIdentity, error) {
+	keyDir := dataDir
+	if label != "" {
+		if !identityLabelPattern.MatchString(label) {
+			return nil, fmt.Errorf("invalid identity label \"%s\"", label)
+		}
+		keyDir = filepath.Join(dataDir, IDENTITIES_DIR, label)
+	}
+	privateKey, publicKey, err := LoadKeyPair(keyDir)
+	if err != nil {
+		return nil, err
+	}
+	id := &LocalIdentity{
+		Label:       label,
+		PrivateKey:  privateKey,
+		PublicKey:   publicKey,
+		DisplayName: publicKey.DeriveName(),
+	}
+	id.Jobs = NewJobQueue(id)
+	id.Search = NewSearchIndex(id)
+	id.Contacts = NewContactBook(id)
+	id.Edits = NewEditIndex(id)
+	id.Threads = NewThreadIndex(id)
+	id.Channels = NewChannelList(id)
+	return id, nil
+}
+
+// DefaultIdentity returns the identity stored in key.bin, which is used when a client does not select an identity.
+func (c *contextType) DefaultIdentity() *LocalIdentity {
+	return c.Identities[0]
+}
+
+// LookupIdentity returns the local identity with the given name or label, or nil if it is not hosted by this gossiper.
+func (c *contextType) LookupIdentity(ref string) *LocalIdentity {
+	for _, id := range c.Identities {
+		if id.DisplayName == ref || (id.Label != "" && id.Label == ref) {
+			return id
+		}
+	}
+	return nil
+}
+
+// LocalNames returns the names of the identities hosted by this gossiper.
+func (c *contextType) LocalNames() []string {
+	names := make([]string, 0, len(c.Identities))
+	for _, id := range c.Identities {
+		names = append(names, id.DisplayName)
+	}
+	return names
+}
+
+// GetMyNextID returns the next ID of this identity.
+func (id *LocalIdentity) GetMyNextID() (uint32, error) {
+	return Context.Database.NextID(id.DisplayName)
+}
+
+// AddNewMessage adds a new message of this identity (when received from a client) and returns its ID.
+// The destination of the draft can be left empty (in this case, it is treated as a public message).
+// If the given context is cancelled during the proof-of-work computation, the context error is returned
+// and the message is not inserted. The progress of the proof-of-work computation is reported to the
+// given callback (which can be nil). If the TTL of the draft is not zero, the message expires after TTL seconds.
+func (id *LocalIdentity) AddNewMessage(ctx context.Context, draft *OutgoingMessage,
+	progress PowProgressCallback) (uint32, error) {
+
+	var m *MessageRecord
+	var nextID uint32
+	var errPk error
+	// Run on main thread
+	Context.RunSync(func() {
+		nextID, errPk = id.GetMyNextID()
+		if errPk != nil {
+			return
+		}
+
+		m = &MessageRecord{}
+		m.Data.ID = nextID
+		m.Data.Origin = id.DisplayName
+		m.Data.Destination = draft.Destination
+		m.Data.TTL = draft.TTL
+		m.Data.Kind = draft.Kind
+		m.Data.Format = FORMAT_DIGEST // Its tombstone can be forwarded once it is pruned
+
+		if draft.Channel != "" {
+			// Message of a channel (encrypted with the key of the channel, if it has a password)
+			if m.Data.Channel, errPk = hex.DecodeString(draft.Channel); errPk != nil {
+				return
+			} else if draft.Destination != "" {
+				errPk = ErrChannelDestination
+				return
+			}
+			m.Data.Content, m.Data.Encoding, errPk = id.encryptChannelContent([]byte(draft.Content), m.Data.Channel)
+			if errPk != nil {
+				return
+			}
+		} else if draft.Destination == "" {
+			// Public message
+			m.Data.Content = []byte(draft.Content) // Unencrypted content (since it is public)
+		} else {
+			// Private message
+			m.Data.Content, m.Data.Encoding, errPk = id.encryptContent([]byte(draft.Content), draft.Destination,
+				draft.Kind)
+			if errPk != nil {
+				return
+			}
+		}
+
+		m.Data.Signature, errPk = id.PrivateKey.Sign(m.Data.Payload())
+		m.FromAddress = "localhost:" + strings.Split(Context.ThisNodeAddress, ":")[1]
+		m.DateSeen = time.Now().Format(time.RFC3339)
+	})
+	if errPk != nil {
+		return 0, errPk
+	}
+
+	// Compute proof-of-work nonce on the caller thread
+	Context.Pow.Declare(&m.Data)
+	if err := m.Data.ComputeNonce(ctx, int(m.Data.Difficulty), progress); err != nil {
+		return 0, err
+	}
+
+	var errInsert error
+	Context.RunSync(func() {
+		errInsert = Context.VerifyMessage(&m.Data)
+		if errInsert != nil {
+			// Something wrong has happened (our own message should always be valid)
+			errInsert = Fatal(errInsert)
+			return
+		}
+
+		// Drafts from the outbox are removed along with the insertion, so that they are never sent twice
+		if draft.LocalID != 0 {
+			errInsert = Context.Database.InsertSentMessage(m, draft.LocalID)
+		} else {
+			errInsert = Context.Database.InsertOrUpdateMessage(m)
+		}
+		if errInsert == nil {
+			Context.messageStored(m)
+		}
+	})
+	if errInsert != nil {
+		return 0, errInsert
+	}
+	return nextID, nil
+}
+
+// encryptContent encrypts the content of a private message, so that it can be read by the devices of the sender
+// and of the recipient. Text messages between two identities without linked devices use the legacy encoding,
+// which can be read by older versions.
+func (id *LocalIdentity) encryptContent(content []byte, destination string, kind uint32) ([]byte, uint32, error) {
+	pk, err := Context.GetPublicKeyOf(destination)
+	if err != nil {
+		// Public key not found (unknown node)
+		return nil, 0, err
+	}
+
+	mine := Context.Devices.NamesOf(id.Primary())
+	theirs := Context.Devices.NamesOf(Context.Devices.IdentityOf(destination))
+	if kind == KIND_TEXT && len(mine) == 1 && len(theirs) == 1 && mine[0] == id.DisplayName {
+		// The content is stored and encrypted twice, first with the public key of the sender (who should be able to
+		// see their own message), then with the public key of the recipient
+
+		encryptedMine, err := id.PublicKey.Encrypt(content)
+		if err != nil {
+			// Encryption error (message too long?)
+			return nil, 0, err
+		}
+
+		encryptedTheirs, err := pk.Encrypt(content)
+		if err != nil {
+			// Encryption error (message too long?)
+			return nil, 0, err
+		}
+
+		// Store the length of the first chunk (so as to identify the split point)
+		lenBin := make([]byte, 2)
+		binary.LittleEndian.PutUint16(lenBin, uint16(len(encryptedMine)))
+		encrypted := append(lenBin, encryptedMine...)
+		return append(encrypted, encryptedTheirs...), ENCODING_LEGACY, nil
+	}
+
+	recipients := map[string]PublicKey{destination: pk, id.DisplayName: id.PublicKey}
+	for _, name := range append(mine, theirs...) {
+		if _, found := recipients[name]; !found {
+			if devicePk, err := Context.GetPublicKeyOf(name); err == nil {
+				recipients[name] = devicePk
+			}
+		}
+	}
+	envelope, err := SealEnvelope(content, recipients)
+	return envelope, ENCODING_ENVELOPE, err
+}
+
+// errMalformedContent is returned when the content of a private message does not have the expected structure.
+var errMalformedContent = errors.New("malformed private message content")
+
+// DecryptContent decrypts the content of a private message sent or received by this identity.
+// With the legacy encoding, the content contains the length of the first chunk, the chunk encrypted for the sender,
+// and the chunk encrypted for the recipient. Otherwise, the content is an envelope (see SealEnvelope).
+func (id *LocalIdentity) DecryptContent(m *RumorMessage) ([]byte, error) {
+	if m.Encoding == ENCODING_ENVELOPE {
+		return OpenEnvelope(m.Content, id.DisplayName, id.PrivateKey)
+	} else if m.Encoding != ENCODING_LEGACY {
+		return nil, errMalformedContent
+	}
+	if len(m.Content) < 2 {
+		return nil, errMalformedContent
+	}
+	splitPoint := binary.LittleEndian.Uint16(m.Content[:2])
+	if int(splitPoint) >= len(m.Content) {
+		return nil, errMalformedContent
+	}
+	if m.Origin == id.DisplayName {
+		// The message has been sent by us
+		return id.PrivateKey.Decrypt(m.Content[2 : 2+splitPoint])
+	}
+	// The message has been sent by the other node
+	return id.PrivateKey.Decrypt(m.Content[2+splitPoint:])
+}
+
+// InsertKeyAnnouncementMessage adds a new message with the public key announcement of this identity
+func (id *LocalIdentity) InsertKeyAnnouncementMessage() error {
+	nextID, err := id.GetMyNextID()
+	if err != nil {
+		return err
+	}
+	if nextID == 0 {
+		m := &MessageRecord{}
+		m.Data.ID = nextID
+		m.Data.Origin = id.DisplayName
+		m.Data.Destination = ""                   // Public message
+		m.Data.Content = id.PublicKey.Serialize() // The content is our public key (serialized to bytes)
+		m.Data.Signature = make([]byte, 0)        // Not needed, since the name is self-signing
+		Context.Pow.Declare(&m.Data)
+		if err := m.Data.ComputeNonce(Context.Running, int(m.Data.Difficulty), nil); err != nil {
+			return err
+		}
+		m.FromAddress = "localhost:" + strings.Split(Context.ThisNodeAddress, ":")[1]
+		m.DateSeen = time.Now().Format(time.RFC3339)
+
+		return Context.Database.InsertOrUpdateMessage(m)
+	}
+	return nil
+}
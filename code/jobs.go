@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type JobState string
+
+// States of a send job
+const (
+	JobQueued    JobState = "queued"    // Waiting for the previous jobs to complete
+	JobSolving   JobState = "solving"   // The proof-of-work is being computed
+	JobRetrying  JobState = "retrying"  // The last attempt failed, and the job will be queued again (see Error)
+	JobFailed    JobState = "failed"    // The message could not be sent (see Error), until the client retries
+	JobDone      JobState = "done"      // The message has been inserted and is being spread
+	JobCancelled JobState = "cancelled" // Cancelled by the client
+)
+
+// Number of finished jobs kept in memory, so that clients can still query their status
+const MAX_FINISHED_JOBS = 100
+
+// Number of attempts before a job is marked as failed
+const OUTBOX_MAX_ATTEMPTS = 3
+
+// Delay before a job is queued again after a failed attempt
+const OUTBOX_RETRY_DELAY = 30 * time.Second
+
+// JobProgress is the JSON-friendly version of PowProgress.
+type JobProgress struct {
+	Tries          uint64
+	Rate           float64
+	ElapsedSeconds float64
+	ETASeconds     float64
+}
+
+// Job tracks a message composed by the client while its proof-of-work is computed.
+// Unfinished jobs are stored in the outbox (the job ID is the LocalID of the outbox entry).
+type Job struct {
+	ID          int64
+	State       JobState
+	Kind        uint32       // Kind of the message (see KIND_TEXT)
+	Destination string       // Empty for public messages
+	Channel     string       // ID of the channel of a public message (hexadecimal), empty for the main public room
+	Content     string       // Plaintext content
+	DateCreated string       // RFC3339
+	TTL         uint32       // Lifetime of the message in seconds (0 = no expiry)
+	Attempts    int          // Number of failed attempts
+	Progress    *JobProgress // Only set while solving
+	MessageID   uint32       // Sequence ID of the message (only meaningful when done)
+	Hash        string       // Hash of the message (only set when done)
+	Error       string       // Error of the last failed attempt
+
+	ctx       context.Context    // Context of the proof-of-work (only set while solving)
+	cancel    context.CancelFunc // Aborts the proof-of-work (only set while solving)
+	cancelled bool               // True if the client requested cancellation
+}
+
+// IsPending tells whether the job is still in the outbox.
+func (j *Job) IsPending() bool {
+	return j.State != JobDone && j.State != JobCancelled
+}
+
+func (q *JobQueue) toOutgoingMessage(j *Job) *OutgoingMessage {
+	state := j.State
+	if state == JobSolving {
+		// If the node is stopped, the proof-of-work starts over at the next start
+		state = JobQueued
+	}
+	return &OutgoingMessage{
+		LocalID:     j.ID,
+		Identity:    q.owner.DisplayName,
+		Destination: j.Destination,
+		Channel:     j.Channel,
+		Content:     j.Content,
+		DateCreated: j.DateCreated,
+		State:       string(state),
+		Attempts:    j.Attempts,
+		LastError:   j.Error,
+		TTL:         j.TTL,
+		Kind:        j.Kind,
+	}
+}
+
+// JobQueue runs the send jobs of a local identity one at a time, in submission order, so that the messages of
+// the identity get consecutive IDs. All the fields are accessed on the main thread.
+type JobQueue struct {
+	owner       *LocalIdentity
+	jobs        map[int64]*Job
+	order       []int64 // All the jobs, sorted by ID
+	wake        chan bool
+	stopped     chan bool
+	subscribers map[chan Job]bool
+}
+
+// ErrJobNotFound is returned when a job ID does not exist (or has been forgotten).
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrJobFinished is returned when trying to modify a job that has already finished.
+var ErrJobFinished = errors.New("job already finished")
+
+// ErrJobBusy is returned when trying to modify a job while its proof-of-work is being computed.
+var ErrJobBusy = errors.New("the proof-of-work of the job is being computed")
+
+// ErrJobNotEditable is returned when trying to edit a message that is not a text message (e.g. a receipt), whose
+// content is generated by the node.
+var ErrJobNotEditable = errors.New("only the text messages can be edited")
+
+// ErrUnknownDestination is returned when the destination of a private message is not a known node.
+var ErrUnknownDestination = errors.New("unknown destination (public key not found)")
+
+// ErrChannelDestination is returned when trying to give a destination to a message of a channel.
+var ErrChannelDestination = errors.New("the messages of a channel cannot be private")
+
+func NewJobQueue(owner *LocalIdentity) *JobQueue {
+	return &JobQueue{
+		owner:       owner,
+		jobs:        make(map[int64]*Job),
+		order:       make([]int64, 0),
+		wake:        make(chan bool, 1),
+		stopped:     make(chan bool),
+		subscribers: make(map[chan Job]bool),
+	}
+}
+
+// Submit stores a new message (destination, content, TTL and kind) in the outbox and queues the corresponding job.
+// It returns a snapshot of the job. Must be called on the main thread.
+func (q *JobQueue) Submit(m *OutgoingMessage) (Job, error) {
+	m.Identity = q.owner.DisplayName
+	m.DateCreated = time.Now().Format(time.RFC3339)
+	m.State = string(JobQueued)
+	if err := Context.Database.InsertOutgoingMessage(m); err != nil {
+		return Job{}, err
+	}
+	return *q.add(m), nil
+}
+
+// add creates a job from an outbox entry.
+func (q *JobQueue) add(m *OutgoingMessage) *Job {
+	job := &Job{
+		ID:          m.LocalID,
+		State:       JobState(m.State),
+		Kind:        m.Kind,
+		Destination: m.Destination,
+		Channel:     m.Channel,
+		Content:     m.Content,
+		DateCreated: m.DateCreated,
+		TTL:         m.TTL,
+		Attempts:    m.Attempts,
+		Error:       m.LastError,
+	}
+	q.jobs[job.ID] = job
+	q.order = append(q.order, job.ID)
+	q.notify(job)
+	if job.State == JobQueued {
+		q.wakeUp()
+	}
+	return job
+}
+
+// wakeUp signals the worker that a job has been queued (without blocking, if it has already been woken up).
+func (q *JobQueue) wakeUp() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// Get returns a snapshot of a job. Must be called on the main thread.
+func (q *JobQueue) Get(id int64) (Job, error) {
+	job, found := q.jobs[id]
+	if !found {
+		return Job{}, ErrJobNotFound
+	}
+	return *job, nil
+}
+
+// List returns a snapshot of the jobs, sorted by ID. If pendingOnly is true, only the jobs
+// in the outbox are returned. Must be called on the main thread.
+func (q *JobQueue) List(pendingOnly bool) []Job {
+	output := make([]Job, 0, len(q.order))
+	for _, id := range q.order {
+		if job := q.jobs[id]; !pendingOnly || job.IsPending() {
+			output = append(output, *job)
+		}
+	}
+	return output
+}
+
+// Cancel cancels a job that has not finished yet, and removes it from the outbox. Must be called on the main thread.
+func (q *JobQueue) Cancel(id int64) error {
+	job, found := q.jobs[id]
+	if !found {
+		return ErrJobNotFound
+	}
+	switch job.State {
+	case JobSolving:
+		// The worker marks the job as cancelled when the proof-of-work stops
+		job.cancelled = true
+		job.cancel()
+		return nil
+	case JobDone, JobCancelled:
+		return ErrJobFinished
+	default:
+		job.cancelled = true
+		return q.finish(job, JobCancelled)
+	}
+}
+
+// Edit changes the content and/or the destination of a text message whose job is not being processed. The
+// destination must be a known node. Must be called on the main thread.
+func (q *JobQueue) Edit(id int64, content string, destination string) error {
+	job, found := q.jobs[id]
+	if !found {
+		return ErrJobNotFound
+	} else if job.State == JobSolving {
+		return ErrJobBusy
+	} else if !job.IsPending() {
+		return ErrJobFinished
+	} else if job.Kind != KIND_TEXT {
+		return ErrJobNotEditable
+	} else if job.Channel != "" && destination != "" {
+		return ErrChannelDestination
+	}
+	if destination != "" {
+		if _, err := Context.GetPublicKeyOf(destination); err != nil {
+			return ErrUnknownDestination
+		}
+	}
+
+	updated := *job
+	updated.Content = content
+	updated.Destination = destination
+	if err := Context.Database.UpdateOutgoingMessage(q.toOutgoingMessage(&updated)); err != nil {
+		return err
+	}
+	*job = updated
+	q.notify(job)
+	return nil
+}
+
+// Retry queues a job again, immediately, resetting its number of failed attempts. Must be called on the main thread.
+func (q *JobQueue) Retry(id int64) error {
+	job, found := q.jobs[id]
+	if !found {
+		return ErrJobNotFound
+	} else if job.State == JobSolving || job.State == JobQueued {
+		return ErrJobBusy
+	} else if !job.IsPending() {
+		return ErrJobFinished
+	}
+
+	job.Attempts = 0
+	return q.requeue(job)
+}
+
+func (q *JobQueue) requeue(job *Job) error {
+	job.State = JobQueued
+	q.notify(job)
+	q.wakeUp()
+	return Context.Database.UpdateOutgoingMessage(q.toOutgoingMessage(job))
+}
+
+// Subscribe returns a channel that receives a snapshot of a job every time it changes.
+// Slow subscribers miss updates instead of blocking the node. Must be called on the main thread.
+func (q *JobQueue) Subscribe() chan Job {
+	ch := make(chan Job, 16)
+	q.subscribers[ch] = true
+	return ch
+}
+
+// Unsubscribe stops the updates sent to a channel returned by Subscribe. Must be called on the main thread.
+func (q *JobQueue) Unsubscribe(ch chan Job) {
+	delete(q.subscribers, ch)
+}
+
+func (q *JobQueue) notify(job *Job) {
+	for ch := range q.subscribers {
+		select {
+		case ch <- *job:
+		default:
+		}
+	}
+}
+
+// finish removes a job from the outbox (after it has been completed or cancelled),
+// and forgets the oldest finished jobs if there are too many.
+func (q *JobQueue) finish(job *Job, state JobState) error {
+	job.State = state
+	job.Progress = nil
+	q.notify(job)
+	err := Context.Database.DeleteOutgoingMessage(job.ID)
+
+	finished := 0
+	for _, id := range q.order {
+		if !q.jobs[id].IsPending() {
+			finished++
+		}
+	}
+	for i := 0; i < len(q.order) && finished > MAX_FINISHED_JOBS; {
+		if !q.jobs[q.order[i]].IsPending() {
+			delete(q.jobs, q.order[i])
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			finished--
+		} else {
+			i++
+		}
+	}
+	return err
+}
+
+// fail records a failed attempt. Recoverable errors are retried after a delay, up to OUTBOX_MAX_ATTEMPTS times.
+func (q *JobQueue) fail(job *Job, err error) error {
+	job.Attempts++
+	job.Error = err.Error()
+	job.Progress = nil
+	if job.Attempts < OUTBOX_MAX_ATTEMPTS && !IsFatal(err) {
+		job.State = JobRetrying
+		time.AfterFunc(OUTBOX_RETRY_DELAY, func() {
+			Context.EventQueue <- func() {
+				if job.State == JobRetrying {
+					ReportError(LogMain, "unable to update the outbox", q.requeue(job))
+				}
+			}
+		})
+	} else {
+		job.State = JobFailed
+	}
+	q.notify(job)
+	return Context.Database.UpdateOutgoingMessage(q.toOutgoingMessage(job))
+}
+
+// next returns the oldest queued job and marks it as solving, or nil if the queue is empty.
+func (q *JobQueue) next() *Job {
+	for _, id := range q.order {
+		job := q.jobs[id]
+		if job.State == JobQueued {
+			job.ctx, job.cancel = context.WithCancel(Context.Running)
+			job.State = JobSolving
+			job.Progress = &JobProgress{}
+			q.notify(job)
+			return job
+		}
+	}
+	return nil
+}
+
+// process computes the proof-of-work of a job and inserts the message. It runs on the worker goroutine.
+func (q *JobQueue) process(job *Job) {
+	progress := func(p PowProgress) {
+		logPowProgress(p)
+		Context.EventQueue <- func() {
+			if job.State == JobSolving {
+				job.Progress = &JobProgress{p.Tries, p.Rate, p.Elapsed.Seconds(), p.ETA.Seconds()}
+				q.notify(job)
+			}
+		}
+	}
+	// The content and the destination cannot be edited while solving, so they can be read on this thread
+	id, err := q.owner.AddNewMessage(job.ctx, q.toOutgoingMessage(job), progress)
+
+	Context.RunSync(func() {
+		job.cancel()
+		switch {
+		case err == nil:
+			job.MessageID = id
+			rumor, errBuild := Context.BuildRumorMessage(q.owner.DisplayName, id)
+			if errBuild == nil {
+				job.Hash = hex.EncodeToString(rumor.ComputeHash())
+			}
+			ReportError(LogMain, "unable to update the outbox", q.finish(job, JobDone))
+			ReportError(LogGossip, "unable to spread message", spreadNewMessage(q.owner.DisplayName, id))
+		case job.cancelled:
+			ReportError(LogMain, "unable to update the outbox", q.finish(job, JobCancelled))
+		case Context.Running.Err() != nil:
+			// Interrupted by the shutdown: the job is still queued in the outbox
+			job.State = JobQueued
+			job.Progress = nil
+		default:
+			ReportError(LogMain, fmt.Sprintf("send job #%d failed", job.ID), err)
+			ReportError(LogMain, "unable to update the outbox", q.fail(job, err))
+		}
+	})
+}
+
+// ResumeOutbox creates a job for each message of the identity left in the outbox when the node was last stopped.
+// Jobs that were waiting for a retry are queued immediately. Must be called on the main thread.
+func (q *JobQueue) ResumeOutbox() error {
+	outbox, err := Context.Database.GetOutgoingMessages()
+	if err != nil {
+		return err
+	}
+	for _, m := range outbox {
+		if m.Identity != q.owner.DisplayName {
+			continue
+		}
+		if m.State == string(JobRetrying) {
+			m.State = string(JobQueued)
+		}
+		q.add(m)
+		LogMain.Infof("resuming job #%d from the outbox (%s)", m.LocalID, m.State)
+	}
+	return nil
+}
+
+// Run processes the jobs until the node shuts down. It must be started on its own goroutine.
+func (q *JobQueue) Run() {
+	defer close(q.stopped)
+	for {
+		select {
+		case <-q.wake:
+		case <-Context.Running.Done():
+			return
+		}
+
+		for {
+			var job *Job
+			Context.RunSync(func() {
+				job = q.next()
+			})
+			if job == nil {
+				break
+			}
+			q.process(job)
+			if Context.Running.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Wait blocks until the worker has stopped (after the node has started shutting down).
+func (q *JobQueue) Wait() {
+	<-q.stopped
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	return levelNames[l]
+}
+
+// ParseLogLevel converts a level name (as found in the config file) to a LogLevel.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range levelNames {
+		if levelName == strings.ToLower(name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level \"%s\"", name)
+}
+
+// logSink is the shared destination of all component loggers.
+type logSink struct {
+	lock     sync.Mutex
+	output   io.Writer
+	minLevel LogLevel
+	json     bool
+	redact   bool
+	salt     []byte // Random salt for redacted values, so that they cannot be reversed by brute force
+}
+
+var sink = &logSink{output: os.Stdout, minLevel: LevelInfo}
+
+// Logger writes log entries on behalf of a subsystem (component).
+type Logger struct {
+	component string
+}
+
+// Per-component loggers
+var (
+	LogMain   = &Logger{"main"}
+	LogGossip = &Logger{"gossip"}
+	LogPow    = &Logger{"pow"}
+	LogDb     = &Logger{"db"}
+	LogWeb    = &Logger{"web"}
+	LogCrypto = &Logger{"crypto"}
+)
+
+// InitializeLogging configures the logging subsystem according to the given settings.
+func InitializeLogging(config LogConfig, privacy PrivacyConfig) error {
+	level, err := ParseLogLevel(config.Level)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer = os.Stdout
+	if config.File != "" {
+		file, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.output = output
+	sink.minLevel = level
+	sink.json = config.JSON
+	sink.redact = privacy.RedactLogs
+	sink.salt = salt
+	return nil
+}
+
+func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if level < sink.minLevel {
+		return
+	}
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+
+	if sink.json {
+		entry := struct {
+			Time      string `json:"time"`
+			Level     string `json:"level"`
+			Component string `json:"component"`
+			Message   string `json:"msg"`
+		}{now.Format(time.RFC3339Nano), level.String(), l.component, msg}
+		encoder := json.NewEncoder(sink.output)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(entry)
+	} else {
+		fmt.Fprintf(sink.output, "%s %-5s %-6s %s\n", now.Format("2006-01-02 15:04:05.000"),
+			strings.ToUpper(level.String()), l.component, msg)
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, format, args...)
+}
+
+// redacted returns a short, salted digest of a sensitive value. The same value always maps to
+// the same digest within a run, so that log entries can still be correlated.
+func redacted(kind string, value string) string {
+	hash := sha256.New()
+	hash.Write(sink.salt)
+	hash.Write([]byte(value))
+	return "<" + kind + ":" + hex.EncodeToString(hash.Sum(nil)[:4]) + ">"
+}
+
+// Addr marks a peer address as sensitive: it is hidden when the privacy mode is enabled.
+type Addr string
+
+func (a Addr) String() string {
+	if sink.redact && a != "" {
+		return redacted("addr", string(a))
+	}
+	return string(a)
+}
+
+// Name marks a node name as sensitive: it is hidden when the privacy mode is enabled.
+type Name string
+
+func (n Name) String() string {
+	if sink.redact && n != "" {
+		return redacted("name", string(n))
+	}
+	return string(n)
+}
+
+// Text marks message contents as sensitive: they are hidden when the privacy mode is enabled.
+type Text string
+
+func (t Text) String() string {
+	if sink.redact {
+		return fmt.Sprintf("<%d bytes>", len(t))
+	}
+	return string(t)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a pure-Go implementation of MessageStore, which keeps everything in memory.
+// It is meant for tests and simulations: its contents are lost when the node stops.
+type MemoryStore struct {
+	lock        sync.Mutex
+	messages    map[string]map[uint32]*memoryRecord // Origin -> ID -> message
+	nextIDs     map[string]uint32                   // Origin -> highest ID + 1
+	nextSeq     uint64                              // Insertion counter (mimics the row order of SQLite)
+	outbox      []*OutgoingMessage
+	nextLocalID int64
+	readMarks   map[string]map[string]uint32  // Identity -> origin -> next unread ID
+	contacts    map[string]map[string]Contact // Identity -> name -> contact
+	receipts    map[messageKey]Receipt
+	preferences map[string]Preferences        // Identity -> preferences
+	channels    map[string]map[string]Channel // Identity -> channel ID (hexadecimal) -> subscription
+}
+
+type memoryRecord struct {
+	MessageRecord
+	seq uint64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		messages:    make(map[string]map[uint32]*memoryRecord),
+		nextIDs:     make(map[string]uint32),
+		outbox:      make([]*OutgoingMessage, 0),
+		nextLocalID: 1,
+		readMarks:   make(map[string]map[string]uint32),
+		contacts:    make(map[string]map[string]Contact),
+		receipts:    make(map[messageKey]Receipt),
+		preferences: make(map[string]Preferences),
+		channels:    make(map[string]map[string]Channel),
+	}
+}
+
+// copyOf returns a copy of a stored record, so that callers cannot modify the store.
+func (r *memoryRecord) copyOf() *MessageRecord {
+	return cloneRecord(&r.MessageRecord)
+}
+
+// cloneRecord returns a deep copy of a record (the byte slices are copied too).
+func cloneRecord(m *MessageRecord) *MessageRecord {
+	c := *m
+	c.Data.Content = cloneBytes(m.Data.Content)
+	c.Data.Signature = cloneBytes(m.Data.Signature)
+	c.Data.Nonce = cloneBytes(m.Data.Nonce)
+	c.Data.Channel = cloneBytes(m.Data.Channel)
+	c.Data.Digest = cloneBytes(m.Data.Digest)
+	c.Hash = cloneBytes(m.Hash)
+	return &c
+}
+
+// cloneBytes returns a copy of a byte slice (nil if the slice is nil).
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(b)), b...)
+}
+
+// collect returns the records that satisfy a condition, in insertion order.
+// Must be called with the lock held.
+func (s *MemoryStore) collect(condition func(r *memoryRecord) bool) []*memoryRecord {
+	output := make([]*memoryRecord, 0)
+	for _, records := range s.messages {
+		for _, r := range records {
+			if condition(r) {
+				output = append(output, r)
+			}
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].seq < output[j].seq
+	})
+	return output
+}
+
+func copyRecords(records []*memoryRecord) []*MessageRecord {
+	output := make([]*MessageRecord, 0, len(records))
+	for _, r := range records {
+		output = append(output, r.copyOf())
+	}
+	return output
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) NextID(origin string) (uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.nextIDs[origin], nil
+}
+
+func (s *MemoryStore) VectorClock() ([]PeerStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := make([]PeerStatus, 0, len(s.nextIDs))
+	for origin, next := range s.nextIDs {
+		status = append(status, PeerStatus{origin, next})
+	}
+	return status, nil
+}
+
+func (s *MemoryStore) FirstPlaceholders() ([]PeerStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	first := make(map[string]uint32)
+	for origin, records := range s.messages {
+		for id, r := range records {
+			if current, found := first[origin]; r.Placeholder && (!found || id < current) {
+				first[origin] = id
+			}
+		}
+	}
+	status := make([]PeerStatus, 0, len(first))
+	for origin, id := range first {
+		status = append(status, PeerStatus{origin, id})
+	}
+	return status, nil
+}
+
+func (s *MemoryStore) NodeList() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	nodes := make([]string, 0, len(s.messages))
+	for origin := range s.messages {
+		nodes = append(nodes, origin)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+func (s *MemoryStore) InsertOrUpdateMessage(m *MessageRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.insertMessage(m)
+	return nil
+}
+
+func (s *MemoryStore) InsertSentMessage(m *MessageRecord, localID int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.insertMessage(m)
+	s.deleteOutgoingMessage(localID)
+	return nil
+}
+
+// insertMessage stores a message, replacing the message with the same (origin, ID) pair if any.
+// Must be called with the lock held.
+func (s *MemoryStore) insertMessage(m *MessageRecord) {
+	records, found := s.messages[m.Data.Origin]
+	if !found {
+		records = make(map[uint32]*memoryRecord)
+		s.messages[m.Data.Origin] = records
+	}
+	s.nextSeq++
+	records[m.Data.ID] = &memoryRecord{*cloneRecord(m), s.nextSeq}
+	if m.Data.ID+1 > s.nextIDs[m.Data.Origin] {
+		s.nextIDs[m.Data.Origin] = m.Data.ID + 1
+	}
+}
+
+func (s *MemoryStore) GetMessage(origin string, id uint32) (*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if r, found := s.messages[origin][id]; found {
+		return r.copyOf(), nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryStore) GetMessageByHash(hash []byte) (*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	matches := s.collect(func(r *memoryRecord) bool {
+		return bytes.Equal(r.MessageHash(), hash)
+	})
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return matches[0].copyOf(), nil
+}
+
+func (s *MemoryStore) GetAllMessagesTo(destination string) ([]*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyRecords(s.collect(func(r *memoryRecord) bool {
+		return !r.Pruned && r.Data.Destination == destination && len(r.Data.Channel) == 0
+	})), nil
+}
+
+func (s *MemoryStore) GetChannelMessages(channel []byte) ([]*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return copyRecords(s.collect(func(r *memoryRecord) bool {
+		return !r.Pruned && len(r.Data.Channel) > 0 && bytes.Equal(r.Data.Channel, channel)
+	})), nil
+}
+
+func (s *MemoryStore) ChannelList() ([]ChannelActivity, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	activities := make(map[string]*ChannelActivity)
+	channels := make([]ChannelActivity, 0)
+	for _, r := range s.collect(func(r *memoryRecord) bool { return !r.Pruned && len(r.Data.Channel) > 0 }) {
+		activity, found := activities[string(r.Data.Channel)]
+		if !found {
+			activity = &ChannelActivity{ID: cloneBytes(r.Data.Channel)}
+			activities[string(r.Data.Channel)] = activity
+		}
+		activity.Messages++
+		if r.DateSeen > activity.LastSeen {
+			activity.LastSeen = r.DateSeen
+		}
+	}
+	for _, activity := range activities {
+		channels = append(channels, *activity)
+	}
+	return channels, nil
+}
+
+func (s *MemoryStore) GetAllMessagesBetween(origin string, destination string) ([]*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	records := s.collect(func(r *memoryRecord) bool {
+		return !r.Pruned && ((r.Data.Origin == origin && r.Data.Destination == destination) ||
+			(r.Data.Origin == destination && r.Data.Destination == origin))
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].DateSeen < records[j].DateSeen
+	})
+	return copyRecords(records), nil
+}
+
+func (s *MemoryStore) GetAllMessages() ([]*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	records := s.collect(func(r *memoryRecord) bool { return true })
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Data.Origin == records[j].Data.Origin {
+			return records[i].Data.ID < records[j].Data.ID
+		}
+		return records[i].Data.Origin < records[j].Data.Origin
+	})
+	return copyRecords(records), nil
+}
+
+func (s *MemoryStore) GetAllMessagesOfKind(kind uint32) ([]*MessageRecord, error) {
+	all, _ := s.GetAllMessages()
+	output := make([]*MessageRecord, 0)
+	for _, m := range all {
+		if !m.Pruned && m.Data.Kind == kind {
+			output = append(output, m)
+		}
+	}
+	return output, nil
+}
+
+func (s *MemoryStore) GetPrunableMessages(filter PruneFilter) ([]*MessageRecord, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	records := s.collect(func(r *memoryRecord) bool {
+		return !r.Pruned && r.Data.ID > 0 && !isPermanentKind(r.Data.Kind) && filter.Matches(&r.MessageRecord)
+	})
+	sort.SliceStable(records, func(i, j int) bool {
+		// The dates have been validated by the filter
+		seenI, _ := time.Parse(time.RFC3339, records[i].DateSeen)
+		seenJ, _ := time.Parse(time.RFC3339, records[j].DateSeen)
+		if seenI.Equal(seenJ) {
+			return records[i].Data.ID < records[j].Data.ID
+		}
+		return seenI.Before(seenJ)
+	})
+	return copyRecords(records), nil
+}
+
+func (s *MemoryStore) PruneMessages(messages []*MessageRecord) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range messages {
+		r, found := s.messages[m.Data.Origin][m.Data.ID]
+		if !found || r.Pruned {
+			continue
+		}
+		r.Hash = r.MessageHash()
+		r.Pruned = true
+		r.Data = r.Data.Tombstone()
+	}
+	return nil
+}
+
+func (s *MemoryStore) StoredContentSize() (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	size := int64(0)
+	for _, r := range s.collect(func(r *memoryRecord) bool { return !r.Pruned }) {
+		size += int64(len(r.Data.Content))
+	}
+	return size, nil
+}
+
+func (s *MemoryStore) InsertOutgoingMessage(m *OutgoingMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	m.LocalID = s.nextLocalID
+	s.nextLocalID++
+	stored := *m
+	s.outbox = append(s.outbox, &stored)
+	return nil
+}
+
+func (s *MemoryStore) UpdateOutgoingMessage(m *OutgoingMessage) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, stored := range s.outbox {
+		if stored.LocalID == m.LocalID {
+			updated := *m
+			updated.DateCreated = stored.DateCreated
+			s.outbox[i] = &updated
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetOutgoingMessages() ([]*OutgoingMessage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	output := make([]*OutgoingMessage, 0, len(s.outbox))
+	for _, stored := range s.outbox {
+		m := *stored
+		output = append(output, &m)
+	}
+	return output, nil
+}
+
+func (s *MemoryStore) DeleteOutgoingMessage(localID int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deleteOutgoingMessage(localID)
+	return nil
+}
+
+// deleteOutgoingMessage removes a message from the outbox. Must be called with the lock held.
+func (s *MemoryStore) deleteOutgoingMessage(localID int64) {
+	for i, stored := range s.outbox {
+		if stored.LocalID == localID {
+			s.outbox = append(s.outbox[:i], s.outbox[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *MemoryStore) GetReadMarks(identity string) ([]PeerStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	marks := make([]PeerStatus, 0, len(s.readMarks[identity]))
+	for origin, next := range s.readMarks[identity] {
+		marks = append(marks, PeerStatus{origin, next})
+	}
+	sort.Slice(marks, func(i, j int) bool {
+		return marks[i].Identifier < marks[j].Identifier
+	})
+	return marks, nil
+}
+
+func (s *MemoryStore) RaiseReadMark(identity string, origin string, nextID uint32) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	marks, found := s.readMarks[identity]
+	if !found {
+		marks = make(map[string]uint32)
+		s.readMarks[identity] = marks
+	}
+	if current, found := marks[origin]; found && current >= nextID {
+		return false, nil
+	}
+	marks[origin] = nextID
+	return true, nil
+}
+
+func (s *MemoryStore) AssignDefaultIdentity(identity string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, m := range s.outbox {
+		if m.Identity == "" {
+			m.Identity = identity
+		}
+	}
+	if orphans, found := s.readMarks[""]; found {
+		if _, found := s.readMarks[identity]; !found {
+			s.readMarks[identity] = orphans
+		}
+		delete(s.readMarks, "")
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetContacts(identity string) ([]*Contact, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contacts := make([]*Contact, 0, len(s.contacts[identity]))
+	for _, c := range s.contacts[identity] {
+		copied := c
+		contacts = append(contacts, &copied)
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Name < contacts[j].Name
+	})
+	return contacts, nil
+}
+
+func (s *MemoryStore) PutContact(identity string, c *Contact) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, found := s.contacts[identity]; !found {
+		s.contacts[identity] = make(map[string]Contact)
+	}
+	s.contacts[identity][c.Name] = *c
+	return nil
+}
+
+func (s *MemoryStore) DeleteContact(identity string, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.contacts[identity], name)
+	return nil
+}
+
+func (s *MemoryStore) GetReceipt(origin string, id uint32) (Receipt, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.receipts[messageKey{origin, id}], nil
+}
+
+func (s *MemoryStore) RecordReceipt(origin string, id uint32, status string, date string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	receipt := s.receipts[messageKey{origin, id}]
+	if receipt.Delivered == "" {
+		receipt.Delivered = date
+	}
+	if status == RECEIPT_READ && receipt.Read == "" {
+		receipt.Read = date
+	}
+	s.receipts[messageKey{origin, id}] = receipt
+	return nil
+}
+
+func (s *MemoryStore) GetPreferences(identity string) (Preferences, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if p, found := s.preferences[identity]; found {
+		return p, nil
+	}
+	return DefaultPreferences(), nil
+}
+
+func (s *MemoryStore) PutPreferences(identity string, p *Preferences) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.preferences[identity] = *p
+	return nil
+}
+
+func (s *MemoryStore) GetChannels(identity string) ([]*Channel, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	channels := make([]*Channel, 0, len(s.channels[identity]))
+	for _, c := range s.channels[identity] {
+		copied := c
+		channels = append(channels, &copied)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels, nil
+}
+
+func (s *MemoryStore) PutChannel(identity string, c *Channel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, found := s.channels[identity]; !found {
+		s.channels[identity] = make(map[string]Channel)
+	}
+	s.channels[identity][hex.EncodeToString(c.ID)] = *c
+	return nil
+}
+
+func (s *MemoryStore) DeleteChannel(identity string, channelID []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.channels[identity], hex.EncodeToString(channelID))
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryStoreReturnsCopies(t *testing.T) {
+	store := NewMemoryStore()
+	m := &MessageRecord{Data: RumorMessage{Origin: "a", ID: 0, Content: []byte("content"),
+		Signature: []byte("signature"), Nonce: []byte("nonce"), Channel: []byte("channel")}}
+	if err := store.InsertOrUpdateMessage(m); err != nil {
+		t.Fatal(err)
+	}
+
+	// Modifying the inserted record does not modify the store
+	m.Data.Content[0] = 'X'
+	m.Data.Signature[0] = 'X'
+	stored, _ := store.GetMessage("a", 0)
+	if string(stored.Data.Content) != "content" || string(stored.Data.Signature) != "signature" {
+		t.Fatal("the store shares the byte slices of the inserted record")
+	}
+
+	// Modifying a returned record does not modify the store
+	stored.Data.Content[0] = 'Y'
+	stored.Data.Nonce[0] = 'Y'
+	stored.Data.Channel[0] = 'Y'
+	all, _ := store.GetAllMessages()
+	if len(all) != 1 || string(all[0].Data.Content) != "content" || string(all[0].Data.Nonce) != "nonce" ||
+		string(all[0].Data.Channel) != "channel" {
+		t.Fatal("the store shares the byte slices of the returned records")
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	store := NewMemoryStore()
+	m := &MessageRecord{Data: RumorMessage{Origin: "a", ID: 1, Content: []byte("content"),
+		Signature: []byte("signature"), Nonce: []byte("nonce"), Format: FORMAT_DIGEST, Difficulty: 1}}
+	hash := m.MessageHash()
+	store.InsertOrUpdateMessage(m)
+	if err := store.PruneMessages([]*MessageRecord{m}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := store.GetMessage("a", 1)
+	if !stored.Pruned || len(stored.Data.Content) != 0 || !stored.Forwardable() {
+		t.Fatal("the message has not been replaced with a forwardable tombstone")
+	}
+	if !bytes.Equal(stored.MessageHash(), hash) || !bytes.Equal(stored.Data.ComputeHash(), hash) {
+		t.Error("the tombstone does not have the hash of the message")
+	}
+	if size, _ := store.StoredContentSize(); size != 0 {
+		t.Errorf("the content of the tombstone is still counted (%d bytes)", size)
+	}
+	if next, _ := store.NextID("a"); next != 2 {
+		t.Errorf("unexpected next ID %d", next)
+	}
+}
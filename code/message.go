@@ -6,10 +6,8 @@ import (
 	"encoding/base32"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"github.com/dedis/protobuf"
 	"strings"
-	"time"
 )
 
 // Proof-of-work nonce length (in bytes)
@@ -22,6 +20,74 @@ type RumorMessage struct {
 	Content     []byte
 	Signature   []byte
 	Nonce       []byte
+	PowScheme   uint32 // Proof-of-work scheme (see pow.go). Zero for SHA-256, as in older versions
+	Difficulty  uint32 // Declared proof-of-work difficulty (leading zeros). Zero if undeclared (older versions)
+	TTL         uint32 // Retention hint in seconds: every node prunes the message this long after first seeing it
+	Kind        uint32 // Purpose of the message (see KIND_TEXT and the following constants)
+	Encoding    uint32 // Encoding of the encrypted content (see ENCODING_LEGACY and the following constants)
+	Channel     []byte // ID of the channel of a public message (see Channel), empty for the main public room
+	Format      uint32 // Representation of the content in the hash and the signature (see FORMAT_LEGACY)
+	Digest      []byte // SHA-256 hash of the content of a pruned message (see Tombstone), empty otherwise
+}
+
+// Kinds of messages. Text messages are displayed to the user; the other kinds are used by the nodes themselves.
+const (
+	KIND_TEXT          = 0  // Text message (public or private)
+	KIND_DEVICE_LINK   = 1  // The origin (primary identity) links the device whose name is the content
+	KIND_DEVICE_UNLINK = 2  // The origin (primary identity) revokes the device whose name is the content
+	KIND_DEVICE_CLAIM  = 3  // The origin (device) declares that it belongs to the identity whose name is the content
+	KIND_DEVICE_SYNC   = 4  // Private message from a device to the other devices of its identity (see DeviceSync)
+	KIND_ALIAS         = 5  // The origin registers the alias given in the content (see AliasRegistry)
+	KIND_PROFILE       = 6  // The origin publishes its profile (see Profile), which replaces its previous profiles
+	KIND_RECEIPT       = 7  // Private message acknowledging the delivery or the reading of messages (see ReceiptNotice)
+	KIND_EDIT          = 8  // New content of a text message of the origin, encrypted like the message (see Amendment)
+	KIND_DELETE        = 9  // Public message purging text messages of the origin and their edits (see Deletion)
+	KIND_REPLY         = 10 // Text message answering an earlier message (see Reply)
+	KIND_REACTION      = 11 // Reaction to an earlier message, encrypted like the message (see Reaction)
+)
+
+// Kinds of messages that are never pruned by the retention policy, since the state of the network depends on them
+var PERMANENT_KINDS = []uint32{KIND_DEVICE_LINK, KIND_DEVICE_UNLINK, KIND_DEVICE_CLAIM, KIND_ALIAS, KIND_PROFILE}
+
+func isPermanentKind(kind uint32) bool {
+	for _, permanent := range PERMANENT_KINDS {
+		if kind == permanent {
+			return true
+		}
+	}
+	return false
+}
+
+// Encodings of the content of private messages, and of the messages of encrypted channels
+const (
+	ENCODING_LEGACY   = 0 // Encrypted for the sender, then for the recipient (see DecryptContent); not encrypted if public
+	ENCODING_ENVELOPE = 1 // Encrypted for several devices (see SealEnvelope)
+	ENCODING_CHANNEL  = 2 // Message of an encrypted channel (see SealChannelContent)
+)
+
+// Representations of the content in the hash and in the signature of a message
+const (
+	FORMAT_LEGACY = 0 // The content itself (as in older versions)
+	FORMAT_DIGEST = 1 // The SHA-256 hash of the content, so that a pruned message can still be verified (see Tombstone)
+)
+
+// Tags of the fields added after the original protocol, in the hashed/signed representation of a message
+const (
+	EXT_POW_SCHEME = 1
+	EXT_DIFFICULTY = 2
+	EXT_TTL        = 3
+	EXT_KIND       = 4
+	EXT_ENCODING   = 5
+	EXT_CHANNEL    = 6
+	EXT_FORMAT     = 7
+)
+
+// extensionField is a field added after the original protocol.
+// Signed fields are part of the payload; the others (proof-of-work parameters) are only hashed.
+type extensionField struct {
+	tag    byte
+	value  []byte // Empty if the field is not set
+	signed bool
 }
 
 type PeerStatus struct {
@@ -30,25 +96,27 @@ type PeerStatus struct {
 }
 
 type StatusPacket struct {
-	Want []PeerStatus
+	Want     []PeerStatus
+	Interest *BloomFilter // Names whose private messages a light node wants to receive (nil for full nodes)
 }
 
 type GossipPacket struct {
 	Rumor  *RumorMessage
 	Status *StatusPacket
+	Skip   *SkipNotice // Sent instead of a rumor that does not match the interest of a light node
 }
 
 func Decode(data []byte, message interface{}) error {
 	return protobuf.Decode(data, message)
 }
 
-func Encode(message interface{}) []byte {
-	encoded, err := protobuf.Encode(message)
-	FailOnError(err)
-	return encoded
+func Encode(message interface{}) ([]byte, error) {
+	return protobuf.Encode(message)
 }
 
-func (m *RumorMessage) SanityCheck(powTarget int) error {
+// SanityCheck verifies the structure of the message and its proof-of-work nonce, according to the given policy.
+// The (possibly expensive) proof-of-work is verified last, once all the other checks have passed.
+func (m *RumorMessage) SanityCheck(policy *PowPolicy) error {
 	if len(m.Origin) != DISPLAY_NAME_BITS/5 {
 		return errors.New("invalid origin length")
 	}
@@ -74,14 +142,67 @@ func (m *RumorMessage) SanityCheck(powTarget int) error {
 		}
 	}
 
-	if NumLeadingZeros(m.ComputeHash()) < powTarget {
-		return errors.New("invalid nonce (not enough leading zeros)")
+	if len(m.Channel) != 0 && len(m.Channel) != CHANNEL_ID_LENGTH {
+		return errors.New("invalid channel length")
+	}
+
+	// Channels are public rooms
+	if len(m.Channel) != 0 && len(m.Destination) != 0 {
+		return errors.New("a private message cannot belong to a channel")
+	}
+
+	if m.Format > FORMAT_DIGEST {
+		return errors.New("unknown content format")
+	} else if m.Format == FORMAT_DIGEST && m.Difficulty == 0 {
+		return errors.New("the messages in the digest format must declare their difficulty")
 	}
+	if m.IsTombstone() && (m.Format != FORMAT_DIGEST || len(m.Digest) != sha256.Size || len(m.Content) != 0 ||
+		m.ID == 0) {
+		return errors.New("malformed tombstone")
+	}
+
+	return policy.Check(m)
+}
+
+// IsTombstone tells whether this message is the tombstone of a pruned message (see Tombstone).
+func (m *RumorMessage) IsTombstone() bool {
+	return len(m.Digest) > 0
+}
 
-	return nil
+// ContentDigest returns the SHA-256 hash of the content of this message (which is stored in the tombstones).
+func (m *RumorMessage) ContentDigest() []byte {
+	if m.IsTombstone() {
+		return m.Digest
+	}
+	digest := sha256.Sum256(m.Content)
+	return digest[:]
 }
 
-// ComputeHash returns the SHA-256 hash of this message (calculated on all fields)
+// signedContent returns the representation of the content in the hash and in the signature of this message.
+func (m *RumorMessage) signedContent() []byte {
+	if m.Format == FORMAT_DIGEST {
+		return m.ContentDigest()
+	}
+	return m.Content
+}
+
+// Tombstone returns the pruned version of this message, without its content. The tombstone of a message in the
+// digest format keeps the digest of the content, the signature and the nonce: it has the same hash as the message,
+// and can be verified and forwarded like the message itself, so that the IDs of the origin remain contiguous on
+// every node. Tombstones of messages in the legacy format only keep the header, and cannot be forwarded.
+func (m *RumorMessage) Tombstone() RumorMessage {
+	t := *m
+	t.Content = make([]byte, 0)
+	if m.Format == FORMAT_DIGEST {
+		t.Digest = m.ContentDigest()
+	} else {
+		t.Signature = make([]byte, 0)
+		t.Nonce = make([]byte, 0)
+	}
+	return t
+}
+
+// ComputeHash returns the SHA-256 hash of this message (calculated on all fields).
 func (m *RumorMessage) ComputeHash() []byte {
 	hash := sha256.New()
 	hash.Write([]byte(m.Origin))
@@ -89,14 +210,15 @@ func (m *RumorMessage) ComputeHash() []byte {
 	id := make([]byte, 4)
 	binary.LittleEndian.PutUint32(id, uint32(m.ID))
 	hash.Write(id)
-	hash.Write(m.Content)
+	hash.Write(m.signedContent())
 	hash.Write(m.Signature)
 	hash.Write(m.Nonce)
+	hash.Write(m.extensions(false))
 	return hash.Sum(nil)
 }
 
-// Payload returns the actual contents of this message (ID, origin, destination, message).
-// This method is typically used for signing the message.
+// Payload returns the actual contents of this message (ID, origin, destination, message or its digest (see Format),
+// and the signed extension fields). This method is typically used for signing the message.
 func (m *RumorMessage) Payload() []byte {
 	var b bytes.Buffer
 	b.Write([]byte(m.Origin))
@@ -104,35 +226,46 @@ func (m *RumorMessage) Payload() []byte {
 	id := make([]byte, 4)
 	binary.LittleEndian.PutUint32(id, uint32(m.ID))
 	b.Write(id)
-	b.Write(m.Content)
+	b.Write(m.signedContent())
+	b.Write(m.extensions(true))
 	return b.Bytes()
 }
 
-// ComputeNonce computes the proof-of-work nonce for this message, according to the given target (number of leading zeros).
-// The process may require a long time, since the nonce is bruteforced.
-func (m *RumorMessage) ComputeNonce(target int) {
-	// The initial nonce is "all zeros"
-	m.Nonce = make([]byte, NONCE_LENGTH)
+// encodeUint32 returns the little-endian representation of an extension value, or nil if it is zero.
+func encodeUint32(value uint32) []byte {
+	if value == 0 {
+		return nil
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, value)
+	return b
+}
 
-	fmt.Printf("INFO: starting a nonce computation with %d leading zeros...\n", target)
-	t1 := time.Now()
-	tries := uint64(0)
-	for {
-		tries++
-		if NumLeadingZeros(m.ComputeHash()) >= target {
-			break
-		}
+func (m *RumorMessage) extensionFields() []extensionField {
+	return []extensionField{
+		{EXT_POW_SCHEME, encodeUint32(m.PowScheme), false},
+		{EXT_DIFFICULTY, encodeUint32(m.Difficulty), false},
+		{EXT_TTL, encodeUint32(m.TTL), true},
+		{EXT_KIND, encodeUint32(m.Kind), true},
+		{EXT_ENCODING, encodeUint32(m.Encoding), true},
+		{EXT_CHANNEL, m.Channel, true},
+		{EXT_FORMAT, encodeUint32(m.Format), true},
+	}
+}
 
-		// Increment the nonce by 1
-		for i := 0; i < NONCE_LENGTH; i++ {
-			if m.Nonce[i] < 255 {
-				m.Nonce[i]++
-				break
-			} else {
-				m.Nonce[i] = 0
-			}
+// extensions returns the representation of the fields added after the original protocol (only the signed ones,
+// if signedOnly is true). Each field is written with its tag and length, and only if it is set, so that the
+// messages that do not use these fields keep the same hash and signature as in older versions.
+func (m *RumorMessage) extensions(signedOnly bool) []byte {
+	var b bytes.Buffer
+	for _, field := range m.extensionFields() {
+		if len(field.value) > 0 && (field.signed || !signedOnly) {
+			length := make([]byte, 2)
+			binary.LittleEndian.PutUint16(length, uint16(len(field.value)))
+			b.WriteByte(field.tag)
+			b.Write(length)
+			b.Write(field.value)
 		}
 	}
-	t2 := time.Now()
-	fmt.Printf("INFO: nonce computed in %.2f seconds (%d tries)\n", t2.Sub(t1).Seconds(), tries)
+	return b.Bytes()
 }
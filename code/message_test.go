@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// testPolicy requires little proof-of-work, so that the tests run quickly.
+var testPolicy = &PowPolicy{Difficulty: map[uint32]int{0: 4}, Minimum: map[uint32]int{0: 4}}
+
+// testMessage returns a signed text message with a valid nonce.
+func testMessage(t *testing.T, sk PrivateKey, pk PublicKey, id uint32, content string, format uint32) *RumorMessage {
+	t.Helper()
+	m := &RumorMessage{Origin: pk.DeriveName(), ID: id, Content: []byte(content), Kind: KIND_TEXT, Format: format}
+	testPolicy.Declare(m)
+	signature, err := sk.Sign(m.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Signature = signature
+	if err := m.ComputeNonce(context.Background(), int(m.Difficulty), nil); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDigestTombstoneCanBeVerified(t *testing.T) {
+	sk, pk := testKeyPair(t)
+	m := testMessage(t, sk, pk, 1, "some content", FORMAT_DIGEST)
+	if err := m.SanityCheck(testPolicy); err != nil {
+		t.Fatal(err)
+	}
+
+	tombstone := m.Tombstone()
+	if !tombstone.IsTombstone() || len(tombstone.Content) != 0 {
+		t.Fatal("the tombstone still has its content")
+	}
+	if !bytes.Equal(tombstone.ComputeHash(), m.ComputeHash()) {
+		t.Error("the tombstone does not have the hash of the message")
+	}
+	if !pk.Verify(tombstone.Payload(), tombstone.Signature) {
+		t.Error("the signature of the tombstone cannot be verified")
+	}
+	if err := tombstone.SanityCheck(testPolicy); err != nil {
+		t.Errorf("the tombstone does not pass the sanity check: %s", err.Error())
+	}
+	if len(m.Content) == 0 || m.IsTombstone() {
+		t.Error("the message has been modified")
+	}
+
+	record := &MessageRecord{Data: tombstone, Pruned: true, Hash: m.ComputeHash()}
+	if !record.Forwardable() {
+		t.Error("the tombstone is not forwardable")
+	}
+	record.Placeholder = true
+	if record.Forwardable() {
+		t.Error("a placeholder is forwardable")
+	}
+}
+
+func TestDigestTombstoneTampering(t *testing.T) {
+	sk, pk := testKeyPair(t)
+	m := testMessage(t, sk, pk, 1, "some content", FORMAT_DIGEST)
+	tombstone := m.Tombstone()
+	tombstone.Digest = append([]byte(nil), tombstone.Digest...)
+	tombstone.Digest[0] ^= 1
+	if pk.Verify(tombstone.Payload(), tombstone.Signature) {
+		t.Error("a tombstone with another digest has a valid signature")
+	}
+	if bytes.Equal(tombstone.ComputeHash(), m.ComputeHash()) {
+		t.Error("a tombstone with another digest has the hash of the message")
+	}
+}
+
+func TestLegacyTombstoneIsNotForwardable(t *testing.T) {
+	sk, pk := testKeyPair(t)
+	m := testMessage(t, sk, pk, 1, "some content", FORMAT_LEGACY)
+	if err := m.SanityCheck(testPolicy); err != nil {
+		t.Fatal(err)
+	}
+	tombstone := m.Tombstone()
+	if tombstone.IsTombstone() || len(tombstone.Signature) != 0 || len(tombstone.Nonce) != 0 {
+		t.Error("the tombstone of a legacy message keeps more than its header")
+	}
+	record := &MessageRecord{Data: tombstone, Pruned: true, Hash: m.ComputeHash()}
+	if record.Forwardable() {
+		t.Error("the tombstone of a legacy message is forwardable")
+	}
+	if !bytes.Equal(record.MessageHash(), m.ComputeHash()) {
+		t.Error("the tombstone does not keep the hash of the message")
+	}
+}
+
+func TestMalformedTombstones(t *testing.T) {
+	sk, pk := testKeyPair(t)
+	m := testMessage(t, sk, pk, 1, "some content", FORMAT_DIGEST)
+	cases := map[string]func(m *RumorMessage){
+		"content":        func(m *RumorMessage) { m.Content = []byte("content") },
+		"legacy format":  func(m *RumorMessage) { m.Format = FORMAT_LEGACY },
+		"short digest":   func(m *RumorMessage) { m.Digest = m.Digest[:31] },
+		"announcement":   func(m *RumorMessage) { m.ID = 0 },
+		"unknown format": func(m *RumorMessage) { m.Format = FORMAT_DIGEST + 1 },
+		"no difficulty":  func(m *RumorMessage) { m.Difficulty = 0 },
+	}
+	for name, tamper := range cases {
+		tombstone := m.Tombstone()
+		tamper(&tombstone)
+		if err := tombstone.SanityCheck(testPolicy); err == nil {
+			t.Errorf("%s: the tombstone passes the sanity check", name)
+		}
+	}
+}
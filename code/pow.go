@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"math"
+	"math/bits"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between two progress reports of a proof-of-work computation
+const POW_PROGRESS_INTERVAL = 500 * time.Millisecond
+
+// Proof-of-work schemes (stored in the PowScheme field of rumors)
+const (
+	POW_SHA256   = 0 // Leading zeros of the SHA-256 hash of the message
+	POW_ARGON2ID = 1 // Leading zeros of the Argon2id digest of the SHA-256 hash (memory-hard)
+)
+
+// Fixed Argon2id parameters. They are part of the scheme (not of the message),
+// so that the cost of verifying a rumor cannot be chosen by its sender.
+const (
+	ARGON2_TIME    = 1
+	ARGON2_MEMORY  = 16 * 1024 // In KiB
+	ARGON2_THREADS = 1
+)
+
+// Salt of the Argon2id digests (the hash of the message is already unique)
+var ARGON2_SALT = []byte("anonpeerster-pow")
+
+// PowScheme describes how the proof-of-work of a message is computed.
+type PowScheme struct {
+	Name      string
+	BatchSize uint64 // Number of tries after which a worker publishes its counter and checks for cancellation
+	Hash      func(m *RumorMessage) []byte
+}
+
+var powSchemes = map[uint32]PowScheme{
+	POW_SHA256: {"sha256", 1024, func(m *RumorMessage) []byte {
+		return m.ComputeHash()
+	}},
+	POW_ARGON2ID: {"argon2id", 1, func(m *RumorMessage) []byte {
+		return argon2.IDKey(m.ComputeHash(), ARGON2_SALT, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, 32)
+	}},
+}
+
+// ParsePowScheme returns the identifier of the proof-of-work scheme with the given name.
+func ParsePowScheme(name string) (uint32, error) {
+	for id, scheme := range powSchemes {
+		if scheme.Name == strings.ToLower(name) {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown proof-of-work scheme \"%s\"", name)
+}
+
+// PowProgress describes the state of a running proof-of-work computation.
+type PowProgress struct {
+	Target  int           // Number of leading zeros required
+	Workers int           // Number of parallel workers
+	Tries   uint64        // Number of hashes computed so far
+	Rate    float64       // Hashes per second
+	Elapsed time.Duration // Time since the start of the computation
+	ETA     time.Duration // Estimated remaining time, based on the expected number of tries (2^target)
+	Done    bool          // True in the last report, when a valid nonce has been found
+}
+
+// PowProgressCallback receives periodic progress reports. It is called from a separate goroutine.
+type PowProgressCallback func(progress PowProgress)
+
+func newPowProgress(target int, workers int, tries uint64, elapsed time.Duration) PowProgress {
+	p := PowProgress{Target: target, Workers: workers, Tries: tries, Elapsed: elapsed}
+	if elapsed > 0 {
+		p.Rate = float64(tries) / elapsed.Seconds()
+	}
+	expected := math.Pow(2, float64(target))
+	if p.Rate > 0 && float64(tries) < expected {
+		p.ETA = time.Duration((expected - float64(tries)) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+// PowPolicy defines the proof-of-work declared in the messages of this node, and the proof-of-work required
+// from the messages of other nodes. The required difficulty grows with the size of the content (one more leading
+// zero, i.e. twice the work, each time the content size doubles beyond SizeUnit), and key announcements
+// and alias registrations can require some extra leading zeros.
+type PowPolicy struct {
+	Scheme            uint32         // Scheme of the messages of this node
+	Difficulty        map[uint32]int // Base difficulty of the messages of this node, for each scheme
+	Minimum           map[uint32]int // Minimum base difficulty accepted from other nodes, for each accepted scheme
+	SizeUnit          int            // Content size (in bytes) covered by the base difficulty (0 = no size surcharge)
+	AnnouncementExtra int            // Additional leading zeros required for key announcements
+	AliasExtra        int            // Additional leading zeros required for alias registrations
+}
+
+// surcharge returns the number of leading zeros that a message requires on top of the base difficulty.
+func (p *PowPolicy) surcharge(m *RumorMessage) int {
+	extra := 0
+	if p.SizeUnit > 0 && len(m.Content) > p.SizeUnit {
+		units := (len(m.Content) + p.SizeUnit - 1) / p.SizeUnit
+		extra += bits.Len(uint(units - 1)) // ceil(log2(units))
+	}
+	if m.ID == 0 {
+		extra += p.AnnouncementExtra
+	}
+	if m.Kind == KIND_ALIAS {
+		extra += p.AliasExtra
+	}
+	return extra
+}
+
+// Declare sets the proof-of-work scheme and difficulty of a message of this node.
+// The content and ID of the message must have been set already.
+func (p *PowPolicy) Declare(m *RumorMessage) {
+	m.PowScheme = p.Scheme
+	m.Difficulty = uint32(p.Difficulty[p.Scheme] + p.surcharge(m))
+}
+
+// Check verifies that the proof-of-work of a message satisfies its declared difficulty, and that the declared
+// difficulty is acceptable for this node. Messages without a declared difficulty (sent by older versions) must meet
+// the base minimum plus the surcharges, so that omitting the declaration does not reduce the required work.
+func (p *PowPolicy) Check(m *RumorMessage) error {
+	scheme, found := powSchemes[m.PowScheme]
+	if !found {
+		return fmt.Errorf("unknown proof-of-work scheme %d", m.PowScheme)
+	}
+	minimum, accepted := p.Minimum[m.PowScheme]
+	if !accepted {
+		return fmt.Errorf("proof-of-work scheme %s not accepted", scheme.Name)
+	}
+
+	required := minimum + p.surcharge(m)
+	target := required
+	if m.Difficulty != 0 {
+		if int(m.Difficulty) < required {
+			return fmt.Errorf("declared difficulty too low (%d leading zeros, %d required)", m.Difficulty, required)
+		}
+		target = int(m.Difficulty)
+	}
+	if NumLeadingZeros(scheme.Hash(m)) < target {
+		return errors.New("invalid nonce (not enough leading zeros)")
+	}
+	return nil
+}
+
+// ComputeNonce computes the proof-of-work nonce for this message, according to its scheme and to the given
+// target (number of leading zeros). The nonce space is split across GOMAXPROCS workers: the first 8 bytes of the nonce are a counter,
+// and the last 8 bytes identify the worker. If the context is cancelled before a valid nonce is found,
+// the computation is aborted and the context error is returned. The progress callback can be nil.
+func (m *RumorMessage) ComputeNonce(ctx context.Context, target int, progress PowProgressCallback) error {
+	scheme, known := powSchemes[m.PowScheme]
+	if !known {
+		return fmt.Errorf("unknown proof-of-work scheme %d", m.PowScheme)
+	}
+	workers := runtime.GOMAXPROCS(0)
+	LogPow.Infof("starting a nonce computation with %d leading zeros (%s, %d workers)...", target, scheme.Name,
+		workers)
+
+	solveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var tries uint64
+	var found sync.Once
+	var nonce []byte
+	var wg sync.WaitGroup
+	t1 := time.Now()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker uint64) {
+			defer wg.Done()
+
+			// Each worker operates on its own copy of the message (only the nonce is modified)
+			candidate := *m
+			candidate.Nonce = make([]byte, NONCE_LENGTH)
+			binary.LittleEndian.PutUint64(candidate.Nonce[8:], worker)
+
+			for counter := uint64(0); ; counter++ {
+				binary.LittleEndian.PutUint64(candidate.Nonce[:8], counter)
+				if NumLeadingZeros(scheme.Hash(&candidate)) >= target {
+					atomic.AddUint64(&tries, counter%scheme.BatchSize+1)
+					found.Do(func() {
+						nonce = candidate.Nonce
+						stop()
+					})
+					return
+				}
+				if counter%scheme.BatchSize == scheme.BatchSize-1 {
+					atomic.AddUint64(&tries, scheme.BatchSize)
+					if solveCtx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(uint64(w))
+	}
+
+	finished := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	ticker := time.NewTicker(POW_PROGRESS_INTERVAL)
+	defer ticker.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-ticker.C:
+			if progress != nil {
+				progress(newPowProgress(target, workers, atomic.LoadUint64(&tries), time.Since(t1)))
+			}
+		case <-finished:
+			waiting = false
+		}
+	}
+
+	elapsed := time.Since(t1)
+	totalTries := atomic.LoadUint64(&tries)
+	if nonce == nil {
+		LogPow.Infof("nonce computation cancelled after %d tries", totalTries)
+		return ctx.Err()
+	}
+
+	m.Nonce = nonce
+	LogPow.Infof("nonce computed in %.2f seconds (%d tries, %.0f tries/s)", elapsed.Seconds(), totalTries,
+		float64(totalTries)/elapsed.Seconds())
+	if progress != nil {
+		final := newPowProgress(target, workers, totalTries, elapsed)
+		final.Done = true
+		progress(final)
+	}
+	return nil
+}
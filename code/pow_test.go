@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPowPolicyDeclare(t *testing.T) {
+	policy := &PowPolicy{Difficulty: map[uint32]int{0: 4}, Minimum: map[uint32]int{0: 4}, SizeUnit: 100,
+		AnnouncementExtra: 2}
+	cases := []struct {
+		id         uint32
+		size       int
+		difficulty uint32
+	}{
+		{1, 0, 4},
+		{1, 100, 4},
+		{1, 101, 5},
+		{1, 400, 6},
+		{1, 401, 7},
+		{0, 10, 6},
+	}
+	for _, c := range cases {
+		m := &RumorMessage{ID: c.id, Content: make([]byte, c.size)}
+		policy.Declare(m)
+		if m.Difficulty != c.difficulty {
+			t.Errorf("message %d of %d bytes: declared difficulty %d, expected %d", c.id, c.size, m.Difficulty,
+				c.difficulty)
+		}
+	}
+}
+
+func TestPowPolicyCheck(t *testing.T) {
+	policy := &PowPolicy{Difficulty: map[uint32]int{0: 4}, Minimum: map[uint32]int{0: 4}, SizeUnit: 10}
+	m := &RumorMessage{Origin: "origin", ID: 1, Content: []byte("content")}
+	policy.Declare(m)
+	if err := m.ComputeNonce(context.Background(), int(m.Difficulty), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Check(m); err != nil {
+		t.Fatalf("a valid message has been rejected: %s", err.Error())
+	}
+
+	low := *m
+	low.Difficulty = 3
+	if err := policy.Check(&low); err == nil {
+		t.Error("a message that declares a difficulty below the minimum has been accepted")
+	}
+
+	// The surcharge of a large content is required from the declared difficulty
+	large := *m
+	large.Content = make([]byte, 40)
+	if err := policy.Check(&large); err == nil {
+		t.Error("a message that does not declare the surcharge of its content has been accepted")
+	}
+
+	unknown := *m
+	unknown.PowScheme = 255
+	if err := policy.Check(&unknown); err == nil {
+		t.Error("a message with an unknown scheme has been accepted")
+	}
+
+	// Find a nonce that does not satisfy the declared difficulty
+	invalid := *m
+	invalid.Nonce = make([]byte, NONCE_LENGTH)
+	for NumLeadingZeros(powSchemes[0].Hash(&invalid)) >= int(invalid.Difficulty) {
+		invalid.Nonce[0]++
+	}
+	if err := policy.Check(&invalid); err == nil {
+		t.Error("a message with an invalid nonce has been accepted")
+	}
+}
+
+func TestPowPolicyUndeclaredDifficulty(t *testing.T) {
+	policy := &PowPolicy{Difficulty: map[uint32]int{0: 4}, Minimum: map[uint32]int{0: 4}, SizeUnit: 10}
+
+	// A message of older versions (without a declared difficulty) whose nonce only meets the base minimum, whereas
+	// its content requires 2 more leading zeros
+	m := &RumorMessage{Origin: "origin", ID: 1, Content: make([]byte, 40)}
+	for {
+		if err := m.ComputeNonce(context.Background(), 4, nil); err != nil {
+			t.Fatal(err)
+		}
+		if NumLeadingZeros(powSchemes[0].Hash(m)) < 6 {
+			break
+		}
+		m.Content[0]++
+	}
+	if err := policy.Check(m); err == nil {
+		t.Error("a message without a declared difficulty has been accepted without the surcharge of its content")
+	}
+
+	if err := m.ComputeNonce(context.Background(), 6, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Check(m); err != nil {
+		t.Errorf("a message without a declared difficulty has been rejected: %s", err.Error())
+	}
+}
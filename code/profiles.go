@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Maximum length of the nickname of a profile, in characters
+const MAX_NICKNAME_LENGTH = 64
+
+// Maximum length of the status line of a profile, in characters
+const MAX_STATUS_LENGTH = 140
+
+// Maximum size of the avatar of a profile, in bytes (the whole profile is gossiped with every update)
+const MAX_AVATAR_SIZE = 16 * 1024
+
+// Image formats accepted for avatars
+var AVATAR_TYPES = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// Profile is the content of the KIND_PROFILE messages (encoded in JSON), which describe the node that signed them.
+type Profile struct {
+	Nickname string
+	Status   string
+	Avatar   []byte // PNG, JPEG, GIF or WebP image (can be empty)
+	Updated  string // RFC3339 date on which the profile was published
+}
+
+// profileRecord is the latest profile of a node.
+type profileRecord struct {
+	ID      uint32 // ID of the profile message, which is its version
+	Profile Profile
+	Seen    string
+}
+
+// ProfileRegistry keeps track of the latest profile published by every node.
+//
+// Profiles are public messages, signed by their origin like any other message. The ID of the message is the version
+// of the profile: a profile replaces all the profiles previously published by the same node, which are then pruned
+// (replaced with tombstones) so that only the latest profile of every node is stored. Profiles are not pruned by the
+// retention policy. The registry must only be used from the main thread.
+type ProfileRegistry struct {
+	profiles map[string]profileRecord // Origin -> latest profile
+}
+
+// ProfileInfo describes the profile of a node (for the client). The avatar is served separately.
+type ProfileInfo struct {
+	Name     string // Node that has published the profile
+	Identity string // Identity of the node
+	Nickname string
+	Status   string
+	Avatar   string // URL of the avatar (empty if the profile has no avatar)
+	Version  uint32 // ID of the profile message
+	Updated  string // Date on which the profile was published (as declared by the node)
+	Seen     string // Date on which the profile was first seen by this node
+}
+
+func NewProfileRegistry() *ProfileRegistry {
+	return &ProfileRegistry{
+		profiles: make(map[string]profileRecord),
+	}
+}
+
+// ValidateProfile normalizes the nickname and the status of a profile, and checks its fields.
+func ValidateProfile(p *Profile) error {
+	p.Nickname = strings.TrimSpace(p.Nickname)
+	p.Status = strings.TrimSpace(p.Status)
+	if utf8.RuneCountInString(p.Nickname) > MAX_NICKNAME_LENGTH {
+		return fmt.Errorf("the nickname cannot be longer than %d characters", MAX_NICKNAME_LENGTH)
+	}
+	if utf8.RuneCountInString(p.Status) > MAX_STATUS_LENGTH {
+		return fmt.Errorf("the status cannot be longer than %d characters", MAX_STATUS_LENGTH)
+	}
+	if len(p.Avatar) > MAX_AVATAR_SIZE {
+		return fmt.Errorf("the avatar cannot be larger than %d bytes", MAX_AVATAR_SIZE)
+	}
+	if len(p.Avatar) > 0 && !IsInArray(http.DetectContentType(p.Avatar), AVATAR_TYPES) {
+		return errors.New("the avatar must be a PNG, JPEG, GIF or WebP image")
+	}
+	return nil
+}
+
+// Rebuild loads the latest profiles from the message store, and prunes the profiles that have been superseded
+// (if the node stopped before it could prune them).
+func (r *ProfileRegistry) Rebuild() error {
+	r.profiles = make(map[string]profileRecord)
+	messages, err := Context.Database.GetAllMessagesOfKind(KIND_PROFILE)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if err := r.Add(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add records a profile (other messages, and invalid profiles, are ignored). The older profile of the same node, if
+// any, is pruned from the message store (see pruneMessages).
+func (r *ProfileRegistry) Add(m *MessageRecord) error {
+	if m.Data.Kind != KIND_PROFILE || m.Pruned || m.Data.ID == 0 || m.Data.Destination != "" {
+		return nil
+	}
+	var profile Profile
+	if err := json.Unmarshal(m.Data.Content, &profile); err != nil || ValidateProfile(&profile) != nil {
+		return nil
+	}
+
+	current, found := r.profiles[m.Data.Origin]
+	if found && current.ID > m.Data.ID {
+		// Superseded (the message store may contain several profiles of the node)
+		_, err := Context.pruneMessages([]*MessageRecord{m})
+		return err
+	}
+	r.profiles[m.Data.Origin] = profileRecord{m.Data.ID, profile, m.DateSeen}
+	if found && current.ID < m.Data.ID {
+		old, err := Context.Database.GetMessage(m.Data.Origin, current.ID)
+		if err != nil || old == nil || old.Pruned {
+			return err
+		}
+		_, err = Context.pruneMessages([]*MessageRecord{old})
+		return err
+	}
+	return nil
+}
+
+// Get returns the latest profile of a node, or else the profile of the identity to which it belongs.
+func (r *ProfileRegistry) Get(name string) (string, Profile, bool) {
+	if record, found := r.profiles[name]; found {
+		return name, record.Profile, true
+	}
+	identity := Context.Devices.IdentityOf(name)
+	record, found := r.profiles[identity]
+	return identity, record.Profile, found
+}
+
+// Info returns the description of the profile of a node (see Get).
+func (r *ProfileRegistry) Info(name string) (ProfileInfo, bool) {
+	origin, profile, found := r.Get(name)
+	if !found {
+		return ProfileInfo{}, false
+	}
+	record := r.profiles[origin]
+	info := ProfileInfo{
+		Name:     origin,
+		Identity: Context.Devices.IdentityOf(origin),
+		Nickname: profile.Nickname,
+		Status:   profile.Status,
+		Version:  record.ID,
+		Updated:  profile.Updated,
+		Seen:     record.Seen,
+	}
+	if len(profile.Avatar) > 0 {
+		info.Avatar = "/profile/" + origin + "/avatar"
+	}
+	return info, true
+}
+
+// All returns the profiles of all the nodes, sorted by name.
+func (r *ProfileRegistry) All() []ProfileInfo {
+	output := make([]ProfileInfo, 0, len(r.profiles))
+	for name := range r.profiles {
+		info, _ := r.Info(name)
+		output = append(output, info)
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].Name < output[j].Name
+	})
+	return output
+}
+
+// PublishProfile submits a profile (which must have been validated) as a public message of this local identity.
+func (id *LocalIdentity) PublishProfile(p Profile) (Job, error) {
+	p.Updated = time.Now().Format(time.RFC3339)
+	content, _ := json.Marshal(p)
+	return id.Jobs.Submit(&OutgoingMessage{Kind: KIND_PROFILE, Content: string(content)})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Statuses of the private messages sent by a local identity (see MessageLogEntry.Status)
+const (
+	RECEIPT_SENT      = "sent"      // No receipt has been received yet
+	RECEIPT_DELIVERED = "delivered" // The message has been received by a device of the recipient
+	RECEIPT_READ      = "read"      // The message has been read on a device of the recipient
+)
+
+// Lifetime of the receipt messages (30 days): receipts are only useful to the sender, who records them
+const RECEIPT_TTL = 30 * 24 * 3600
+
+// Delay during which the delivery receipts are accumulated before being sent, so that a node catching up on many
+// messages sends a single receipt to each sender (every receipt requires a proof-of-work)
+const RECEIPT_DELAY = 2 * time.Second
+
+// Receipt records when a private message sent by a local identity was delivered and read (RFC3339 dates, empty
+// if no receipt has been received).
+type Receipt struct {
+	Delivered string
+	Read      string
+}
+
+// Status returns the status of the message (see RECEIPT_SENT and the following constants).
+func (r Receipt) Status() string {
+	if r.Read != "" {
+		return RECEIPT_READ
+	} else if r.Delivered != "" {
+		return RECEIPT_DELIVERED
+	}
+	return RECEIPT_SENT
+}
+
+// ReceiptNotice is the content of the KIND_RECEIPT messages, which are sent by the recipient of private messages
+// to their sender. Receipts are encrypted and signed like any other private message.
+type ReceiptNotice struct {
+	Status   string       // RECEIPT_DELIVERED or RECEIPT_READ
+	Messages []ReceiptRef // Messages covered by the receipt
+}
+
+// ReceiptRef identifies a message covered by a receipt. The hash makes sure that the receipt applies to the version
+// of the message that was received (in case of conflicting messages with the same ID).
+type ReceiptRef struct {
+	Origin string
+	ID     uint32
+	Hash   []byte
+}
+
+// Preferences are the settings of a local identity.
+type Preferences struct {
+	ReadReceipts bool // Send read receipts (delivery receipts are always sent)
+}
+
+func DefaultPreferences() Preferences {
+	return Preferences{ReadReceipts: true}
+}
+
+// queueDeliveryReceipt schedules a delivery receipt for a private text message received by this identity.
+// Only the device to which the message is addressed (the primary device) sends delivery receipts.
+// Must be called on the main thread.
+func (id *LocalIdentity) queueDeliveryReceipt(m *MessageRecord) {
+	if m.Pruned || !isTextKind(m.Data.Kind) || m.Data.Destination != id.DisplayName || id.IsMine(m.Data.Origin) {
+		return
+	}
+	if id.pendingReceipts == nil {
+		id.pendingReceipts = make(map[string][]ReceiptRef)
+		time.AfterFunc(RECEIPT_DELAY, func() {
+			Context.EventQueue <- id.flushDeliveryReceipts
+		})
+	}
+	sender := Context.Devices.IdentityOf(m.Data.Origin)
+	id.pendingReceipts[sender] = append(id.pendingReceipts[sender],
+		ReceiptRef{m.Data.Origin, m.Data.ID, m.Data.ComputeHash()})
+}
+
+// flushDeliveryReceipts sends the scheduled delivery receipts (one message per sender).
+// Must be called on the main thread.
+func (id *LocalIdentity) flushDeliveryReceipts() {
+	for sender, refs := range id.pendingReceipts {
+		ReportError(LogMain, "unable to send a delivery receipt", id.sendReceipt(sender, RECEIPT_DELIVERED, refs))
+	}
+	id.pendingReceipts = nil
+}
+
+// sendReceipt submits a receipt for the given messages, which have been received from another identity.
+func (id *LocalIdentity) sendReceipt(sender string, status string, refs []ReceiptRef) error {
+	content, _ := json.Marshal(ReceiptNotice{Status: status, Messages: refs})
+	_, err := id.Jobs.Submit(&OutgoingMessage{Kind: KIND_RECEIPT, Content: string(content), Destination: sender,
+		TTL: RECEIPT_TTL})
+	return err
+}
+
+// sendReadReceipts sends a read receipt for the given messages (which have just been marked as read), unless this
+// identity has disabled read receipts.
+func (id *LocalIdentity) sendReadReceipts(messages []*MessageRecord) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	preferences, err := Context.Database.GetPreferences(id.DisplayName)
+	if err != nil || !preferences.ReadReceipts {
+		return err
+	}
+	bySender := make(map[string][]ReceiptRef)
+	for _, m := range messages {
+		sender := Context.Devices.IdentityOf(m.Data.Origin)
+		bySender[sender] = append(bySender[sender], ReceiptRef{m.Data.Origin, m.Data.ID, m.Data.ComputeHash()})
+	}
+	for sender, refs := range bySender {
+		if err := id.sendReceipt(sender, RECEIPT_READ, refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyReceipt records a receipt sent by another identity for the messages sent by this identity. Receipts are only
+// accepted from the devices of the identity to which the messages were sent.
+func (id *LocalIdentity) applyReceipt(m *MessageRecord) error {
+	if m.Pruned || m.Data.Destination != id.Primary() || id.IsMine(m.Data.Origin) {
+		return nil
+	}
+	content, err := id.DecryptContent(&m.Data)
+	if err != nil {
+		return err
+	}
+	var notice ReceiptNotice
+	if err := json.Unmarshal(content, &notice); err != nil {
+		return err
+	}
+	if notice.Status != RECEIPT_DELIVERED && notice.Status != RECEIPT_READ {
+		return nil
+	}
+	recipient := Context.Devices.IdentityOf(m.Data.Origin)
+	for _, ref := range notice.Messages {
+		if !id.IsMine(ref.Origin) {
+			continue
+		}
+		sent, err := Context.Database.GetMessage(ref.Origin, ref.ID)
+		if err != nil {
+			return err
+		}
+		if sent == nil || !isTextKind(sent.Data.Kind) || !bytes.Equal(sent.MessageHash(), ref.Hash) ||
+			Context.Devices.IdentityOf(sent.Data.Destination) != recipient {
+			continue
+		}
+		if err := Context.Database.RecordReceipt(ref.Origin, ref.ID, notice.Status, m.DateSeen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Replication modes (see ReplicationConfig)
+const (
+	REPLICATION_FULL  = "full"
+	REPLICATION_LIGHT = "light"
+)
+
+// SkipNotice is sent by a full node instead of a private message that does not match the interest filter of a light
+// peer. The light node stores a placeholder (a tombstone with the hash of the notice), so that the IDs of the origin
+// remain contiguous and its vector clock can catch up with the vector clocks of the full nodes.
+//
+// The hash of a notice cannot be verified: the light node trusts its peers not to skip the messages it is interested
+// in. A placeholder is replaced by the actual message whenever it is received (whatever its hash), and the full nodes
+// do not count placeholders in their vector clocks, so that they fetch the skipped messages from their peers.
+type SkipNotice struct {
+	Origin      string
+	ID          uint32
+	Destination string
+	Hash        []byte
+}
+
+// peerInterest is the interest filter registered by a light peer.
+type peerInterest struct {
+	Filter  *BloomFilter
+	Updated time.Time
+}
+
+// IsLight tells whether this node is a light node, i.e. whether it only stores the public messages and the private
+// messages sent or received by its local identities (or their devices).
+func (c *contextType) IsLight() bool {
+	return c.Config.Replication.Mode == REPLICATION_LIGHT
+}
+
+// localNodes returns the names of the local identities and of their devices.
+func (c *contextType) localNodes() []string {
+	names := make([]string, 0, len(c.Identities))
+	for _, id := range c.Identities {
+		for _, name := range append([]string{id.DisplayName}, c.Devices.NamesOf(id.Primary())...) {
+			if !IsInArray(name, names) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isLocalNode tells whether a name is a local identity or one of its devices.
+func (c *contextType) isLocalNode(name string) bool {
+	for _, id := range c.Identities {
+		if name == id.DisplayName || id.IsMine(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps tells whether this node stores the content of a message: full nodes store every message, whereas light
+// nodes replace the private messages of the other nodes with tombstones.
+func (c *contextType) Keeps(m *RumorMessage) bool {
+	return !c.IsLight() || m.Destination == "" || c.isLocalNode(m.Origin) || c.isLocalNode(m.Destination)
+}
+
+// InterestFilter returns the filter of the names of the local nodes, which a light node attaches to its status
+// messages (nil for full nodes).
+func (c *contextType) InterestFilter() *BloomFilter {
+	if !c.IsLight() {
+		return nil
+	}
+	filter := NewBloomFilter(BLOOM_FILTER_BITS, BLOOM_FILTER_HASHES)
+	for _, name := range c.localNodes() {
+		filter.Add(name)
+	}
+	return filter
+}
+
+// RecordInterest registers the interest filter attached to a status message of a peer. Peers that send a status
+// message without filter are full nodes, and their previous filter (if any) is forgotten.
+func (c *contextType) RecordInterest(peer string, filter *BloomFilter) {
+	if filter == nil {
+		delete(c.Interests, peer)
+		return
+	}
+	if err := filter.Check(); err != nil {
+		LogGossip.Debugf("ignored the interest filter of %s (%s)", Addr(peer), err.Error())
+		delete(c.Interests, peer)
+		return
+	}
+	c.Interests[peer] = peerInterest{filter, time.Now()}
+}
+
+// interestOf returns the interest filter of a light peer, or nil if the peer is a full node (or if its filter
+// has expired).
+func (c *contextType) interestOf(peer string) *BloomFilter {
+	interest, found := c.Interests[peer]
+	if !found {
+		return nil
+	} else if time.Since(interest.Updated) > c.Config.Replication.InterestLifetime.Duration {
+		delete(c.Interests, peer)
+		return nil
+	}
+	return interest.Filter
+}
+
+// randomFullPeer returns a random peer that has not registered an interest filter (or "" if there is none).
+func (c *contextType) randomFullPeer(exclusionList []string) string {
+	for peer := range c.PeerSet {
+		if c.interestOf(peer) != nil {
+			exclusionList = append(exclusionList, peer)
+		}
+	}
+	return c.RandomPeer(exclusionList)
+}
+
+// PeerWants tells whether a peer wants to receive a message: light peers only want the public messages, and the
+// private messages sent or received by the names of their filter (and by some other names, since the filter is
+// probabilistic).
+func (c *contextType) PeerWants(peer string, m *RumorMessage) bool {
+	filter := c.interestOf(peer)
+	return filter == nil || m.Destination == "" || filter.Contains(m.Origin) || filter.Contains(m.Destination)
+}
+
+// BuildPacket returns the packet that sends the message with the given (origin, ID) pair to a peer: the message
+// itself, or a skip notice if the peer is not interested in it. Light nodes do not forward the tombstones of the
+// messages they have dropped (see Keeps): the peers that want these messages have to fetch them from full nodes.
+func (c *contextType) BuildPacket(origin string, id uint32, peer string) (*GossipPacket, error) {
+	m, err := c.Database.GetMessage(origin, id)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return nil, errMessageNotFound
+	}
+	if !c.PeerWants(peer, &m.Data) {
+		return &GossipPacket{Skip: &SkipNotice{origin, id, m.Data.Destination, m.MessageHash()}}, nil
+	} else if !m.Forwardable() || (m.Pruned && !c.Keeps(&m.Data)) {
+		return nil, errMessagePruned
+	}
+	return &GossipPacket{Rumor: &m.Data}, nil
+}
+
+// rumorPacket returns the packet that forwards a rumor to a peer (see BuildPacket).
+func (c *contextType) rumorPacket(m *RumorMessage, peer string) *GossipPacket {
+	if !c.PeerWants(peer, m) {
+		return &GossipPacket{Skip: &SkipNotice{m.Origin, m.ID, m.Destination, m.ComputeHash()}}
+	}
+	return &GossipPacket{Rumor: m}
+}
+
+// newRecord returns the record of a new message received from a peer: the message itself, or a tombstone if the
+// message is a tombstone or if this node does not keep it (see Keeps).
+func (c *contextType) newRecord(m *RumorMessage, originAddress string) *MessageRecord {
+	mr := &MessageRecord{}
+	mr.Data = *m
+	mr.FromAddress = originAddress
+	mr.DateSeen = time.Now().Format(time.RFC3339)
+	if m.IsTombstone() || !c.Keeps(m) {
+		mr.Hash = m.ComputeHash()
+		mr.Pruned = true
+		mr.Data = m.Tombstone()
+	}
+	return mr
+}
+
+// TryInsertPlaceholder stores the placeholder of a message skipped by a full peer (see SkipNotice).
+// Returns true if the placeholder is inserted, and false if the notice is out of order or already seen.
+// Only light nodes accept skip notices, and only for the private messages of the other nodes.
+func (c *contextType) TryInsertPlaceholder(notice *SkipNotice, originAddress string) (bool, error) {
+	if !c.IsLight() {
+		return false, errors.New("skip notices are only accepted by light nodes")
+	} else if notice.ID == 0 || notice.Destination == "" || len(notice.Hash) != sha256.Size {
+		return false, errors.New("malformed skip notice")
+	} else if c.isLocalNode(notice.Origin) || c.isLocalNode(notice.Destination) {
+		return false, errors.New("skipped a message of a local identity")
+	}
+	expectedNextID, err := c.Database.NextID(notice.Origin)
+	if err != nil || notice.ID != expectedNextID {
+		return false, err
+	}
+	mr := &MessageRecord{
+		Data: RumorMessage{
+			Origin:      notice.Origin,
+			Destination: notice.Destination,
+			ID:          notice.ID,
+			Content:     make([]byte, 0),
+			Signature:   make([]byte, 0),
+			Nonce:       make([]byte, 0),
+		},
+		FromAddress: originAddress,
+		DateSeen:    time.Now().Format(time.RFC3339),
+		Pruned:      true,
+		Hash:        notice.Hash,
+		Placeholder: true,
+	}
+	return true, c.Database.InsertOrUpdateMessage(mr)
+}
+
+// VectorClock returns the vector clock of this node. Full nodes do not count the placeholders left by an earlier
+// run as a light node: the next expected ID of an origin is the ID of its first placeholder, so that the peers
+// send the skipped messages again.
+func (c *contextType) VectorClock() ([]PeerStatus, error) {
+	vectorClock, err := c.Database.VectorClock()
+	if err != nil || c.IsLight() {
+		return vectorClock, err
+	}
+	placeholders, err := c.Database.FirstPlaceholders()
+	if err != nil || len(placeholders) == 0 {
+		return vectorClock, err
+	}
+	first := make(map[string]uint32)
+	for _, p := range placeholders {
+		first[p.Identifier] = p.NextID
+	}
+	for i, status := range vectorClock {
+		if id, found := first[status.Identifier]; found && id < status.NextID {
+			vectorClock[i].NextID = id
+		}
+	}
+	return vectorClock, nil
+}
+
+// ReplicationInfo describes the replication mode of this node (for the client).
+type ReplicationInfo struct {
+	Mode       string
+	Interest   []string // Names registered with the peers (light nodes only)
+	LightPeers []LightPeerInfo
+}
+
+// LightPeerInfo describes a light peer, i.e. a peer that has registered an interest filter.
+type LightPeerInfo struct {
+	Address string
+	Updated string // Date of the latest registration of the filter
+	Bits    int
+	Hashes  uint32
+}
+
+// ReplicationInfo describes the replication mode of this node, and the filters registered by its light peers.
+func (c *contextType) ReplicationInfo() ReplicationInfo {
+	info := ReplicationInfo{Mode: c.Config.Replication.Mode, Interest: make([]string, 0),
+		LightPeers: make([]LightPeerInfo, 0)}
+	if c.IsLight() {
+		info.Interest = c.localNodes()
+	}
+	for peer := range c.Interests {
+		if filter := c.interestOf(peer); filter != nil {
+			info.LightPeers = append(info.LightPeers, LightPeerInfo{peer,
+				c.Interests[peer].Updated.Format(time.RFC3339), len(filter.Bits) * 8, filter.Hashes})
+		}
+	}
+	sort.Slice(info.LightPeers, func(i, j int) bool {
+		return info.LightPeers[i].Address < info.LightPeers[j].Address
+	})
+	return info
+}
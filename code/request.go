@@ -1,18 +1,26 @@
 package main
 
+import (
+	"time"
+)
+
+// Delay before reading from the socket again after a failed read
+const RECEIVE_RETRY_DELAY = 20 * time.Millisecond
+
 // RequestListener waits for remote requests (using the given socket)
 // and handles them according to the supplied implementation.
 type RequestListener struct {
 	socket  Socket
-	Handler func(data []byte, sender string)
+	Handler func(data []byte, sender string) error
 }
 
 // NewRequestListener constructs a new RequestListener, using the given socket.
 // All events will be pushed into the main event queue (passed as argument).
 func NewRequestListener(socket Socket) *RequestListener {
 	listener := &RequestListener{socket,
-		func(data []byte, sender string) {
+		func(data []byte, sender string) error {
 			// HandleRequest: do nothing
+			return nil
 		}}
 	return listener
 }
@@ -22,9 +30,17 @@ func (listener *RequestListener) Start() {
 	// Run socket receiver in another thread. All events are pushed into the event queue.
 	go func() {
 		for {
-			data, sender := listener.socket.Receive()
+			data, sender, err := listener.socket.Receive()
+			if err == ErrSocketClosed {
+				return
+			} else if err != nil {
+				// A single bad read (e.g. an ICMP error for a previous packet) should not stop the listener
+				LogGossip.Warnf("unable to receive packet: %s", err.Error())
+				time.Sleep(RECEIVE_RETRY_DELAY)
+				continue
+			}
 			Context.EventQueue <- func() {
-				listener.Handler(data, sender)
+				ReportError(LogGossip, "unable to handle packet from "+Addr(sender).String(), listener.Handler(data, sender))
 			}
 		}
 	}()
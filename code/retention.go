@@ -0,0 +1,170 @@
+package main
+
+import (
+	"time"
+)
+
+// PruneMessages applies the retention policy, and replaces the messages that must not be kept with tombstones.
+// Key announcements are never pruned, since they are needed to verify and encrypt messages.
+// The following messages are pruned, in this order:
+//   - on light nodes, the private messages that are neither sent nor received by the local identities (or their
+//     devices), e.g. the messages stored before switching to the light mode (see Keeps);
+//   - the messages whose TTL has expired (counted from the moment they were first seen by this node);
+//   - the messages older than the maximum age of their origin (Retention.OriginMaxAge, or else Retention.MaxAge);
+//   - the oldest messages, until the total size of the stored content fits in Retention.MaxSize.
+//
+// Unless their TTL has expired, the messages sent or received by the local identities are kept if Retention.KeepOwn
+// is set. Messages in the legacy format may be kept longer (see pruneMessages).
+// Returns the number of pruned messages.
+func (c *contextType) PruneMessages() (int, error) {
+	config := c.Config.Retention
+	now := time.Now()
+	pruned := 0
+
+	prune := func(messages []*MessageRecord, err error) error {
+		if err != nil {
+			return err
+		}
+		count, err := c.pruneMessages(messages)
+		pruned += count
+		return err
+	}
+
+	// The messages sent or received by the local identities are protected by KeepOwn
+	var protected []string
+	if config.KeepOwn {
+		protected = c.LocalNames()
+	}
+
+	// Messages that light nodes do not keep
+	if c.IsLight() {
+		err := prune(c.Database.GetPrunableMessages(PruneFilter{PrivateOnly: true, ExcludeNodes: c.localNodes()}))
+		if err != nil {
+			return pruned, err
+		}
+	}
+
+	// Expired messages
+	if err := prune(c.Database.GetPrunableMessages(PruneFilter{ExpiredAt: now})); err != nil {
+		return pruned, err
+	}
+
+	// Old messages, with per-origin overrides
+	overridden := make([]string, 0, len(config.OriginMaxAge))
+	for origin, maxAge := range config.OriginMaxAge {
+		overridden = append(overridden, origin)
+		if maxAge.Duration > 0 {
+			err := prune(c.Database.GetPrunableMessages(PruneFilter{
+				SeenBefore:   now.Add(-maxAge.Duration),
+				Origin:       origin,
+				ExcludeNodes: protected,
+			}))
+			if err != nil {
+				return pruned, err
+			}
+		}
+	}
+	if config.MaxAge.Duration > 0 {
+		err := prune(c.Database.GetPrunableMessages(PruneFilter{
+			SeenBefore:     now.Add(-config.MaxAge.Duration),
+			ExcludeOrigins: overridden,
+			ExcludeNodes:   protected,
+		}))
+		if err != nil {
+			return pruned, err
+		}
+	}
+
+	// Total size
+	if config.MaxSize > 0 {
+		size, err := c.Database.StoredContentSize()
+		if err != nil || size <= config.MaxSize {
+			return pruned, err
+		}
+		candidates, err := c.Database.GetPrunableMessages(PruneFilter{ExcludeNodes: protected})
+		if err != nil {
+			return pruned, err
+		}
+		oldest := make([]*MessageRecord, 0)
+		for _, m := range candidates {
+			if size <= config.MaxSize {
+				break
+			}
+			size -= int64(len(m.Data.Content))
+			oldest = append(oldest, m)
+		}
+		if err := prune(oldest, nil); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// pruneMessages replaces messages with tombstones, removes them from the in-memory indexes, and returns the number
+// of pruned messages. The tombstones of the messages in the legacy format cannot be forwarded, so such a message is
+// only pruned once every peer has advertised a vector clock past it (the other ones are kept for now): otherwise,
+// a peer that still needs the message could not receive the later messages of its origin from this node.
+func (c *contextType) pruneMessages(messages []*MessageRecord) (int, error) {
+	prunable := make([]*MessageRecord, 0, len(messages))
+	for _, m := range messages {
+		if m.Data.Format == FORMAT_DIGEST || c.seenByPeers(m.Data.Origin, m.Data.ID) {
+			prunable = append(prunable, m)
+		}
+	}
+	if len(prunable) == 0 {
+		return 0, nil
+	}
+	if err := c.Database.PruneMessages(prunable); err != nil {
+		return 0, err
+	}
+	for _, m := range prunable {
+		c.forgetMessage(messageKey{m.Data.Origin, m.Data.ID})
+	}
+	return len(prunable), nil
+}
+
+// seenByPeers tells whether every peer has advertised a vector clock past the given message. Without any peer,
+// nothing is known about the nodes that may still need the message, so it returns false.
+func (c *contextType) seenByPeers(origin string, id uint32) bool {
+	if len(c.PeerSet) == 0 {
+		return false
+	}
+	for peer := range c.PeerSet {
+		clock, found := c.PeerClocks[peer]
+		if !found || clock[origin] <= id {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordPeerClock remembers the vector clock advertised by a peer in its latest status message.
+func (c *contextType) RecordPeerClock(peer string, want []PeerStatus) {
+	clock := make(map[string]uint32, len(want))
+	for _, status := range want {
+		clock[status.Identifier] = status.NextID
+	}
+	c.PeerClocks[peer] = clock
+}
+
+// startPruning applies the retention policy now, and then periodically. The returned ticker must be stopped
+// when the node shuts down.
+func startPruning(interval time.Duration) *time.Ticker {
+	run := func() {
+		// Executed on the main thread
+		pruned, err := Context.PruneMessages()
+		ReportError(LogDb, "unable to prune messages", err)
+		if pruned > 0 {
+			LogDb.Infof("pruned %d messages according to the retention policy", pruned)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		Context.EventQueue <- run
+		for _ = range ticker.C {
+			Context.EventQueue <- run
+		}
+	}()
+	return ticker
+}
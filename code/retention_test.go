@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestSeenByPeers(t *testing.T) {
+	c := &contextType{PeerSet: map[string]int{}, PeerClocks: map[string]map[string]uint32{}}
+	if c.seenByPeers("a", 1) {
+		t.Error("a message has been considered as seen without any peer")
+	}
+
+	c.PeerSet["peer1"], c.PeerSet["peer2"] = 0, 0
+	c.RecordPeerClock("peer1", []PeerStatus{{Identifier: "a", NextID: 2}})
+	if c.seenByPeers("a", 1) {
+		t.Error("a message has been considered as seen by a peer without a known vector clock")
+	}
+	c.RecordPeerClock("peer2", []PeerStatus{{Identifier: "a", NextID: 1}})
+	if c.seenByPeers("a", 1) {
+		t.Error("a message has been considered as seen by a peer that has not received it")
+	}
+	c.RecordPeerClock("peer2", []PeerStatus{{Identifier: "a", NextID: 3}})
+	if !c.seenByPeers("a", 1) {
+		t.Error("a message received by every peer has not been considered as seen")
+	}
+}
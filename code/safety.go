@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Version of the safety-number computation (hashed along with the keys)
+const SAFETY_NUMBER_VERSION = 0
+
+// Number of SHA-512 iterations used to derive each half of a safety number (slows down the search for keys
+// whose safety numbers collide)
+const SAFETY_NUMBER_ITERATIONS = 5200
+
+// Number of digits of each half of a safety number (the safety number has twice as many)
+const SAFETY_NUMBER_HALF_DIGITS = 30
+
+// Width and height of the QR codes, in pixels
+const QR_CODE_SIZE = 256
+
+// Prefix of the identity codes (e.g. "anonpeerster:NAME?fingerprint=HEX"), which are shown as QR codes
+const IDENTITY_CODE_PREFIX = "anonpeerster:"
+
+// ErrUnknownKey is returned when the public key of a node has not been received yet.
+var ErrUnknownKey = errors.New("the public key of the node is unknown")
+
+// safetyNumberHalf derives the digits contributed by one party to a safety number.
+func safetyNumberHalf(name string, fingerprint []byte) string {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, SAFETY_NUMBER_VERSION)
+	hash := append(append(version, fingerprint...), []byte(name)...)
+	for i := 0; i < SAFETY_NUMBER_ITERATIONS; i++ {
+		digest := sha512.Sum512(append(hash, fingerprint...))
+		hash = digest[:]
+	}
+	// Every chunk of 5 bytes gives 5 digits
+	var digits strings.Builder
+	for i := 0; i < SAFETY_NUMBER_HALF_DIGITS/5; i++ {
+		chunk := hash[i*5 : i*5+5]
+		value := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 |
+			uint64(chunk[4])
+		fmt.Fprintf(&digits, "%05d", value%100000)
+	}
+	return digits.String()
+}
+
+// SafetyNumber computes the safety number of two identities from the fingerprints of their keys, as 12 groups
+// of 5 digits. Both parties get the same number (the halves are sorted), and it changes if any of the keys changes.
+func SafetyNumber(nameA string, keyA PublicKey, nameB string, keyB PublicKey) string {
+	halves := []string{safetyNumberHalf(nameA, keyA.Fingerprint()), safetyNumberHalf(nameB, keyB.Fingerprint())}
+	if halves[1] < halves[0] {
+		halves[0], halves[1] = halves[1], halves[0]
+	}
+	digits := halves[0] + halves[1]
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
+
+// IdentityCode returns the code that identifies a node and its key (meant to be scanned as a QR code).
+func IdentityCode(name string, key PublicKey) string {
+	return IDENTITY_CODE_PREFIX + name + "?fingerprint=" + hex.EncodeToString(key.Fingerprint())
+}
+
+// parseIdentityCode returns the name and the fingerprint given by an identity code.
+func parseIdentityCode(code string) (string, []byte, error) {
+	parts := strings.SplitN(strings.TrimPrefix(strings.TrimSpace(code), IDENTITY_CODE_PREFIX), "?fingerprint=", 2)
+	if !strings.HasPrefix(strings.TrimSpace(code), IDENTITY_CODE_PREFIX) || len(parts) != 2 {
+		return "", nil, errors.New("malformed identity code")
+	}
+	fingerprint, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, errors.New("malformed identity code")
+	}
+	return parts[0], fingerprint, nil
+}
+
+// normalizeSafetyNumber removes the separators of a safety number.
+func normalizeSafetyNumber(number string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, number)
+}
+
+// SafetyNumberWith computes the safety number of this local identity and another identity (which can be given by
+// the name of any of its devices). The keys of the primary devices are used, so that all the devices of both
+// identities show the same number. Returns the name of the other identity and the safety number.
+func (id *LocalIdentity) SafetyNumberWith(name string) (string, string, error) {
+	mine, err := Context.GetPublicKeyOf(id.Primary())
+	if err != nil {
+		return "", "", ErrUnknownKey
+	}
+	contact := Context.Devices.IdentityOf(name)
+	theirs, err := Context.GetPublicKeyOf(contact)
+	if err != nil {
+		return "", "", ErrUnknownKey
+	}
+	return contact, SafetyNumber(id.Primary(), mine, contact, theirs), nil
+}
+
+// VerifyContact checks a code obtained out-of-band from another identity: either its identity code, or the safety
+// number that it sees. The name can be omitted for identity codes. The result is recorded in the contact of the
+// identity (which is created if needed), and returned along with the name of the identity.
+func (id *LocalIdentity) VerifyContact(name string, code string) (string, bool, error) {
+	var verified bool
+	if strings.HasPrefix(strings.TrimSpace(code), IDENTITY_CODE_PREFIX) {
+		codeName, fingerprint, err := parseIdentityCode(code)
+		if err != nil {
+			return "", false, err
+		} else if name != "" && Context.Devices.IdentityOf(name) != Context.Devices.IdentityOf(codeName) {
+			return "", false, errors.New("the identity code belongs to another identity")
+		}
+		key, err := Context.GetPublicKeyOf(codeName)
+		if err != nil {
+			return "", false, ErrUnknownKey
+		}
+		// The code can be shown by any device of the identity
+		name = Context.Devices.IdentityOf(codeName)
+		verified = bytes.Equal(fingerprint, key.Fingerprint())
+	} else {
+		contact, number, err := id.SafetyNumberWith(name)
+		if err != nil {
+			return "", false, err
+		}
+		name = contact
+		verified = normalizeSafetyNumber(code) == normalizeSafetyNumber(number)
+	}
+
+	contact, found := id.Contacts.Get(name)
+	if !found {
+		contact = Contact{Name: name}
+	}
+	contact.Verified = verified
+	contact.LastVerified = time.Now().Format(time.RFC3339)
+	return name, verified, id.Contacts.Put(contact)
+}
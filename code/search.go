@@ -0,0 +1,211 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Maximum number of results returned by a search, unless a lower limit is requested
+const SEARCH_MAX_RESULTS = 100
+
+// Value of SearchQuery.Conversation that selects the public messages
+const PUBLIC_CONVERSATION = "public"
+
+// messageKey identifies a message in the search index.
+type messageKey struct {
+	Origin string
+	ID     uint32
+}
+
+// indexedMessage contains the metadata of an indexed message, used to filter the results.
+type indexedMessage struct {
+	Conversation string // PUBLIC_CONVERSATION, a channel (see channelConversation), or the other identity
+	Seen         time.Time
+	Tokens       []string
+}
+
+// SearchIndex is an inverted index over the content of the public messages and of the private messages
+// sent or received by a local identity. Every local identity has its own index. Since it contains decrypted
+// content, it is never written to disk: it is rebuilt from the message store when the node starts (i.e. once the
+// private key has been loaded), and before the first search after it has been invalidated (see Invalidate).
+// It must only be used from the main thread.
+type SearchIndex struct {
+	owner    *LocalIdentity
+	messages map[messageKey]*indexedMessage
+	tokens   map[string]map[messageKey]bool // Token -> messages containing it
+	outdated bool                           // The index must be rebuilt before the next search
+}
+
+// SearchQuery describes a search. All the terms must match (as prefixes of the words of a message),
+// and zero fields do not filter.
+type SearchQuery struct {
+	Terms        []string
+	Origin       string    // Only the messages sent by this node
+	Conversation string    // Only the public messages (PUBLIC_CONVERSATION), a channel, or an identity
+	Since        time.Time // Only the messages first seen at or after this time
+	Until        time.Time // Only the messages first seen before this time
+	Limit        int       // Maximum number of results (SEARCH_MAX_RESULTS if zero)
+}
+
+func NewSearchIndex(owner *LocalIdentity) *SearchIndex {
+	return &SearchIndex{
+		owner:    owner,
+		messages: make(map[messageKey]*indexedMessage),
+		tokens:   make(map[string]map[messageKey]bool),
+	}
+}
+
+// Tokenize splits a text into lower-case words (sequences of letters and digits).
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Rebuild indexes all the readable messages of the store, replacing the current contents of the index.
+func (s *SearchIndex) Rebuild() error {
+	s.messages = make(map[messageKey]*indexedMessage)
+	s.tokens = make(map[string]map[messageKey]bool)
+	s.outdated = false
+
+	for _, kind := range []uint32{KIND_TEXT, KIND_REPLY} {
+		messages, err := Context.Database.GetAllMessagesOfKind(kind)
+		if err != nil {
+			s.Invalidate()
+			return err
+		}
+		for _, m := range messages {
+			s.Add(m)
+		}
+	}
+	return nil
+}
+
+// Invalidate empties the index, which is rebuilt before the next search. This is used when the conversations of the
+// indexed messages may have changed (e.g. when a device is linked to an identity), so that several changes only
+// require a single rebuild.
+func (s *SearchIndex) Invalidate() {
+	s.messages = make(map[messageKey]*indexedMessage)
+	s.tokens = make(map[string]map[messageKey]bool)
+	s.outdated = true
+}
+
+// Add indexes a message, replacing the previous version of the message with the same (origin, ID) pair.
+// Key announcements, tombstones, messages that are not text, and the private messages of other identities
+// (or that cannot be decrypted) are skipped.
+func (s *SearchIndex) Add(m *MessageRecord) {
+	key := messageKey{m.Data.Origin, m.Data.ID}
+	s.Remove(key)
+	if s.outdated || m.Data.ID == 0 || m.Pruned || !isTextKind(m.Data.Kind) {
+		return
+	}
+
+	content, conversation, err := s.owner.readContent(m)
+	if err != nil {
+		return
+	}
+	entry := &indexedMessage{Conversation: conversation}
+	text, _ := messageText(m.Data.Kind, content)
+	if edit, found := s.owner.Edits.Get(key); found {
+		text = edit.Content
+	}
+	entry.Seen, _ = time.Parse(time.RFC3339, m.DateSeen)
+
+	for _, token := range Tokenize(text) {
+		keys, found := s.tokens[token]
+		if !found {
+			keys = make(map[messageKey]bool)
+			s.tokens[token] = keys
+		}
+		if !keys[key] {
+			keys[key] = true
+			entry.Tokens = append(entry.Tokens, token)
+		}
+	}
+	s.messages[key] = entry
+}
+
+// Remove removes a message from the index (if present).
+func (s *SearchIndex) Remove(key messageKey) {
+	entry, found := s.messages[key]
+	if !found {
+		return
+	}
+	for _, token := range entry.Tokens {
+		delete(s.tokens[token], key)
+		if len(s.tokens[token]) == 0 {
+			delete(s.tokens, token)
+		}
+	}
+	delete(s.messages, key)
+}
+
+// matchTerm returns the messages that contain a word starting with the given term.
+func (s *SearchIndex) matchTerm(term string) map[messageKey]bool {
+	matches := make(map[messageKey]bool)
+	for token, keys := range s.tokens {
+		if strings.HasPrefix(token, term) {
+			for key := range keys {
+				matches[key] = true
+			}
+		}
+	}
+	return matches
+}
+
+// Search returns the messages that match the query, from the newest to the oldest. The index is rebuilt first if it
+// has been invalidated.
+func (s *SearchIndex) Search(q SearchQuery) ([]messageKey, error) {
+	if s.outdated {
+		if err := s.Rebuild(); err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates map[messageKey]bool
+	for _, term := range q.Terms {
+		matches := s.matchTerm(term)
+		if candidates != nil {
+			for key := range candidates {
+				if !matches[key] {
+					delete(candidates, key)
+				}
+			}
+		} else {
+			candidates = matches
+		}
+	}
+
+	results := make([]messageKey, 0)
+	for key := range candidates {
+		entry := s.messages[key]
+		if (q.Origin != "" && key.Origin != q.Origin) ||
+			(q.Conversation != "" && entry.Conversation != q.Conversation) ||
+			(!q.Since.IsZero() && entry.Seen.Before(q.Since)) ||
+			(!q.Until.IsZero() && !entry.Seen.Before(q.Until)) {
+			continue
+		}
+		results = append(results, key)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		seenI, seenJ := s.messages[results[i]].Seen, s.messages[results[j]].Seen
+		if seenI.Equal(seenJ) {
+			if results[i].Origin == results[j].Origin {
+				return results[i].ID > results[j].ID
+			}
+			return results[i].Origin < results[j].Origin
+		}
+		return seenI.After(seenJ)
+	})
+
+	limit := q.Limit
+	if limit <= 0 || limit > SEARCH_MAX_RESULTS {
+		limit = SEARCH_MAX_RESULTS
+	}
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes of the gossiper
+const (
+	EXIT_OK               = 0
+	EXIT_STARTUP_FAILURE  = 1 // See FailOnError
+	EXIT_CONFIG_ERROR     = 2
+	EXIT_SHUTDOWN_FAILURE = 3
+)
+
+// Maximum time allowed for in-flight HTTP requests to complete during shutdown
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// Fatal error that has stopped the node (see requestShutdown)
+var fatalErrors = make(chan error, 1)
+
+// requestShutdown stops the node after a fatal error, as if it had received SIGTERM. It does not block, and only
+// the first fatal error is kept.
+func requestShutdown(err error) {
+	select {
+	case fatalErrors <- err:
+	default:
+	}
+}
+
+// shutdownTasks contains the resources that must be released when the node stops.
+type shutdownTasks struct {
+	Cancel      context.CancelFunc // Cancels Context.Running (and thus all the running proof-of-work computations)
+	WebServer   *http.Server       // Can be nil if the web server is disabled
+	Listener    *RequestListener
+	AntiEntropy *time.Ticker
+	Pruning     *time.Ticker
+	Jobs        []*JobQueue
+}
+
+// waitForShutdown installs the handler for SIGINT/SIGTERM. When a signal is received (or a fatal error is reported,
+// see requestShutdown), the node stops accepting new work and the returned channel receives the outcome, after which
+// the event loop can be drained. A signal received during the shutdown terminates the process immediately.
+func waitForShutdown(tasks *shutdownTasks) <-chan error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan error, 1)
+
+	go func() {
+		var fatal error
+		select {
+		case sig := <-signals:
+			LogMain.Infof("received %s, shutting down (send it again to force)", sig.String())
+		case fatal = <-fatalErrors:
+			LogMain.Errorf("shutting down after a fatal error (send SIGINT to force)")
+		}
+		go func() {
+			<-signals
+			LogMain.Errorf("forced shutdown")
+			os.Exit(EXIT_SHUTDOWN_FAILURE)
+		}()
+
+		// Abort the proof-of-work computations, and wait until the workers have stopped (the messages stay in the outbox)
+		// (the main event loop is still running at this point)
+		tasks.Cancel()
+		for _, jobs := range tasks.Jobs {
+			jobs.Wait()
+		}
+
+		var err error
+		if tasks.WebServer != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+			err = tasks.WebServer.Shutdown(ctx)
+			cancel()
+		}
+		tasks.AntiEntropy.Stop()
+		tasks.Pruning.Stop()
+		tasks.Listener.Close()
+		if fatal != nil {
+			err = fatal
+		}
+		done <- err
+	}()
+	return done
+}
+
+// drainEventQueue runs the events that are still queued, without waiting for new ones.
+func drainEventQueue() {
+	for {
+		select {
+		case eventHandler := <-Context.EventQueue:
+			eventHandler()
+		default:
+			return
+		}
+	}
+}
+
+// finalizeShutdown releases the remaining resources and terminates the process.
+func finalizeShutdown(shutdownErr error) {
+	drainEventQueue()
+	if err := Context.Database.Close(); err != nil {
+		shutdownErr = errors.New("unable to close the database: " + err.Error())
+	}
+
+	if shutdownErr != nil {
+		LogMain.Errorf("shutdown completed with errors: %s", shutdownErr.Error())
+		os.Exit(EXIT_SHUTDOWN_FAILURE)
+	}
+	LogMain.Infof("shutdown completed")
+	os.Exit(EXIT_OK)
+}
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
 )
 
+// ErrSocketClosed is returned by Receive after the socket has been closed.
+var ErrSocketClosed = errors.New("socket closed")
+
 // Socket represents a generic socket.
 type Socket interface {
 	Send(data []byte, address string)
-	Receive() ([]byte, string)
+	Receive() ([]byte, string, error)
 	Close()
 }
 
@@ -20,15 +24,19 @@ type UdpSocket struct {
 // MakeServerUdpSocket constructs a UDP socket.
 // listenAddress can either be a full address "ipAddress:port" or just a port in the form ":port".
 // In the latter case, the socket listens on all interfaces.
-func MakeServerUdpSocket(listenAddress string) *UdpSocket {
+func MakeServerUdpSocket(listenAddress string) (*UdpSocket, error) {
 	addr, err := net.ResolveUDPAddr("udp", listenAddress)
-	FailOnError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	socket := &UdpSocket{}
 	socket.connection, err = net.ListenUDP("udp", addr)
-	FailOnError(err)
+	if err != nil {
+		return nil, err
+	}
 
-	return socket
+	return socket, nil
 }
 
 func (socket *UdpSocket) Send(data []byte, address string) {
@@ -38,11 +46,17 @@ func (socket *UdpSocket) Send(data []byte, address string) {
 	}
 }
 
-func (socket *UdpSocket) Receive() ([]byte, string) {
+// Receive blocks until a datagram is received. If the socket has been closed, ErrSocketClosed is returned.
+func (socket *UdpSocket) Receive() ([]byte, string, error) {
 	buffer := make([]byte, 65536) // Maximum size of UDP datagram: 64 kB
 	bytesRead, source, err := socket.connection.ReadFromUDP(buffer)
-	FailOnError(err)
-	return buffer[:bytesRead], source.IP.String() + ":" + fmt.Sprint(source.Port)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return nil, "", ErrSocketClosed
+		}
+		return nil, "", err
+	}
+	return buffer[:bytesRead], source.IP.String() + ":" + fmt.Sprint(source.Port), nil
 }
 
 func (socket *UdpSocket) Close() {
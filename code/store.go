@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage backends (see OpenStore)
+const (
+	STORAGE_SQLITE = "sqlite"
+	STORAGE_MEMORY = "memory"
+)
+
+// MessageStore stores the messages of all the nodes (as well as the outbox of this node).
+// Messages are identified by their (origin, ID) pair, and the IDs of each origin are contiguous.
+type MessageStore interface {
+	// NextID returns the next expected ID of the given origin (0 if no message has been seen)
+	NextID(origin string) (uint32, error)
+	// VectorClock returns the next expected ID of every known origin
+	VectorClock() ([]PeerStatus, error)
+	// FirstPlaceholders returns the lowest ID of the placeholders of every origin that has some (see SkipNotice)
+	FirstPlaceholders() ([]PeerStatus, error)
+	// NodeList returns the known origins, sorted by name
+	NodeList() ([]string, error)
+	// InsertOrUpdateMessage stores a message, replacing the message with the same (origin, ID) pair if any
+	InsertOrUpdateMessage(m *MessageRecord) error
+	// InsertSentMessage stores a new message of a local identity and removes its draft from the outbox, atomically
+	InsertSentMessage(m *MessageRecord, localID int64) error
+	// GetMessage returns the message with the given (origin, ID) pair, or nil if it does not exist
+	GetMessage(origin string, id uint32) (*MessageRecord, error)
+	// GetMessageByHash returns the message with the given hash (including tombstones), or nil if it does not exist
+	GetMessageByHash(hash []byte) (*MessageRecord, error)
+	// GetAllMessagesTo returns the messages sent to the given destination (empty for the public messages of the
+	// main room, i.e. not sent to a channel)
+	GetAllMessagesTo(destination string) ([]*MessageRecord, error)
+	// GetChannelMessages returns the messages of a channel
+	GetChannelMessages(channel []byte) ([]*MessageRecord, error)
+	// ChannelList returns the channels that have messages (except tombstones), with their number of messages
+	ChannelList() ([]ChannelActivity, error)
+	// GetAllMessagesBetween returns the private messages exchanged by two nodes, sorted by date
+	GetAllMessagesBetween(origin string, destination string) ([]*MessageRecord, error)
+	// GetAllMessages returns every message (including tombstones), sorted by origin and ID
+	GetAllMessages() ([]*MessageRecord, error)
+	// GetAllMessagesOfKind returns the messages of the given kind (except tombstones), sorted by origin and ID
+	GetAllMessagesOfKind(kind uint32) ([]*MessageRecord, error)
+
+	// GetPrunableMessages returns the messages that match the filter and can be pruned (i.e. they are not
+	// tombstones, key announcements, or messages of the PERMANENT_KINDS), from the oldest to the newest
+	GetPrunableMessages(filter PruneFilter) ([]*MessageRecord, error)
+	// PruneMessages replaces the given messages with tombstones
+	PruneMessages(messages []*MessageRecord) error
+	// StoredContentSize returns the total size of the content of the messages that have not been pruned
+	StoredContentSize() (int64, error)
+
+	// InsertOutgoingMessage stores a new message in the outbox, and sets its LocalID
+	InsertOutgoingMessage(m *OutgoingMessage) error
+	// UpdateOutgoingMessage overwrites a message in the outbox (identified by its LocalID)
+	UpdateOutgoingMessage(m *OutgoingMessage) error
+	// GetOutgoingMessages returns the messages in the outbox, in the order in which they were composed
+	GetOutgoingMessages() ([]*OutgoingMessage, error)
+	// DeleteOutgoingMessage removes a message from the outbox
+	DeleteOutgoingMessage(localID int64) error
+
+	// GetReadMarks returns, for each origin, the next ID that has not been read by a local identity
+	GetReadMarks(identity string) ([]PeerStatus, error)
+	// RaiseReadMark marks the messages of an origin with an ID lower than nextID as read by a local identity,
+	// and tells whether the read mark has changed (read marks never decrease)
+	RaiseReadMark(identity string, origin string, nextID uint32) (bool, error)
+	// AssignDefaultIdentity assigns the outbox entries and the read marks that do not belong to any identity
+	// (stored by older versions) to the default identity
+	AssignDefaultIdentity(identity string) error
+
+	// GetContacts returns the address book of a local identity, sorted by name
+	GetContacts(identity string) ([]*Contact, error)
+	// PutContact creates or replaces a contact in the address book of a local identity
+	PutContact(identity string, c *Contact) error
+	// DeleteContact removes a contact from the address book of a local identity
+	DeleteContact(identity string, name string) error
+
+	// GetReceipt returns the receipts received for a private message (empty dates if none)
+	GetReceipt(origin string, id uint32) (Receipt, error)
+	// RecordReceipt records the date on which a private message was delivered or read (the first date is kept)
+	RecordReceipt(origin string, id uint32, status string, date string) error
+	// GetPreferences returns the preferences of a local identity (the default preferences if none are stored)
+	GetPreferences(identity string) (Preferences, error)
+	// PutPreferences stores the preferences of a local identity
+	PutPreferences(identity string, p *Preferences) error
+
+	// GetChannels returns the channels to which a local identity is subscribed, sorted by name
+	GetChannels(identity string) ([]*Channel, error)
+	// PutChannel creates or replaces the subscription of a local identity to a channel
+	PutChannel(identity string, c *Channel) error
+	// DeleteChannel removes the subscription of a local identity to a channel
+	DeleteChannel(identity string, channelID []byte) error
+
+	Close() error
+}
+
+// PruneFilter selects the messages considered by the retention policy. Zero fields do not filter.
+type PruneFilter struct {
+	ExpiredAt      time.Time // Only the messages whose TTL (counted from DateSeen) has elapsed at this time
+	SeenBefore     time.Time // Only the messages first seen before this time
+	Origin         string    // Only the messages of this origin
+	ExcludeOrigins []string  // Skip the messages of these origins
+	ExcludeNodes   []string  // Skip the messages sent or received by these nodes
+	PrivateOnly    bool      // Only the private messages
+}
+
+// Matches tells whether a message satisfies the filter (tombstones, key announcements and kinds are not checked).
+func (f *PruneFilter) Matches(m *MessageRecord) bool {
+	seen, err := time.Parse(time.RFC3339, m.DateSeen)
+	if err != nil {
+		return false
+	}
+	if !f.ExpiredAt.IsZero() &&
+		(m.Data.TTL == 0 || !seen.Add(time.Duration(m.Data.TTL)*time.Second).Before(f.ExpiredAt)) {
+		return false
+	}
+	if !f.SeenBefore.IsZero() && !seen.Before(f.SeenBefore) {
+		return false
+	}
+	if f.Origin != "" && m.Data.Origin != f.Origin {
+		return false
+	}
+	if IsInArray(m.Data.Origin, f.ExcludeOrigins) {
+		return false
+	}
+	if IsInArray(m.Data.Origin, f.ExcludeNodes) || IsInArray(m.Data.Destination, f.ExcludeNodes) {
+		return false
+	}
+	if f.PrivateOnly && m.Data.Destination == "" {
+		return false
+	}
+	return true
+}
+
+// OpenStore opens the message store of the given backend. The SQLite database is stored in dataDir,
+// whereas the in-memory store is lost when the node stops.
+func OpenStore(backend string, dataDir string) (MessageStore, error) {
+	switch backend {
+	case STORAGE_SQLITE:
+		db, err := NewConnection(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case STORAGE_MEMORY:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend \"%s\"", backend)
+	}
+}
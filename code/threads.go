@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Maximum length of a reaction, in characters (enough for any emoji sequence, or a short word)
+const MAX_REACTION_LENGTH = 16
+
+// Reply is the content of the KIND_REPLY messages: a text message that answers an earlier message. Replies are
+// encrypted like any other private message, including their reference.
+type Reply struct {
+	InReplyTo MessageRef // Message answered (by hash)
+	Content   string
+}
+
+// Reaction is the content of the KIND_REACTION messages. The latest reaction of a node with a given text counts,
+// so that a reaction can be withdrawn. Reactions to private messages are encrypted.
+type Reaction struct {
+	Target   MessageRef // Message reacted to (by hash)
+	Reaction string     // Emoji (or short text)
+	Removed  bool       // The node withdraws its reaction
+}
+
+// isTextKind tells whether messages of the given kind are displayed to the user.
+func isTextKind(kind uint32) bool {
+	return kind == KIND_TEXT || kind == KIND_REPLY
+}
+
+// messageText returns the text displayed for the (decrypted) content of a text message, and the hash of the message
+// it answers (nil if none).
+func messageText(kind uint32, content []byte) (string, []byte) {
+	if kind == KIND_REPLY {
+		var reply Reply
+		if err := json.Unmarshal(content, &reply); err == nil {
+			return reply.Content, reply.InReplyTo.Hash
+		}
+	}
+	return string(content), nil
+}
+
+// ValidateReaction normalizes the text of a reaction, and checks its length.
+func ValidateReaction(r *Reaction) error {
+	r.Reaction = strings.TrimSpace(r.Reaction)
+	if r.Reaction == "" || utf8.RuneCountInString(r.Reaction) > MAX_REACTION_LENGTH {
+		return fmt.Errorf("a reaction must contain 1 to %d characters", MAX_REACTION_LENGTH)
+	}
+	return nil
+}
+
+// conversationOf returns the conversation of a message, as seen by this local identity: PUBLIC_CONVERSATION, the
+// conversation of a channel (see channelConversation), or the other identity of a private conversation. Returns false
+// if the message is private and not readable by this identity, or if it belongs to a channel to which this identity
+// is not subscribed.
+func (id *LocalIdentity) conversationOf(m *MessageRecord) (string, bool) {
+	if len(m.Data.Channel) > 0 {
+		_, subscribed := id.Channels.Get(m.Data.Channel)
+		return channelConversation(m.Data.Channel), subscribed
+	} else if m.Data.Destination == "" {
+		return PUBLIC_CONVERSATION, true
+	} else if id.IsMine(m.Data.Destination) {
+		return Context.Devices.IdentityOf(m.Data.Origin), true
+	} else if id.IsMine(m.Data.Origin) {
+		return Context.Devices.IdentityOf(m.Data.Destination), true
+	}
+	return "", false
+}
+
+// readContent returns the content of a message readable by this local identity (decrypted if it is private or if it
+// belongs to an encrypted channel), and its conversation (see conversationOf).
+func (id *LocalIdentity) readContent(m *MessageRecord) ([]byte, string, error) {
+	conversation, readable := id.conversationOf(m)
+	if !readable {
+		return nil, "", errors.New("the message is not readable by this identity")
+	} else if conversation == PUBLIC_CONVERSATION {
+		return m.Data.Content, conversation, nil
+	} else if len(m.Data.Channel) > 0 {
+		content, err := id.readChannelContent(m)
+		return content, conversation, err
+	}
+	content, err := id.DecryptContent(&m.Data)
+	return content, conversation, err
+}
+
+// threadLink is a reference from a reply or a reaction to an earlier message.
+type threadLink struct {
+	Target       string // Hash of the referenced message (hexadecimal)
+	Conversation string // Conversation of the reply or reaction, which must be the one of the referenced message
+}
+
+// reactionKey identifies the reactions of a node with a given text to a message.
+type reactionKey struct {
+	Origin   string
+	Reaction string
+}
+
+// reactionVote is the latest reaction of a node with a given text to a message.
+type reactionVote struct {
+	ID           uint32
+	Removed      bool
+	Conversation string
+}
+
+// ThreadIndex keeps track of the replies and reactions readable by a local identity, by the hash of the messages
+// they reference. Like the SearchIndex, it is rebuilt from the message store when the node starts. Replies and
+// reactions only count if they belong to the conversation of the message they reference (a private message cannot
+// be answered in public, even though its hash is known to every node).
+// It must only be used from the main thread.
+type ThreadIndex struct {
+	owner     *LocalIdentity
+	parents   map[messageKey]threadLink               // Reply -> answered message
+	replies   map[string]map[messageKey]bool          // Hash -> replies
+	votes     map[messageKey]threadLink               // Reaction message -> message reacted to
+	reactions map[string]map[reactionKey]reactionVote // Hash -> latest reactions of each node
+}
+
+func NewThreadIndex(owner *LocalIdentity) *ThreadIndex {
+	t := &ThreadIndex{owner: owner}
+	t.reset()
+	return t
+}
+
+func (t *ThreadIndex) reset() {
+	t.parents = make(map[messageKey]threadLink)
+	t.replies = make(map[string]map[messageKey]bool)
+	t.votes = make(map[messageKey]threadLink)
+	t.reactions = make(map[string]map[reactionKey]reactionVote)
+}
+
+// Rebuild loads the replies and reactions readable by the owner from the message store.
+func (t *ThreadIndex) Rebuild() error {
+	t.reset()
+	for _, kind := range []uint32{KIND_REPLY, KIND_REACTION} {
+		messages, err := Context.Database.GetAllMessagesOfKind(kind)
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			t.Add(m)
+		}
+	}
+	return nil
+}
+
+// Add records a reply or a reaction (other messages, and messages that cannot be read by the owner, are ignored).
+func (t *ThreadIndex) Add(m *MessageRecord) {
+	key := messageKey{m.Data.Origin, m.Data.ID}
+	if m.Pruned || m.Data.ID == 0 || (m.Data.Kind != KIND_REPLY && m.Data.Kind != KIND_REACTION) {
+		return
+	}
+	content, conversation, err := t.owner.readContent(m)
+	if err != nil {
+		return
+	}
+	t.Remove(key)
+
+	switch m.Data.Kind {
+	case KIND_REPLY:
+		if _, parent := messageText(m.Data.Kind, content); len(parent) > 0 {
+			link := threadLink{hex.EncodeToString(parent), conversation}
+			t.parents[key] = link
+			if t.replies[link.Target] == nil {
+				t.replies[link.Target] = make(map[messageKey]bool)
+			}
+			t.replies[link.Target][key] = true
+		}
+
+	case KIND_REACTION:
+		var reaction Reaction
+		if json.Unmarshal(content, &reaction) != nil || ValidateReaction(&reaction) != nil ||
+			len(reaction.Target.Hash) == 0 {
+			return
+		}
+		link := threadLink{hex.EncodeToString(reaction.Target.Hash), conversation}
+		t.votes[key] = link
+		if t.reactions[link.Target] == nil {
+			t.reactions[link.Target] = make(map[reactionKey]reactionVote)
+		}
+		vote := reactionKey{m.Data.Origin, reaction.Reaction}
+		if current, found := t.reactions[link.Target][vote]; !found || current.ID < m.Data.ID {
+			t.reactions[link.Target][vote] = reactionVote{m.Data.ID, reaction.Removed, conversation}
+		}
+	}
+}
+
+// Remove forgets a reply or a reaction (if it has been pruned).
+func (t *ThreadIndex) Remove(key messageKey) {
+	if link, found := t.parents[key]; found {
+		delete(t.replies[link.Target], key)
+		if len(t.replies[link.Target]) == 0 {
+			delete(t.replies, link.Target)
+		}
+		delete(t.parents, key)
+	}
+	if link, found := t.votes[key]; found {
+		for vote, current := range t.reactions[link.Target] {
+			if vote.Origin == key.Origin && current.ID == key.ID {
+				delete(t.reactions[link.Target], vote)
+			}
+		}
+		if len(t.reactions[link.Target]) == 0 {
+			delete(t.reactions, link.Target)
+		}
+		delete(t.votes, key)
+	}
+}
+
+// Replies returns the replies to a message (given by its hash and conversation).
+func (t *ThreadIndex) Replies(hash string, conversation string) []messageKey {
+	output := make([]messageKey, 0)
+	for key := range t.replies[hash] {
+		if t.parents[key].Conversation == conversation {
+			output = append(output, key)
+		}
+	}
+	return output
+}
+
+// Reactions returns the identities that have reacted to a message (given by its hash and conversation), by reaction.
+func (t *ThreadIndex) Reactions(hash string, conversation string) map[string][]string {
+	identities := make(map[string]map[string]bool)
+	for vote, current := range t.reactions[hash] {
+		if current.Removed || current.Conversation != conversation {
+			continue
+		}
+		if identities[vote.Reaction] == nil {
+			identities[vote.Reaction] = make(map[string]bool)
+		}
+		identities[vote.Reaction][Context.Devices.IdentityOf(vote.Origin)] = true
+	}
+	output := make(map[string][]string)
+	for reaction, names := range identities {
+		for name := range names {
+			output[reaction] = append(output[reaction], name)
+		}
+		sort.Strings(output[reaction])
+	}
+	return output
+}
+
+// threadMessage returns the text message with the given hash, if it is readable by the owner.
+func (t *ThreadIndex) threadMessage(hash string) (*MessageRecord, string, error) {
+	binHash, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, "", errUnresolvedRef
+	}
+	m, err := Context.Database.GetMessageByHash(binHash)
+	if err != nil {
+		return nil, "", err
+	} else if m == nil || m.Pruned || !isTextKind(m.Data.Kind) {
+		return nil, "", errUnresolvedRef
+	}
+	conversation, readable := t.owner.conversationOf(m)
+	if !readable {
+		return nil, "", errUnresolvedRef
+	}
+	return m, conversation, nil
+}
+
+// Thread returns the thread that contains a message (given by its hash): the first message of the thread (the
+// oldest known ancestor of the message), followed by all its replies and their replies, sorted by date.
+// Returns errUnresolvedRef if the message is unknown, or if it is not readable by the owner.
+func (t *ThreadIndex) Thread(hash string) ([]*MessageRecord, error) {
+	root, conversation, err := t.threadMessage(hash)
+	if err != nil {
+		return nil, err
+	}
+	ancestors := map[string]bool{hash: true}
+	for {
+		link, found := t.parents[messageKey{root.Data.Origin, root.Data.ID}]
+		if !found || link.Conversation != conversation || ancestors[link.Target] {
+			break
+		}
+		parent, parentConversation, err := t.threadMessage(link.Target)
+		if err == errUnresolvedRef || (err == nil && parentConversation != conversation) {
+			// The rest of the thread is unknown (or has been deleted)
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		ancestors[link.Target] = true
+		root = parent
+	}
+
+	thread := []*MessageRecord{root}
+	pending := []string{hex.EncodeToString(root.MessageHash())}
+	visited := map[string]bool{pending[0]: true}
+	replies := make([]*MessageRecord, 0)
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		for _, key := range t.Replies(current, conversation) {
+			m, err := Context.Database.GetMessage(key.Origin, key.ID)
+			if err != nil {
+				return nil, err
+			} else if m == nil || m.Pruned {
+				continue
+			}
+			replyHash := hex.EncodeToString(m.MessageHash())
+			if !visited[replyHash] {
+				visited[replyHash] = true
+				replies = append(replies, m)
+				pending = append(pending, replyHash)
+			}
+		}
+	}
+	sort.SliceStable(replies, func(i, j int) bool {
+		return replies[i].DateSeen < replies[j].DateSeen
+	})
+	return append(thread, replies...), nil
+}
+
+// ReplyTo builds a reply to a message (given by its hash). The reply must belong to the conversation of the message:
+// the destination must be empty for a public message, or the other identity of a private conversation, and the
+// channel (given by its ID in hexadecimal) must be the channel of the message, if any.
+func (id *LocalIdentity) ReplyTo(hash string, destination string, channel string, content string) (*OutgoingMessage,
+	error) {
+
+	parent, conversation, err := id.Threads.threadMessage(hash)
+	if err != nil {
+		return nil, err
+	}
+	expected := PUBLIC_CONVERSATION
+	if destination != "" {
+		expected = Context.Devices.IdentityOf(destination)
+	} else if channel != "" {
+		expected = CHANNEL_CONVERSATION_PREFIX + channel
+	}
+	if conversation != expected {
+		return nil, errors.New("a reply must belong to the conversation of the message it answers")
+	}
+	data, _ := json.Marshal(Reply{InReplyTo: MessageRef{Hash: parent.MessageHash()}, Content: content})
+	return &OutgoingMessage{Kind: KIND_REPLY, Destination: destination, Channel: channel, Content: string(data)}, nil
+}
+
+// React submits a reaction (or withdraws it) to a message given by its hash. Reactions to private messages are sent
+// to the other identity of the conversation, and reactions to the messages of a channel are sent to the channel.
+func (id *LocalIdentity) React(hash string, reaction Reaction) (Job, error) {
+	target, conversation, err := id.Threads.threadMessage(hash)
+	if err != nil {
+		return Job{}, err
+	}
+	reaction.Target = MessageRef{Hash: target.MessageHash()}
+	destination := ""
+	if len(target.Data.Channel) == 0 && conversation != PUBLIC_CONVERSATION {
+		destination = conversation
+	}
+	data, _ := json.Marshal(reaction)
+	return id.Jobs.Submit(&OutgoingMessage{Kind: KIND_REACTION, Destination: destination,
+		Channel: hex.EncodeToString(target.Data.Channel), Content: string(data)})
+}
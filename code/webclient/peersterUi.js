@@ -18,19 +18,35 @@ $(document).ready(function(){
 		
 		// Check selected tab
 		const nodeName = $('li[aria-selected="true"]').attr("data-nodename")
-		if (typeof nodeName !== typeof undefined && nodeName !== false) {
-			// Private message
+		const channel = $('li[aria-selected="true"]').attr("data-channel")
+		if (typeof channel !== typeof undefined && channel !== false) {
+			// Message of a channel
 			$.ajax({
 				type: 'POST',
-				url: "/privateMessage",
-				data: JSON.stringify({Destination: nodeName, Content: msg}),
-				success: function() {
-					update()
+				url: "/channels/" + channel + "/messages" + (replyTo ? "?replyTo=" + replyTo : ""),
+				data: JSON.stringify(msg),
+				success: function(job) {
+					cancelReply()
+					waitForJob(JSON.parse(job).ID, "Unable to send the message to the channel")
+				},
+				error: function() {
+					alert("Unable to send the message to the channel")
 					$("#sendMessage").prop("disabled", false)
 					$("#message").prop("disabled", false)
-					$("#message").val("")
 					$("#loading").hide()
 				},
+				contentType: "application/json"
+			})
+		} else if (typeof nodeName !== typeof undefined && nodeName !== false) {
+			// Private message
+			$.ajax({
+				type: 'POST',
+				url: "/privateMessage" + (replyTo ? "?replyTo=" + replyTo : ""),
+				data: JSON.stringify({Destination: nodeName, Content: msg}),
+				success: function(job) {
+					cancelReply()
+					waitForJob(JSON.parse(job).ID, "Unable to send private message")
+				},
 				error: function() {
 					alert("Unable to send private message")
 					$("#sendMessage").prop("disabled", false)
@@ -43,15 +59,13 @@ $(document).ready(function(){
 			// Generic gossip message
 			$.ajax({
 				type: 'POST',
-				url: "/message",
+				url: "/message" + (replyTo ? "?replyTo=" + replyTo : ""),
 				data: JSON.stringify(msg),
-				success: function() {
-					update()
-					$("#sendMessage").prop("disabled", false)
-					$("#message").prop("disabled", false)
-					$("#message").val("")
-					$("#loading").hide()
-					$('#tabs-1').scrollTop(1E10);
+				success: function(job) {
+					cancelReply()
+					waitForJob(JSON.parse(job).ID, "Unable to send gossip message", function() {
+						$('#tabs-1').scrollTop(1E10);
+					})
 				},
 				error: function() {
 					alert("Unable to send gossip message")
@@ -64,6 +78,24 @@ $(document).ready(function(){
 		}
 	})
 	
+	$("#joinChannel").click(function() {
+		$.ajax({
+			type: 'POST',
+			url: "/channels",
+			data: JSON.stringify({Name: $("#channelName").val(), Password: $("#channelPassword").val()}),
+			success: function(result) {
+				$("#channelName").val("")
+				$("#channelPassword").val("")
+				openChannel(JSON.parse(result))
+				update()
+			},
+			error: function(xhr) {
+				alert("Unable to join the channel" + (xhr.responseText ? " (" + xhr.responseText + ")" : ""))
+			},
+			contentType: "application/json"
+		})
+	})
+
 	$("#addPeer").click(function(){
 		const peer = $("#newPeerAddress").val()
 		$.ajax({
@@ -80,9 +112,98 @@ $(document).ready(function(){
 		})
     })
 	
+	// Identity selector (only shown if the gossiper hosts several identities)
+	$("#identity").hide()
+	$.when($.get("/identities"), $.get("/session")).then(function(identities, session) {
+		const current = JSON.parse(session[0]).Name
+		const list = JSON.parse(identities[0])
+		list.forEach(id => {
+			const option = document.createElement("option")
+			option.value = id.Name
+			option.selected = id.Name == current
+			option.appendChild(document.createTextNode(id.Label != "" ? id.Label : "default"))
+			document.getElementById("identity").appendChild(option)
+		})
+		if (list.length > 1) {
+			$("#identity").show()
+		}
+	})
+	$("#identity").change(function() {
+		$.ajax({
+			type: 'POST',
+			url: "/session",
+			data: JSON.stringify({Identity: $(this).val()}),
+			success: function() {
+				// The private chats belong to the previous identity
+				location.reload()
+			},
+			error: function() {
+				alert("Unable to switch identity")
+			},
+			contentType: "application/json"
+		})
+	})
+
 	$("#tabs").tabs()
 })
 
+// waitForJob polls the status of a send job until its proof-of-work has been computed
+function waitForJob(jobId, errorMessage, onDone) {
+	$.get("/jobs/" + jobId, function(result) {
+		const job = JSON.parse(result)
+		if (job.State == "queued" || job.State == "solving") {
+			if (job.Progress) {
+				$("#powStatus").text(job.Progress.Tries + " tries, about " + Math.round(job.Progress.ETASeconds) + " s left ")
+			}
+			$("#cancelSend").off("click").click(function() {
+				$.ajax({type: 'DELETE', url: "/jobs/" + jobId})
+			}).show()
+			setTimeout(function() { waitForJob(jobId, errorMessage, onDone) }, 500)
+			return
+		}
+
+		$("#powStatus").text("")
+		$("#cancelSend").hide()
+		$("#sendMessage").prop("disabled", false)
+		$("#message").prop("disabled", false)
+		$("#loading").hide()
+		if (job.State == "done") {
+			$("#message").val("")
+			update()
+			if (onDone) {
+				onDone()
+			}
+		} else if (job.State == "retrying") {
+			alert(errorMessage + " (" + job.Error + "). It will be retried automatically.")
+		} else if (job.State == "failed") {
+			alert(errorMessage + " (" + job.Error + "). It has been kept in the outbox.")
+		}
+	}).fail(function() {
+		setTimeout(function() { waitForJob(jobId, errorMessage, onDone) }, 1000)
+	})
+}
+
+// openChannel opens the tab of a channel (if it is not open yet)
+function openChannel(channel) {
+	if (!$('*[data-channel="' + channel.ID + '"]').exists()) {
+		$("#tabs ul").append('<li data-channel="' + channel.ID + '"><a href="#tabs-' + tabCounter + '">#' + channel.Name + '</a> <span>x&nbsp;</span></li>')
+		$("#tabs").append('<div data-channel="' + channel.ID + '" id="tabs-' + tabCounter + '"></div>')
+		$("#tabs").tabs("refresh")
+		$('li[data-channel="' + channel.ID + '"] span').click(function() {
+			$('*[data-channel="' + channel.ID + '"]').remove()
+		})
+		tabCounter++
+	}
+}
+
+// Hash of the message answered by the next message (null if it is not a reply)
+let replyTo = null
+
+function cancelReply() {
+	replyTo = null
+	$("#message").attr("placeholder", "Send a message...")
+}
+
 function showMessages(container, messages, myName) {
 	if (container !== null) {
 		container.innerHTML = ""
@@ -93,14 +214,18 @@ function showMessages(container, messages, myName) {
 			}
 			const tooltip = document.createElement("img")
 			tooltip.src = "info.png"
-			tooltip.title = "Message first seen on " + m.FirstSeen + " \n"
+			tooltip.title = "Sent by " + m.FromNode + " \n"
+				+ (m.Alias ? "Alias: ~" + m.Alias + " (registration with the lowest hash: check the safety number before trusting it) \n" : "")
+				+ "Message first seen on " + m.FirstSeen + " \n"
 				+ "Relayed through " + m.FromAddress + " \n"
 				+ "Sequence ID: " + m.SeqID + " \n"
+				+ (m.TTL > 0 ? "Expires " + m.TTL + " seconds after it was first seen \n" : "")
 				+ "Hash: " + m.Hash
 			elem.appendChild(tooltip)
 			const nameTag = document.createElement("span")
 			const date = m.FirstSeen.slice(0, 10)
-			nameTag.appendChild(document.createTextNode(" " + m.FromNode + " "))
+			const sender = m.Petname != "" ? m.Petname : m.FromNode + (m.Alias ? " ~" + m.Alias : "")
+			nameTag.appendChild(document.createTextNode(" " + sender + " "))
 			nameTag.title = tooltip.title
 			elem.appendChild(nameTag)
 			if (m.SeqID == 0) {
@@ -110,6 +235,81 @@ function showMessages(container, messages, myName) {
 			} else {
 				elem.appendChild(document.createTextNode(m.Content))
 			}
+			if (m.ReplyTo) {
+				const reply = document.createElement("em")
+				reply.className = "status"
+				reply.appendChild(document.createTextNode("\u21aa"))
+				reply.title = "In reply to " + m.ReplyTo
+				elem.insertBefore(reply, nameTag)
+			}
+			Object.keys(m.Reactions || {}).forEach(reaction => {
+				const count = document.createElement("em")
+				count.className = "status"
+				count.appendChild(document.createTextNode(reaction + " " + m.Reactions[reaction].length))
+				count.title = m.Reactions[reaction].join(", ")
+				elem.appendChild(count)
+			})
+			if (m.Replies > 0) {
+				const replies = document.createElement("em")
+				replies.className = "status"
+				replies.appendChild(document.createTextNode(m.Replies + (m.Replies > 1 ? " replies" : " reply")))
+				elem.appendChild(replies)
+			}
+			if (m.SeqID > 0) {
+				const replyLink = document.createElement("a")
+				replyLink.className = "amend"
+				replyLink.appendChild(document.createTextNode("reply"))
+				$(replyLink).click(function() {
+					replyTo = m.Hash
+					$("#message").attr("placeholder", "Reply to: " + m.Content).focus()
+				})
+				elem.appendChild(replyLink)
+				const reactLink = document.createElement("a")
+				reactLink.className = "amend"
+				reactLink.appendChild(document.createTextNode("react"))
+				$(reactLink).click(function() {
+					const reaction = prompt("Reaction (an emoji)", "\ud83d\udc4d")
+					if (reaction) {
+						$.ajax({type: 'POST', url: "/reactions", data: JSON.stringify({Hash: m.Hash, Reaction: reaction}), contentType: "application/json"})
+					}
+				})
+				elem.appendChild(reactLink)
+			}
+			if (m.Edited) {
+				const edited = document.createElement("em")
+				edited.className = "status"
+				edited.appendChild(document.createTextNode("(edited)"))
+				edited.title = "Edited on " + m.Edited
+				elem.appendChild(edited)
+			}
+			if (m.FromNode == myName && m.SeqID > 0) {
+				const editLink = document.createElement("a")
+				editLink.className = "amend"
+				editLink.appendChild(document.createTextNode("edit"))
+				$(editLink).click(function() {
+					const content = prompt("New content of the message", m.Content)
+					if (content !== null) {
+						$.ajax({type: 'PUT', url: "/message/" + m.SeqID, data: JSON.stringify(content), contentType: "application/json"})
+					}
+				})
+				elem.appendChild(editLink)
+				const deleteLink = document.createElement("a")
+				deleteLink.className = "amend"
+				deleteLink.appendChild(document.createTextNode("delete"))
+				$(deleteLink).click(function() {
+					if (confirm("Delete this message on every node?")) {
+						$.ajax({type: 'DELETE', url: "/message/" + m.SeqID})
+					}
+				})
+				elem.appendChild(deleteLink)
+			}
+			if (m.Status) {
+				const status = document.createElement("em")
+				status.className = "status"
+				status.appendChild(document.createTextNode(m.Status == "read" ? "\u2713\u2713 read" : m.Status == "delivered" ? "\u2713\u2713" : "\u2713"))
+				status.title = m.Status
+				elem.appendChild(status)
+			}
 			container.appendChild(elem)
 		})
 	}	
@@ -120,9 +320,15 @@ function update() {
 		$.get("/id"),
 		$.get("/node"),
 		$.get("/message"),
-		$.get("/routes")
+		$.get("/routes?profiles=true"),
+		$.get("/contacts"),
+		$.get("/channels")
 	)
-	.then(function(id, nodes, messages, routes) {
+	.then(function(id, nodes, messages, routes, contacts, channels) {
+		const petnames = {}
+		JSON.parse(contacts[0]).forEach(c => {
+			petnames[c.Name] = c.Petname
+		})
 		const name = JSON.parse(id[0])
 		$(".nodeName").text(name)
 		
@@ -167,14 +373,68 @@ function update() {
 			})
 		}
 		
+		const channelBox = document.getElementById("channelContent")
+		if (channelBox !== null) {
+			channelBox.innerHTML = "<h2>Channels</h2>"
+			JSON.parse(channels[0]).forEach(channel => {
+				const elem = document.createElement("div")
+				const leaveButton = document.createElement("span")
+				leaveButton.appendChild(document.createTextNode("(X) "))
+				leaveButton.title = "Leave the channel"
+				$(leaveButton).click(function() {
+					$.ajax({
+						type: 'DELETE',
+						url: "/channels/" + channel.ID,
+						success: function() {
+							$('*[data-channel="' + channel.ID + '"]').remove()
+							update()
+						},
+						error: function() {
+							alert("Unable to leave the channel")
+						}
+					})
+				})
+				const selectChannel = document.createElement("span")
+				selectChannel.classList.add("button")
+				selectChannel.appendChild(document.createTextNode("#" + channel.Name + (channel.Encrypted ? " \ud83d\udd12" : "") + " (" + channel.Messages + ")"))
+				$(selectChannel).click(function() {
+					openChannel(channel)
+				})
+				elem.appendChild(leaveButton)
+				elem.appendChild(selectChannel)
+				channelBox.appendChild(elem)
+
+				$('div[data-channel="' + channel.ID + '"]').each(function() {
+					const that = $(this)
+					$.get("/channels/" + channel.ID + "/messages", function(result) {
+						showMessages(that.get(0), JSON.parse(result), name)
+					})
+				})
+			})
+		}
+
 		const routeBox = document.getElementById("routeContent")
 		if (routeBox !== null) {
 			routeBox.innerHTML = "<h2>Known nodes</h2>"
-			JSON.parse(routes[0]).forEach(route => {
+			JSON.parse(routes[0]).forEach(node => {
+				const route = node.Name
+				const profile = node.Profile
 				const elem = document.createElement("div")
 				const selectNode = document.createElement("span")
 				selectNode.classList.add("button")
-				selectNode.appendChild(document.createTextNode(route))
+				if (profile && profile.Avatar) {
+					const avatar = document.createElement("img")
+					avatar.src = profile.Avatar
+					avatar.className = "avatar"
+					selectNode.appendChild(avatar)
+				}
+				const label = petnames[route] || (profile && profile.Nickname)
+				selectNode.appendChild(document.createTextNode(label ? label + " (" + route + ")" : route))
+				if (profile) {
+					selectNode.title = (profile.Nickname ? "Nickname (chosen by the node): " + profile.Nickname + " \n" : "")
+						+ (profile.Status ? "Status: " + profile.Status + " \n" : "")
+						+ "Profile published on " + profile.Updated
+				}
 				$(selectNode).click(function() {
 					if (!$('*[data-nodename="'+ route +'"]').exists()) {
 						$("#tabs ul").append('<li data-nodename="' + route + '"><a href="#tabs-' + tabCounter + '">' + route + '</a> <span>x&nbsp;</span></li></ul>')
@@ -4,21 +4,64 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/skip2/go-qrcode"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // InitializeWebServer spawns an HTTP request handler on another thread.
-func InitializeWebServer(port int) {
+// The returned server can be used to stop accepting requests when the node shuts down.
+func InitializeWebServer(config WebConfig) (*http.Server, error) {
 	r := http.NewServeMux()
-	r.HandleFunc("/message", handleMessages) // Asynchronous (due to proof-of-work)
+	r.HandleFunc("/message", handle(handleAs(handleMessages)))
+	r.HandleFunc("/message/", handle(handleAs(handleAmendments)))
 	r.HandleFunc("/node", handle(handleNodes))
-	r.HandleFunc("/id", handle(handleId))
+	r.HandleFunc("/id", handle(handleAs(handleId)))
+	r.HandleFunc("/id/qr", handle(handleAs(handleIdQRCode)))
+	r.HandleFunc("/identities", handle(handleIdentities))
+	r.HandleFunc("/session", handle(handleAs(handleSession)))
 	r.HandleFunc("/routes", handle(handleRoutes))
-	r.HandleFunc("/privateMessage", handlePrivateMessages)
-	r.Handle("/", http.FileServer(http.Dir("webclient")))
-	go http.ListenAndServe("localhost:"+fmt.Sprint(port), r)
+	r.HandleFunc("/replication", handle(handleReplication))
+	r.HandleFunc("/privateMessage", handle(handleAs(handlePrivateMessages)))
+	r.HandleFunc("/privateMessage/read", handle(handleAs(handleMarkRead)))
+	r.HandleFunc("/devices", handle(handleAs(handleDevices)))
+	r.HandleFunc("/devices/", handle(handleAs(handleDevices)))
+	r.HandleFunc("/jobs", handle(handleAs(handleJobs)))
+	r.HandleFunc("/jobs/", handle(handleAs(handleJobs)))
+	r.HandleFunc("/outbox", handle(handleAs(handleOutbox)))
+	r.HandleFunc("/outbox/", handle(handleAs(handleOutbox)))
+	r.HandleFunc("/search", handle(handleAs(handleSearch)))
+	r.HandleFunc("/thread/", handle(handleAs(handleThread)))
+	r.HandleFunc("/reactions", handle(handleAs(handleReactions)))
+	r.HandleFunc("/preferences", handle(handleAs(handlePreferences)))
+	r.HandleFunc("/contacts", handle(handleAs(handleContacts)))
+	r.HandleFunc("/contacts/", handle(handleAs(handleContacts)))
+	r.HandleFunc("/channels", handleAs(handleSubscribe))
+	r.HandleFunc("/channels/", handle(handleAs(handleChannels)))
+	r.HandleFunc("/aliases", handle(handleAs(handleAliases)))
+	r.HandleFunc("/aliases/", handle(handleAs(handleAliases)))
+	r.HandleFunc("/profile", handle(handleAs(handleProfile)))
+	r.HandleFunc("/profile/", handle(handleAs(handleProfile)))
+	r.HandleFunc("/safetyNumber", handle(handleAs(handleSafetyNumber)))
+	r.HandleFunc("/safetyNumber/qr", handle(handleAs(handleSafetyNumber)))
+	r.HandleFunc("/safetyNumber/verify", handle(handleAs(handleVerify)))
+	r.HandleFunc("/events", handleAs(handleEvents)) // Long-lived connection (server-sent events)
+	r.Handle("/", http.FileServer(http.Dir(config.StaticDir)))
+	listener, err := net.Listen("tcp", config.ListenAddress+":"+fmt.Sprint(config.Port))
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: r}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			LogWeb.Errorf("the web server has stopped: %s", err.Error())
+		}
+	}()
+	return server, nil
 }
 
 // handle wraps a handler so that it gets processed on the main event loop.
@@ -31,8 +74,8 @@ func handle(callback func(http.ResponseWriter, *http.Request)) func(http.Respons
 			// Enable CORS for all requests
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			if r.Method == "OPTIONS" {
-				w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "origin, content-type, accept")
+				w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PUT, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "origin, content-type, accept, "+IDENTITY_HEADER)
 				w.WriteHeader(http.StatusOK)
 			} else {
 				callback(w, r)
@@ -41,6 +84,34 @@ func handle(callback func(http.ResponseWriter, *http.Request)) func(http.Respons
 	}
 }
 
+// handleAs wraps a handler that acts on behalf of a local identity. The identity is selected by the X-Identity header,
+// the "identity" query parameter or the "identity" cookie (see handleSession), in this order, and can be given
+// as a name or as a label. The default identity is used if none is selected, and unknown identities are rejected
+// with a 400 Bad Request status. The identities do not change while the node runs, so this can be called from
+// any thread.
+func handleAs(callback func(http.ResponseWriter, *http.Request, *LocalIdentity)) func(http.ResponseWriter,
+	*http.Request) {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ref := r.Header.Get(IDENTITY_HEADER)
+		if ref == "" {
+			ref = r.URL.Query().Get("identity")
+		}
+		if cookie, err := r.Cookie(IDENTITY_COOKIE); ref == "" && err == nil {
+			ref = cookie.Value
+		}
+		id := Context.DefaultIdentity()
+		if ref != "" {
+			if id = Context.LookupIdentity(ref); id == nil {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		callback(w, r, id)
+	}
+}
+
 // safeDecode safely decodes an AJAX request in JSON format.
 // If an error is detected, a 400 Bad Request status is returned.
 func safeDecode(w http.ResponseWriter, r *http.Request, out interface{}) error {
@@ -66,153 +137,1197 @@ type MessageLogEntry struct {
 	FromAddress string
 	Content     string
 	Hash        string
+	TTL         uint32              // Lifetime in seconds, counted from FirstSeen (0 = no expiry)
+	Identity    string              // Identity of the sender (FromNode, unless it is a linked device)
+	Petname     string              // Petname of the sender in the contacts of the identity (empty if unknown)
+	Alias       string              // Alias registered by the identity of the sender (not self-authenticating, see AliasRegistry)
+	Read        bool                // Only for the private messages received by this identity: marked as read (on any device)
+	Status      string              // Only for the private messages sent by this identity: "sent", "delivered" or "read"
+	Edited      string              // Date on which the latest edit of the message was first seen (empty if never edited)
+	ReplyTo     string              // Hash of the message answered by this message (empty if it is not a reply)
+	Replies     int                 // Number of replies to this message
+	Reactions   map[string][]string // Identities that have reacted to this message, by reaction
+	Channel     string              // ID of the channel of the message (empty for the main public room)
 }
 
-func ConvertMessageFormat(m *MessageRecord) *MessageLogEntry {
+// ConvertMessageFormat converts a message for the client, as seen by the given local identity.
+func ConvertMessageFormat(m *MessageRecord, id *LocalIdentity) *MessageLogEntry {
 	out := &MessageLogEntry{}
 	out.FirstSeen = m.DateSeen
 	out.FromAddress = m.FromAddress
 	out.FromNode = m.Data.Origin
 	out.SeqID = m.Data.ID
+	out.TTL = m.Data.TTL
+	out.Identity = Context.Devices.IdentityOf(m.Data.Origin)
+	out.Petname = id.Contacts.Petname(m.Data.Origin)
+	if aliases := Context.Aliases.AliasesOf(m.Data.Origin); len(aliases) > 0 {
+		out.Alias = aliases[0]
+	}
+	var replyTo []byte
 	if out.SeqID == 0 {
 		// Special message (public key announcement)
 		out.Content = "joined the network for the first time and announced its public key."
+	} else if len(m.Data.Channel) > 0 {
+		// Message of a channel (encrypted if the channel has a password)
+		out.Channel = hex.EncodeToString(m.Data.Channel)
+		if text, err := id.readChannelContent(m); err == errNotSubscribed {
+			out.Content = "*** Message of a channel to which you are not subscribed ***"
+		} else if err != nil {
+			out.Content = "*** Unable to decrypt the message (wrong channel password?) ***"
+		} else {
+			out.Content, replyTo = messageText(m.Data.Kind, text)
+		}
 	} else if m.Data.Destination == "" {
 		// Public message (not encrypted, only signed)
-		out.Content = string(m.Data.Content)
+		out.Content, replyTo = messageText(m.Data.Kind, m.Data.Content)
 	} else {
 		// Regular encrypted private message
-		if len(m.Data.Content) < 2 {
+		text, err := id.DecryptContent(&m.Data)
+		if err == errMalformedContent {
 			// The message is unintelligible
 			out.Content = "*** Unable to decrypt the message (malformed data) ***"
+		} else if err != nil {
+			// The message is unintelligible
+			out.Content = "*** Unable to decrypt the message (the sender used a wrong key?) ***"
 		} else {
-			splitPoint := binary.LittleEndian.Uint16(m.Data.Content[:2])
-			if int(splitPoint) >= len(m.Data.Content) {
-				out.Content = "*** Unable to decrypt the message (malformed data) ***"
-			} else {
-				var text []byte
-				var err error
-				if out.FromNode == Context.DisplayName {
-					// The message has been sent by us
-					text, err = Context.PrivateKey.Decrypt(m.Data.Content[2:2+splitPoint])
-				} else {
-					// The message has been sent by the other node
-					text, err = Context.PrivateKey.Decrypt(m.Data.Content[2+splitPoint:])
-				}
-				if err == nil {
-					out.Content = string(text)
-				} else {
-					// The message is unintelligible
-					out.Content = "*** Unable to decrypt the message (the sender used a wrong key?) ***"
-				}
-			}
+			out.Content, replyTo = messageText(m.Data.Kind, text)
 		}
 	}
+	if edit, found := id.Edits.Get(messageKey{m.Data.Origin, m.Data.ID}); found {
+		out.Content = edit.Content
+		out.Edited = edit.Date
+	}
 	out.Hash = hex.EncodeToString(m.Data.ComputeHash())
+	if replyTo != nil {
+		out.ReplyTo = hex.EncodeToString(replyTo)
+	}
+	if conversation, readable := id.conversationOf(m); readable {
+		out.Replies = len(id.Threads.Replies(out.Hash, conversation))
+		out.Reactions = id.Threads.Reactions(out.Hash, conversation)
+	}
 	return out
 }
 
 // handleMessages sends the list of messages to the client, or inserts a new message.
-func handleMessages(w http.ResponseWriter, r *http.Request) {
+func handleMessages(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
 	switch r.Method {
 	case "GET":
-		w.WriteHeader(http.StatusOK)
-		var log []*MessageLogEntry
-		Context.RunSync(func() {
-
-			messages := Context.Database.GetAllMessagesTo("")
-			log = make([]*MessageLogEntry, 0)
-			for _, m := range messages {
-				log = append(log, ConvertMessageFormat(m))
+		messages, err := Context.Database.GetAllMessagesTo("")
+		if err != nil {
+			ReportError(LogWeb, "unable to load messages", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log := make([]*MessageLogEntry, 0)
+		for _, m := range messages {
+			if isTextKind(m.Data.Kind) {
+				log = append(log, ConvertMessageFormat(m, id))
 			}
-
-		})
+		}
+		w.WriteHeader(http.StatusOK)
 		data, _ := json.Marshal(log)
 		w.Write(data)
 
 	case "POST":
-		// The insertion of a new message is asynchronous because of the proof-of-work computation
+		// The message is queued, since the proof-of-work computation can take a long time
 		var msg string
 		err := safeDecode(w, r, &msg)
 		if err == nil {
+			LogWeb.Infof("PUBLIC MESSAGE FROM CLIENT: %s", Text(msg))
+			submitJob(w, r, id, &OutgoingMessage{Content: msg})
+		}
 
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
 
-			fmt.Printf("PUBLIC MESSAGE FROM CLIENT: %s\n", msg)
-			id, err := Context.AddNewMessage(msg, "") // Blocking on this thread, but not on the main thread
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			Context.RunSync(func() {
-				rumorMsg := Context.BuildRumorMessage(Context.DisplayName, id)
-				randomPeer := Context.RandomPeer([]string{})
-				if randomPeer != "" {
-					fmt.Printf("MONGERING with %s\n", randomPeer)
-					startRumormongering(rumorMsg, randomPeer)
-				}
-			})
+// handleAmendments edits (PUT /message/{ref}, with the new content as a JSON string) or deletes
+// (DELETE /message/{ref}) a text message sent by the selected identity from this device, public or private.
+// The message is given by its ID or by its hash (in hexadecimal). The response contains the corresponding send job.
+func handleAmendments(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	var ref MessageRef
+	path := strings.TrimPrefix(r.URL.Path, "/message/")
+	if seqID, err := strconv.ParseUint(path, 10, 32); err == nil {
+		ref.ID = uint32(seqID)
+	} else if ref.Hash, err = hex.DecodeString(path); err != nil || len(ref.Hash) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	target, err := ref.Resolve(id.DisplayName)
+	if err == errUnresolvedRef || (err == nil && (target.Data.Origin != id.DisplayName || target.Pruned)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		ReportError(LogWeb, "unable to load the message", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !isTextKind(target.Data.Kind) || target.Data.ID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-			w.WriteHeader(http.StatusOK)
+	var job Job
+	switch r.Method {
+	case "PUT":
+		var content string
+		if err := safeDecode(w, r, &content); err != nil {
+			return
 		}
-
+		LogWeb.Infof("EDIT OF MESSAGE %d FROM CLIENT: %s", target.Data.ID, Text(content))
+		job, err = id.EditMessage(target, content)
+	case "DELETE":
+		LogWeb.Infof("DELETION OF MESSAGE %d FROM CLIENT", target.Data.ID)
+		job, err = id.DeleteMessage(target)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err == ErrLegacyFormat {
+		w.WriteHeader(http.StatusConflict)
+		return
+	} else if err != nil {
+		ReportError(LogWeb, "unable to store the message in the outbox", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(job)
+	w.Write(data)
+}
+
+// handleThread sends the thread that contains a message, given by its hash (GET /thread/{hash}): the first message
+// of the thread, followed by all the replies, in the same format as GET /message. Works for public and private
+// messages readable by the selected identity.
+func handleThread(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	messages, err := id.Threads.Thread(strings.TrimPrefix(r.URL.Path, "/thread/"))
+	if err == errUnresolvedRef {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		ReportError(LogWeb, "unable to load the thread", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log := make([]*MessageLogEntry, 0, len(messages))
+	for _, m := range messages {
+		log = append(log, ConvertMessageFormat(m, id))
+	}
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(log)
+	w.Write(data)
+}
+
+// handleReactions publishes a reaction of the selected identity (POST /reactions, with {"Hash": ..., "Reaction": ...},
+// and "Removed": true to withdraw the reaction). The response contains the corresponding send job.
+func handleReactions(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	type ReactionRequest struct {
+		Hash     string
+		Reaction string
+		Removed  bool
+	}
+
+	var request ReactionRequest
+	if err := safeDecode(w, r, &request); err != nil {
+		return
+	}
+	reaction := Reaction{Reaction: request.Reaction, Removed: request.Removed}
+	if err := ValidateReaction(&reaction); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	LogWeb.Infof("REACTION FROM CLIENT: %s", Text(reaction.Reaction))
+	job, err := id.React(request.Hash, reaction)
+	if err == errUnresolvedRef {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		ReportError(LogWeb, "unable to store the message in the outbox", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(job)
+	w.Write(data)
+}
+
+// submitJob queues a new text message (destination, channel and content) composed by the client on behalf of a local
+// identity, and sends the corresponding job to the client. The lifetime of the message (in seconds) can be given in
+// the "ttl" query parameter, and the hash of the message it answers in the "replyTo" query parameter.
+func submitJob(w http.ResponseWriter, r *http.Request, id *LocalIdentity, m *OutgoingMessage) {
+	var ttl uint64
+	if ttlStr := r.URL.Query().Get("ttl"); ttlStr != "" {
+		var err error
+		if ttl, err = strconv.ParseUint(ttlStr, 10, 32); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if replyTo := r.URL.Query().Get("replyTo"); replyTo != "" {
+		var err error
+		if m, err = id.ReplyTo(replyTo, m.Destination, m.Channel, m.Content); err == errUnresolvedRef {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	m.TTL = uint32(ttl)
+	job, err := id.Jobs.Submit(m)
+	if err != nil {
+		ReportError(LogWeb, "unable to store the message in the outbox", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(job)
+	w.Write(data)
+}
+
+// logPowProgress reports the progress of a proof-of-work computation in the log.
+func logPowProgress(p PowProgress) {
+	if !p.Done {
+		LogPow.Debugf("%d tries (%.0f tries/s), about %s left", p.Tries, p.Rate, p.ETA.Round(time.Second))
+	}
+}
+
+// spreadNewMessage starts rumormongering a message of a local identity with a random peer.
+func spreadNewMessage(origin string, id uint32) error {
+	rumorMsg, err := Context.BuildRumorMessage(origin, id)
+	if err != nil {
+		return err
+	}
+	randomPeer := Context.RandomPeer([]string{})
+	if randomPeer != "" {
+		LogGossip.Debugf("MONGERING with %s", Addr(randomPeer))
+		return startRumormongering(rumorMsg, randomPeer)
+	}
+	return nil
 }
 
 // handlePrivateMessages handles direct messages between nodes.
-func handlePrivateMessages(w http.ResponseWriter, r *http.Request) {
+func handlePrivateMessages(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
 	switch r.Method {
 	case "GET":
-		w.WriteHeader(http.StatusOK)
-		var log []*MessageLogEntry
-		Context.RunSync(func() {
-
-			origin := r.URL.Query().Get("name")
-			messages := Context.Database.GetAllMessagesBetween(origin, Context.DisplayName)
-			log = make([]*MessageLogEntry, 0)
-			for _, m := range messages {
-				log = append(log, ConvertMessageFormat(m))
+		// The conversation includes the messages of all the devices of both identities
+		origin := r.URL.Query().Get("name")
+		messages, err := id.Conversation(origin)
+		if err != nil {
+			ReportError(LogWeb, "unable to load private messages", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		marks, err := id.ReadMarks()
+		if err != nil {
+			ReportError(LogWeb, "unable to load the read marks", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log := make([]*MessageLogEntry, 0)
+		for _, m := range messages {
+			entry := ConvertMessageFormat(m, id)
+			entry.Read = !id.IsMine(m.Data.Origin) && m.Data.ID < marks[m.Data.Origin]
+			if id.IsMine(m.Data.Origin) {
+				receipt, err := Context.Database.GetReceipt(m.Data.Origin, m.Data.ID)
+				ReportError(LogWeb, "unable to load the receipts of a message", err)
+				entry.Status = receipt.Status()
 			}
-
-		})
+			log = append(log, entry)
+		}
+		w.WriteHeader(http.StatusOK)
 		data, _ := json.Marshal(log)
 		w.Write(data)
 
 	case "POST":
-		// The insertion of a new message is asynchronous because of the proof-of-work computation
-		type OutgoingMessage struct {
+		// The message is queued, since the proof-of-work computation can take a long time
+		type PrivateMessageRequest struct {
 			Destination string
 			Content     string
 		}
 
-		var msg OutgoingMessage
+		var msg PrivateMessageRequest
 		err := safeDecode(w, r, &msg)
 		if err == nil {
+			// Messages are addressed to identities (and encrypted for all their devices)
+			msg.Destination = Context.Devices.IdentityOf(msg.Destination)
+			LogWeb.Infof("PRIVATE MESSAGE FROM CLIENT TO %s", Name(msg.Destination))
+
+			// Reject the message immediately if the recipient is unknown
+			if _, err := Context.GetPublicKeyOf(msg.Destination); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			submitJob(w, r, id, &OutgoingMessage{Destination: msg.Destination, Content: msg.Content})
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePreferences sends the preferences of the selected identity (GET), or replaces them (PUT).
+func handlePreferences(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	switch r.Method {
+	case "GET":
+		preferences, err := Context.Database.GetPreferences(id.DisplayName)
+		if err != nil {
+			ReportError(LogWeb, "unable to load the preferences", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(preferences)
+		w.Write(data)
+
+	case "PUT":
+		preferences := DefaultPreferences()
+		if err := safeDecode(w, r, &preferences); err != nil {
+			return
+		}
+		if err := Context.Database.PutPreferences(id.DisplayName, &preferences); err != nil {
+			ReportError(LogWeb, "unable to store the preferences", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(preferences)
+		w.Write(data)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMarkRead marks the messages received from an identity as read (POST /privateMessage/read
+// with {"Name": ...}). The read marks are synchronized with the other devices of this identity.
+func handleMarkRead(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	type MarkReadRequest struct {
+		Name string
+	}
+
+	var request MarkReadRequest
+	if err := safeDecode(w, r, &request); err != nil {
+		return
+	}
+	if err := id.MarkConversationRead(request.Name); err != nil {
+		ReportError(LogWeb, "unable to mark the conversation as read", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleDevices manages the devices of this identity: GET /devices lists them, POST /devices (with {"Name": ...})
+// links a device, DELETE /devices/{name} revokes it, and POST /devices/claim (with {"Primary": ...}) declares
+// that this node is a device of another identity. Links and claims are published as messages, so the responses
+// contain the corresponding send jobs.
+func handleDevices(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/devices"), "/")
+	switch {
+	case path == "" && r.Method == "GET":
+		type DeviceList struct {
+			Identity string // Identity of this node
+			Device   string // Name of this node
+			Devices  []DeviceInfo
+		}
+
+		w.WriteHeader(http.StatusOK)
+		identity := id.Primary()
+		data, _ := json.Marshal(DeviceList{identity, id.DisplayName, Context.Devices.DevicesOf(identity)})
+		w.Write(data)
+
+	case path == "" && r.Method == "POST":
+		type LinkRequest struct {
+			Name string
+		}
+
+		var request LinkRequest
+		if err := safeDecode(w, r, &request); err != nil {
+			return
+		}
+		// Only primary devices can link other devices
+		if id.Primary() != id.DisplayName || len(request.Name) != DISPLAY_NAME_BITS/5 ||
+			request.Name == id.DisplayName {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		submitDeviceMessage(w, id, KIND_DEVICE_LINK, request.Name)
+
+	case path == "claim" && r.Method == "POST":
+		type ClaimRequest struct {
+			Primary string
+		}
+
+		var request ClaimRequest
+		if err := safeDecode(w, r, &request); err != nil {
+			return
+		}
+		if len(request.Primary) != DISPLAY_NAME_BITS/5 || request.Primary == id.DisplayName {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		submitDeviceMessage(w, id, KIND_DEVICE_CLAIM, request.Primary)
+
+	case path != "" && path != "claim" && r.Method == "DELETE":
+		if id.Primary() != id.DisplayName {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		submitDeviceMessage(w, id, KIND_DEVICE_UNLINK, path)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// submitDeviceMessage queues a public device link, unlink or claim message.
+func submitDeviceMessage(w http.ResponseWriter, id *LocalIdentity, kind uint32, name string) {
+	LogWeb.Infof("DEVICE MESSAGE (kind %d) FROM CLIENT FOR %s", kind, Name(name))
+	job, err := id.Jobs.Submit(&OutgoingMessage{Kind: kind, Content: name})
+	if err != nil {
+		ReportError(LogWeb, "unable to store the message in the outbox", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	data, _ := json.Marshal(job)
+	w.Write(data)
+}
+
+// handleSearch searches the messages readable by a local identity (GET /search?q=...). The results can be filtered
+// by origin ("origin"), conversation ("conversation": a node name, "public", or "#" followed by a channel), and by
+// the date on which they were first seen ("since" and "until": RFC 3339 dates, or days in YYYY-MM-DD format, both
+// inclusive). The number of results can be limited with "limit".
+func handleSearch(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	query := SearchQuery{
+		Terms:        Tokenize(params.Get("q")),
+		Origin:       params.Get("origin"),
+		Conversation: params.Get("conversation"),
+	}
+	if strings.HasPrefix(query.Conversation, CHANNEL_CONVERSATION_PREFIX) {
+		channelID, err := ParseChannelRef(strings.TrimPrefix(query.Conversation, CHANNEL_CONVERSATION_PREFIX))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query.Conversation = channelConversation(channelID)
+	} else if query.Conversation != "" && query.Conversation != PUBLIC_CONVERSATION {
+		query.Conversation = Context.Devices.IdentityOf(query.Conversation)
+	}
+	var err error
+	if query.Since, err = parseSearchDate(params.Get("since"), false); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if query.Until, err = parseSearchDate(params.Get("until"), true); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if limitStr := params.Get("limit"); limitStr != "" {
+		if query.Limit, err = strconv.Atoi(limitStr); err != nil || query.Limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if len(query.Terms) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results, err := id.Search.Search(query)
+	if err != nil {
+		ReportError(LogWeb, "unable to rebuild the search index", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log := make([]*MessageLogEntry, 0)
+	for _, key := range results {
+		m, err := Context.Database.GetMessage(key.Origin, key.ID)
+		if err != nil {
+			ReportError(LogWeb, "unable to load messages", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if m != nil {
+			log = append(log, ConvertMessageFormat(m, id))
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(log)
+	w.Write(data)
+}
+
+// parseSearchDate parses a date filter of a search (zero if empty). If end is true, the returned time
+// is the end of the given day or second, so that it can be used as an exclusive upper bound.
+func parseSearchDate(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil && end {
+		t = t.Add(time.Second)
+	}
+	return t, err
+}
+
+// handleContacts manages the address book of a local identity: GET /contacts lists the contacts, GET, PUT (with
+// {"Petname": ..., "Notes": ..., "Verified": ...}) and DELETE /contacts/{name} read, create/replace and remove
+// a contact. GET /contacts/export downloads the address book, and POST /contacts/import (with a list of contacts)
+// merges a list of contacts into it (existing contacts are replaced, unless "replace=false" is given).
+func handleContacts(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/contacts"), "/")
+	switch {
+	case path == "" && r.Method == "GET":
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(id.Contacts.List())
+		w.Write(data)
+
+	case path == "export" && r.Method == "GET":
+		w.Header().Set("Content-Disposition", "attachment; filename=\"contacts.json\"")
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.MarshalIndent(id.Contacts.List(), "", "  ")
+		w.Write(data)
+
+	case path == "import" && r.Method == "POST":
+		type ImportResult struct {
+			Imported int
+			Skipped  int // Invalid contacts, or petnames already used by other contacts
+		}
+
+		var contacts []Contact
+		if err := safeDecode(w, r, &contacts); err != nil {
+			return
+		}
+		imported, skipped, err := id.Contacts.Import(contacts, r.URL.Query().Get("replace") != "false")
+		if err != nil {
+			ReportError(LogWeb, "unable to import the contacts", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(ImportResult{imported, skipped})
+		w.Write(data)
+
+	case path == "" || path == "export" || path == "import":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+	case r.Method == "GET":
+		contact, found := id.Contacts.Get(path)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(contact)
+		w.Write(data)
+
+	case r.Method == "PUT":
+		var contact Contact
+		if err := safeDecode(w, r, &contact); err != nil {
+			return
+		}
+		contact.Name = path
+		if existing, found := id.Contacts.Get(path); found {
+			// Only VerifyContact records safety-number checks
+			contact.LastVerified = existing.LastVerified
+		} else {
+			contact.LastVerified = ""
+		}
+		if err := ValidateContact(&contact); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := id.Contacts.Put(contact); err == ErrPetnameTaken {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(err.Error()))
+			return
+		} else if err != nil {
+			ReportError(LogWeb, "unable to store the contact", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		contact, _ = id.Contacts.Get(path)
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(contact)
+		w.Write(data)
+
+	case r.Method == "DELETE":
+		if found, err := id.Contacts.Delete(path); err != nil {
+			ReportError(LogWeb, "unable to delete the contact", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		} else if !found {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSubscribe subscribes the selected identity to a channel (POST /channels, see handleChannels), and passes the
+// other requests to handleChannels. Unlike the other handlers, it does not run on the main thread: the key of an
+// encrypted channel is derived first (see ChannelKey, which is expensive), and only the subscription is stored
+// on the main thread.
+func handleSubscribe(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "POST" {
+		handle(func(w http.ResponseWriter, r *http.Request) {
+			handleChannels(w, r, id)
+		})(w, r)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	type SubscriptionRequest struct {
+		Name     string
+		Password string // Empty if the channel is not encrypted
+	}
 
-			fmt.Printf("PRIVATE MESSAGE FROM CLIENT TO %s\n", msg.Destination)
+	var request SubscriptionRequest
+	if err := safeDecode(w, r, &request); err != nil {
+		return
+	}
+	name, err := NormalizeChannelName(request.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var key []byte
+	if request.Password != "" {
+		key = ChannelKey(ChannelID(name), request.Password)
+	}
+
+	Context.RunSync(func() {
+		LogWeb.Infof("SUBSCRIPTION TO CHANNEL #%s FROM CLIENT", Text(name))
+		channel, err := id.Channels.Subscribe(name, key)
+		if err != nil {
+			ReportError(LogWeb, "unable to subscribe to the channel", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(id.Channels.Info(channel.ID, ChannelActivity{}))
+		w.Write(data)
+	})
+}
 
-			id, err := Context.AddNewMessage(msg.Content, msg.Destination) // Blocking on this thread, but not on the main thread
+// handleChannels manages the channels of the selected identity: GET /channels lists the channels to which it is
+// subscribed (and the other channels that have messages, with "all=true"), POST /channels (with {"Name": ...,
+// "Password": ...}) subscribes to a channel, and GET and DELETE /channels/{channel} describe a channel and unsubscribe
+// from it. GET /channels/{channel}/messages returns the messages of a channel (in the same format as GET /message),
+// and POST /channels/{channel}/messages (with a JSON string) sends a message to it. Channels are given by their ID
+// (in hexadecimal) or by their name.
+func handleChannels(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/channels"), "/")
+	if path == "" {
+		switch r.Method {
+		case "GET":
+			channels, err := id.Channels.All(r.URL.Query().Get("all") == "true")
 			if err != nil {
+				ReportError(LogWeb, "unable to load the channels", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
-			Context.RunSync(func() {
-				rumorMsg := Context.BuildRumorMessage(Context.DisplayName, id)
-				randomPeer := Context.RandomPeer([]string{})
-				if randomPeer != "" {
-					fmt.Printf("MONGERING with %s\n", randomPeer)
-					startRumormongering(rumorMsg, randomPeer)
-				}
-			})
 			w.WriteHeader(http.StatusOK)
+			data, _ := json.Marshal(channels)
+			w.Write(data)
+
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	ref := strings.TrimSuffix(path, "/messages")
+	channelID, err := ParseChannelRef(ref)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	switch {
+	case ref == path && r.Method == "GET":
+		channels, err := id.Channels.All(true)
+		if err != nil {
+			ReportError(LogWeb, "unable to load the channels", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		info := id.Channels.Info(channelID, ChannelActivity{})
+		for _, channel := range channels {
+			if channel.ID == info.ID {
+				info = channel
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(info)
+		w.Write(data)
+
+	case ref == path && r.Method == "DELETE":
+		if err := id.Channels.Unsubscribe(channelID); err == errNotSubscribed {
+			w.WriteHeader(http.StatusNotFound)
+		} else if err != nil {
+			ReportError(LogWeb, "unable to unsubscribe from the channel", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+
+	case ref != path && r.Method == "GET":
+		messages, err := id.ChannelMessages(channelID)
+		if err == errNotSubscribed {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			ReportError(LogWeb, "unable to load the messages of the channel", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		log := make([]*MessageLogEntry, 0, len(messages))
+		for _, m := range messages {
+			log = append(log, ConvertMessageFormat(m, id))
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(log)
+		w.Write(data)
+
+	case ref != path && r.Method == "POST":
+		if _, found := id.Channels.Get(channelID); !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var msg string
+		if err := safeDecode(w, r, &msg); err == nil {
+			LogWeb.Infof("CHANNEL MESSAGE FROM CLIENT: %s", Text(msg))
+			submitJob(w, r, id, &OutgoingMessage{Channel: hex.EncodeToString(channelID), Content: msg})
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAliases manages the aliases registered on the network: GET /aliases lists them (or only the aliases of an
+// identity, with "name"), GET /aliases/{alias} returns the owner of an alias, and POST /aliases (with
+// {"Alias": ...}) registers an alias for the selected identity. Registrations are published as messages, so the
+// response contains the corresponding send job.
+func handleAliases(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/aliases"), "/")
+	switch {
+	case path == "" && r.Method == "GET":
+		aliases := Context.Aliases.All()
+		if name := r.URL.Query().Get("name"); name != "" {
+			aliases = make([]AliasInfo, 0)
+			for _, alias := range Context.Aliases.AliasesOf(name) {
+				info, _ := Context.Aliases.Lookup(alias)
+				aliases = append(aliases, info)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(aliases)
+		w.Write(data)
+
+	case path == "" && r.Method == "POST":
+		type AliasRequest struct {
+			Alias string
+		}
+
+		var request AliasRequest
+		if err := safeDecode(w, r, &request); err != nil {
+			return
 		}
+		alias, err := NormalizeAlias(request.Alias)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if _, found := Context.Aliases.Lookup(alias); found {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		LogWeb.Infof("ALIAS REGISTRATION FROM CLIENT: %s", Text(alias))
+		job, err := id.Jobs.Submit(&OutgoingMessage{Kind: KIND_ALIAS, Content: alias})
+		if err != nil {
+			ReportError(LogWeb, "unable to store the message in the outbox", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		data, _ := json.Marshal(job)
+		w.Write(data)
+
+	case path != "" && r.Method == "GET":
+		info, found := Context.Aliases.Lookup(path)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(info)
+		w.Write(data)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleProfile manages the profiles of the nodes: GET /profile/{name} returns the latest profile of a node (or of
+// its identity), and GET /profile/{name}/avatar its avatar. GET /profile returns the profile of the selected identity,
+// and PUT /profile (with {"Nickname": ..., "Status": ..., "Avatar": ...}, the avatar being encoded in base64)
+// publishes a new profile, which replaces the previous one; the response contains the corresponding send job.
+func handleProfile(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/profile"), "/")
+	switch {
+	case path == "" && r.Method == "PUT":
+		var profile Profile
+		if err := safeDecode(w, r, &profile); err != nil {
+			return
+		}
+		if err := ValidateProfile(&profile); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		LogWeb.Infof("PROFILE FROM CLIENT: %s", Text(profile.Nickname))
+		job, err := id.PublishProfile(profile)
+		if err != nil {
+			ReportError(LogWeb, "unable to store the message in the outbox", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		data, _ := json.Marshal(job)
+		w.Write(data)
+
+	case strings.HasSuffix(path, "/avatar") && r.Method == "GET":
+		_, profile, found := Context.Profiles.Get(strings.TrimSuffix(path, "/avatar"))
+		if !found || len(profile.Avatar) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(profile.Avatar))
+		w.WriteHeader(http.StatusOK)
+		w.Write(profile.Avatar)
+
+	case r.Method == "GET":
+		name := path
+		if name == "" {
+			name = id.DisplayName
+		}
+		info, found := Context.Profiles.Info(name)
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(info)
+		w.Write(data)
 
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// handleSafetyNumber sends the safety number of the selected identity and another identity (GET /safetyNumber?name=...),
+// or the same safety number as a QR code (GET /safetyNumber/qr?name=...).
+func handleSafetyNumber(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	contact, number, err := id.SafetyNumberWith(r.URL.Query().Get("name"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Path == "/safetyNumber/qr" {
+		writeQRCode(w, number)
+		return
+	}
+
+	type SafetyNumberInfo struct {
+		Name         string // Identity of the contact
+		SafetyNumber string
+		Verified     bool   // Recorded in the contacts
+		LastVerified string // Date of the last check (empty if never checked)
+	}
+
+	info := SafetyNumberInfo{Name: contact, SafetyNumber: number}
+	if c, found := id.Contacts.Get(contact); found {
+		info.Verified = c.Verified
+		info.LastVerified = c.LastVerified
+	}
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(info)
+	w.Write(data)
+}
+
+// handleVerify checks a code obtained from another identity out-of-band (POST /safetyNumber/verify with
+// {"Name": ..., "Code": ...}), which is either its identity code (see GET /id/qr) or its safety number, and records
+// the result in the contacts.
+func handleVerify(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	type VerifyRequest struct {
+		Name string // Can be omitted for identity codes
+		Code string
+	}
+	type VerifyResult struct {
+		Name     string
+		Verified bool
+	}
+
+	var request VerifyRequest
+	if err := safeDecode(w, r, &request); err != nil {
+		return
+	}
+	name, verified, err := id.VerifyContact(request.Name, request.Code)
+	if err == ErrUnknownKey {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil && name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		ReportError(LogWeb, "unable to record the verification", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	LogWeb.Infof("VERIFICATION OF %s: %t", Name(name), verified)
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(VerifyResult{name, verified})
+	w.Write(data)
+}
+
+// handleIdQRCode sends the identity code of the selected identity as a QR code (GET /id/qr).
+func handleIdQRCode(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeQRCode(w, IdentityCode(id.DisplayName, id.PublicKey))
+}
+
+// writeQRCode sends a QR code as a PNG image.
+func writeQRCode(w http.ResponseWriter, content string) {
+	png, err := qrcode.Encode(content, qrcode.Medium, QR_CODE_SIZE)
+	if err != nil {
+		ReportError(LogWeb, "unable to generate the QR code", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(png)
+}
+
+// handleJobs sends the list of send jobs (/jobs), the status of a single job (GET /jobs/ID),
+// or cancels a job (DELETE /jobs/ID).
+func handleJobs(w http.ResponseWriter, r *http.Request, localId *LocalIdentity) {
+	jobs := localId.Jobs
+	idStr := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if idStr == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(jobs.List(false))
+		w.Write(data)
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		job, err := jobs.Get(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(job)
+		w.Write(data)
+
+	case "DELETE":
+		err := jobs.Cancel(id)
+		if err == ErrJobNotFound {
+			w.WriteHeader(http.StatusNotFound)
+		} else if err == ErrJobFinished {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			ReportError(LogWeb, "unable to update the outbox", err)
+			w.WriteHeader(http.StatusOK)
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleOutbox sends the messages that have not been sent yet (/outbox), a single entry (GET /outbox/ID),
+// edits an entry (PUT /outbox/ID), discards it (DELETE /outbox/ID) or retries it now (POST /outbox/ID/retry).
+func handleOutbox(w http.ResponseWriter, r *http.Request, localId *LocalIdentity) {
+	jobs := localId.Jobs
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/outbox"), "/")
+	if path == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(jobs.List(true))
+		w.Write(data)
+		return
+	}
+
+	idStr := strings.TrimSuffix(path, "/retry")
+	retry := idStr != path
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if job, err := jobs.Get(id); err != nil || !job.IsPending() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case retry && r.Method == "POST":
+		writeOutboxResult(w, jobs, id, jobs.Retry(id))
+
+	case retry:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+	case r.Method == "GET":
+		job, _ := jobs.Get(id)
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(job)
+		w.Write(data)
+
+	case r.Method == "PUT":
+		type OutboxEditRequest struct {
+			Destination string
+			Content     string
+		}
+
+		var edit OutboxEditRequest
+		if err := safeDecode(w, r, &edit); err != nil {
+			return
+		}
+		writeOutboxResult(w, jobs, id, jobs.Edit(id, edit.Content, edit.Destination))
+
+	case r.Method == "DELETE":
+		writeOutboxResult(w, jobs, id, jobs.Cancel(id))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeOutboxResult sends the outcome of an operation on an outbox entry, with the updated entry.
+func writeOutboxResult(w http.ResponseWriter, jobs *JobQueue, id int64, err error) {
+	switch err {
+	case nil:
+	case ErrJobNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case ErrJobFinished, ErrJobBusy, ErrJobNotEditable:
+		w.WriteHeader(http.StatusConflict)
+		return
+	case ErrChannelDestination, ErrUnknownDestination:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	default:
+		ReportError(LogWeb, "unable to update the outbox", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	job, _ := jobs.Get(id)
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(job)
+	w.Write(data)
+}
+
+// handleEvents pushes the updates of the send jobs of a local identity to the client as server-sent events.
+// Unlike the other handlers, it does not run on the main thread, since the connection stays open.
+func handleEvents(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || r.Method != "GET" {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	var updates chan Job
+	Context.RunSync(func() {
+		updates = id.Jobs.Subscribe()
+	})
+	defer Context.RunSync(func() {
+		id.Jobs.Unsubscribe(updates)
+	})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case job := <-updates:
+			data, _ := json.Marshal(job)
+			fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-Context.Running.Done():
+			return
+		}
+	}
+}
+
 // handleNodes sends/updates the list of peers.
 func handleNodes(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
@@ -255,14 +1370,39 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-
-// handleRoutes sends the list of known nodes.
+// handleRoutes sends the list of known nodes: their names, or their names and profiles if the "profiles" query
+// parameter is set.
 func handleRoutes(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
+		nodeList, err := Context.Database.NodeList()
+		if err != nil {
+			ReportError(LogWeb, "unable to load the list of nodes", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("profiles") == "" {
+			w.WriteHeader(http.StatusOK)
+			data, _ := json.Marshal(nodeList)
+			w.Write(data)
+			return
+		}
+
+		type NodeInfo struct {
+			Name    string
+			Profile *ProfileInfo // Latest profile of the node (or of its identity), null if unknown
+		}
+
+		nodes := make([]NodeInfo, 0, len(nodeList))
+		for _, name := range nodeList {
+			node := NodeInfo{Name: name}
+			if profile, found := Context.Profiles.Info(name); found {
+				node.Profile = &profile
+			}
+			nodes = append(nodes, node)
+		}
 		w.WriteHeader(http.StatusOK)
-		nodeList := Context.Database.NodeList()
-		data, _ := json.Marshal(nodeList)
+		data, _ := json.Marshal(nodes)
 		w.Write(data)
 
 	default:
@@ -270,14 +1410,87 @@ func handleRoutes(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleId sends/changes the name of this node.
-func handleId(w http.ResponseWriter, r *http.Request) {
+// handleReplication describes the replication mode of this node, and the light peers that have registered an
+// interest filter.
+func handleReplication(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(Context.ReplicationInfo())
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleId sends the name of the selected local identity.
+func handleId(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
+	switch r.Method {
+	case "GET":
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(id.DisplayName)
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// IdentityInfo describes a local identity (for the client).
+type IdentityInfo struct {
+	Name    string
+	Label   string // Empty for the default identity
+	Primary string // Identity to which this identity belongs (itself, unless it is a linked device)
+}
+
+func identityInfo(id *LocalIdentity) IdentityInfo {
+	return IdentityInfo{id.DisplayName, id.Label, id.Primary()}
+}
+
+// handleIdentities sends the list of the identities hosted by this node (the default identity first).
+func handleIdentities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	identities := make([]IdentityInfo, 0, len(Context.Identities))
+	for _, id := range Context.Identities {
+		identities = append(identities, identityInfo(id))
+	}
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(identities)
+	w.Write(data)
+}
+
+// handleSession sends the identity selected by the client (GET /session), or selects the identity used by the
+// following requests of a browser session (POST /session with {"Identity": ...}, stored in a cookie).
+func handleSession(w http.ResponseWriter, r *http.Request, id *LocalIdentity) {
 	switch r.Method {
 	case "GET":
 		w.WriteHeader(http.StatusOK)
-		data, _ := json.Marshal(Context.DisplayName)
+		data, _ := json.Marshal(identityInfo(id))
 		w.Write(data)
+
+	case "POST":
+		type SessionRequest struct {
+			Identity string
+		}
+
+		var request SessionRequest
+		if err := safeDecode(w, r, &request); err != nil {
+			return
+		}
+		selected := Context.LookupIdentity(request.Identity)
+		if selected == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: IDENTITY_COOKIE, Value: selected.DisplayName, Path: "/", HttpOnly: true,
+			SameSite: http.SameSiteStrictMode})
+		w.WriteHeader(http.StatusOK)
+		data, _ := json.Marshal(identityInfo(selected))
+		w.Write(data)
+
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
-}
\ No newline at end of file
+}